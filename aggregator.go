@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	aggregatorMode = flag.Bool("aggregator", false, "Run as the central aggregator that accepts reports from remote collectors (needs -listen)")
+	aggregatorKeys = flag.String("aggregator-keys", "", `File of "<collector-id> <secret>" lines with the upload key of each collector`)
+	collectorStale = flag.Duration("collector-stale", 5*time.Minute, "Mark a collector missing when it has not uploaded for this long")
+	aggregatorURL  = flag.String("aggregator-url", "", "Upload each report to the aggregator at this URL")
+	collectorID    = flag.String("collector-id", "", "ID this collector uploads as (default: the hostname)")
+	uploadKey      = flag.String("upload-key", "", "Secret used to sign uploads to the aggregator")
+	uploadKeyFile  = flag.String("upload-key-file", "", "File holding the secret used to sign uploads, instead of -upload-key")
+	fleet          = newFleet()
+)
+
+const (
+	// Uploads signed further than this from the aggregator's clock are rejected, which bounds replays
+	maxUploadSkew = 5 * time.Minute
+	// How long run IDs are remembered for deduplication
+	runIDMemory = time.Hour
+	// Largest upload body accepted
+	maxUploadSize = 32 << 20
+)
+
+// signUpload computes the signature of an upload: HMAC-SHA256 over the timestamp, a newline and the body.
+func signUpload(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// uploadReport sends a report summary to the aggregator, signed with the collector's key.
+func uploadReport(s reportSummary) error {
+	key, err := collectorKey()
+	if err != nil {
+		return err
+	}
+	s.Collector = collectorName()
+
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*aggregatorURL, "/")+"/api/v1/upload", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Collector-ID", s.Collector)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signUpload(key, timestamp, body))
+
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("aggregator error: %s", strings.TrimSpace(string(msg)))
+	}
+	fmt.Printf("Uploaded run %s to the aggregator.\n", s.RunID)
+	return nil
+}
+
+func collectorName() string {
+	if *collectorID != "" {
+		return *collectorID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return clusterName
+	}
+	return host
+}
+
+func collectorKey() ([]byte, error) {
+	if *uploadKeyFile != "" {
+		data, err := os.ReadFile(*uploadKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(data), nil
+	}
+	if *uploadKey == "" {
+		return nil, fmt.Errorf("no upload key configured")
+	}
+	return []byte(*uploadKey), nil
+}
+
+// loadAggregatorKeys reads the "<collector-id> <secret>" lines of the keys file.
+func loadAggregatorKeys(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: expected <collector-id> <secret>", path)
+		}
+		keys[fields[0]] = []byte(fields[1])
+	}
+	return keys, scanner.Err()
+}
+
+// collectorState is what the aggregator knows about one remote collector.
+type collectorState struct {
+	ID       string
+	Cluster  string
+	LastSeen time.Time
+	Uploads  int
+	Report   reportSummary
+}
+
+// fleetModel merges the latest report of every collector.
+type fleetModel struct {
+	mu         sync.Mutex
+	keys       map[string][]byte
+	collectors map[string]*collectorState
+	// Run IDs already accepted, with the time they were received
+	seen map[string]time.Time
+}
+
+func newFleet() *fleetModel {
+	return &fleetModel{
+		collectors: make(map[string]*collectorState),
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// verify checks the signature and timestamp of an upload against the collector's key.
+func (f *fleetModel) verify(collector, timestamp, signature string, body []byte) error {
+	f.mu.Lock()
+	key, ok := f.keys[collector]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown collector %q", collector)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(ts, 0)); math.Abs(float64(skew)) > float64(maxUploadSkew) {
+		return fmt.Errorf("timestamp is %v off", skew.Round(time.Second))
+	}
+
+	expected := signUpload(key, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// accept merges an upload, and reports false if its run ID was already accepted.
+func (f *fleetModel) accept(s reportSummary) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range f.seen {
+		if now.Sub(t) > runIDMemory {
+			delete(f.seen, id)
+		}
+	}
+	if _, dup := f.seen[s.RunID]; dup {
+		return false
+	}
+	f.seen[s.RunID] = now
+
+	c := f.collectors[s.Collector]
+	if c == nil {
+		c = &collectorState{ID: s.Collector}
+		f.collectors[s.Collector] = c
+	}
+	c.Uploads++
+	c.LastSeen = now
+	// An upload that arrives late must not replace a newer run
+	if s.Start.After(c.Report.Start) {
+		c.Cluster = s.Cluster
+		c.Report = s
+	}
+	return true
+}
+
+// fleetCollector is a collector in the fleet API.
+type fleetCollector struct {
+	ID         string    `json:"id"`
+	Cluster    string    `json:"cluster"`
+	LastSeen   time.Time `json:"lastSeen"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	Missing    bool      `json:"missing"`
+	Uploads    int       `json:"uploads"`
+	RunID      string    `json:"runId"`
+	Total      int       `json:"total"`
+	Pods       int       `json:"pods"`
+	FailedPods int       `json:"failedPods"`
+}
+
+// fleetView is the merged fleet in the aggregator API. Totals leave out missing collectors,
+// whose last report is too old to be trusted.
+type fleetView struct {
+	Total int `json:"total"`
+	// Estimated distinct clients across the fleet and per cluster; a client of several clusters counts once
+	DistinctClients        float64            `json:"distinctClients"`
+	ClusterDistinctClients map[string]float64 `json:"clusterDistinctClients,omitempty"`
+	Collectors             []fleetCollector   `json:"collectors"`
+	Missing                []string           `json:"missing"`
+	Pods                   []fleetPod         `json:"pods"`
+	Findings               []Finding          `json:"findings"`
+}
+
+type fleetPod struct {
+	Collector string `json:"collector"`
+	Cluster   string `json:"cluster"`
+	podSummary
+}
+
+func (f *fleetModel) view() fleetView {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v := fleetView{Missing: []string{}, Pods: []fleetPod{}, Findings: []Finding{}}
+	now := time.Now()
+	for _, c := range f.collectors {
+		fc := fleetCollector{
+			ID:         c.ID,
+			Cluster:    c.Cluster,
+			LastSeen:   c.LastSeen,
+			AgeSeconds: now.Sub(c.LastSeen).Seconds(),
+			Missing:    now.Sub(c.LastSeen) > *collectorStale,
+			Uploads:    c.Uploads,
+			RunID:      c.Report.RunID,
+			Total:      c.Report.Total,
+			Pods:       len(c.Report.Pods),
+		}
+		for _, p := range c.Report.Pods {
+			if p.Error != "" {
+				fc.FailedPods++
+			}
+		}
+		v.Collectors = append(v.Collectors, fc)
+		if fc.Missing {
+			v.Missing = append(v.Missing, c.ID)
+			continue
+		}
+
+		v.Total += c.Report.Total
+		for _, p := range c.Report.Pods {
+			v.Pods = append(v.Pods, fleetPod{Collector: c.ID, Cluster: c.Cluster, podSummary: p})
+		}
+		v.Findings = append(v.Findings, c.Report.Findings...)
+	}
+
+	// Collectors that have a key but never uploaded are missing too
+	for id := range f.keys {
+		if _, ok := f.collectors[id]; !ok {
+			v.Collectors = append(v.Collectors, fleetCollector{ID: id, Missing: true})
+			v.Missing = append(v.Missing, id)
+		}
+	}
+
+	var all []*hll
+	byCluster := make(map[string][]*hll)
+	for _, p := range v.Pods {
+		all = append(all, p.Clients)
+		byCluster[p.Cluster] = append(byCluster[p.Cluster], p.Clients)
+	}
+	if merged := mergeSketches(all...); merged != nil {
+		v.DistinctClients = merged.estimate()
+		v.ClusterDistinctClients = make(map[string]float64)
+		for cluster, sketches := range byCluster {
+			v.ClusterDistinctClients[cluster] = mergeSketches(sketches...).estimate()
+		}
+	}
+
+	sort.Slice(v.Collectors, func(i, j int) bool { return v.Collectors[i].ID < v.Collectors[j].ID })
+	sort.Strings(v.Missing)
+	sort.Slice(v.Pods, func(i, j int) bool {
+		if v.Pods[i].Collector != v.Pods[j].Collector {
+			return v.Pods[i].Collector < v.Pods[j].Collector
+		}
+		return v.Pods[i].Namespace+"/"+v.Pods[i].Pod < v.Pods[j].Namespace+"/"+v.Pods[j].Pod
+	})
+	return v
+}
+
+// addMetrics adds the merged metrics: each fresh collector's report labelled with its cluster and ID,
+// the fleet total, and the freshness of every collector.
+func (f *fleetModel) addMetrics(m *metricWriter) {
+	v := f.view()
+	m.add("client_tcp_fleet_total", "Established TCP connections across all collectors that are not missing.", nil, float64(v.Total))
+	m.add("client_tcp_fleet_distinct_clients", "Estimated distinct clients across all collectors that are not missing.", nil, v.DistinctClients)
+	clusters := make([]string, 0, len(v.ClusterDistinctClients))
+	for cluster := range v.ClusterDistinctClients {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		m.add("client_tcp_cluster_distinct_clients", "Estimated distinct clients across the collectors of a cluster.", map[string]string{"cluster": cluster}, v.ClusterDistinctClients[cluster])
+	}
+	for _, c := range v.Collectors {
+		labels := map[string]string{"collector": c.ID, "cluster": c.Cluster}
+		up := 1.0
+		if c.Missing {
+			up = 0
+		}
+		m.add("client_tcp_collector_up", "Whether the collector has uploaded recently.", labels, up)
+		if !c.LastSeen.IsZero() {
+			m.add("client_tcp_collector_last_upload_timestamp_seconds", "Time of the collector's last accepted upload.", labels, float64(c.LastSeen.Unix()))
+		}
+	}
+
+	f.mu.Lock()
+	reports := make([]*collectorState, 0, len(f.collectors))
+	for _, c := range f.collectors {
+		reports = append(reports, c)
+	}
+	f.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+	for _, c := range reports {
+		if time.Since(c.LastSeen) > *collectorStale {
+			continue
+		}
+		m.addSummary(c.Report, map[string]string{"collector": c.ID, "cluster": c.Cluster})
+	}
+}
+
+// handleUpload accepts a signed report from a remote collector.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxUploadSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collector := r.Header.Get("X-Collector-ID")
+	if err := fleet.verify(collector, r.Header.Get("X-Timestamp"), r.Header.Get("X-Signature"), body); err != nil {
+		fmt.Printf("Rejected upload from %q: %v\n", collector, err)
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var s reportSummary
+	if err := json.Unmarshal(body, &s); err != nil {
+		http.Error(w, fmt.Sprintf("invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+	if s.RunID == "" {
+		http.Error(w, "report has no run ID", http.StatusBadRequest)
+		return
+	}
+	// The signed header is authoritative for who sent the report
+	s.Collector = collector
+
+	status := "accepted"
+	if !fleet.accept(s) {
+		status = "duplicate"
+	}
+	fmt.Printf("Upload from %s, run %s: %s\n", collector, s.RunID, status)
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// handleFleet returns the merged fleet.
+func handleFleet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, fleet.view())
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"age": func(seconds float64) string { return (time.Duration(seconds) * time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>client_tcp_new fleet</title>
+<meta http-equiv="refresh" content="30">
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+.missing { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Fleet total: {{.Total}}</h1>
+<p>Distinct clients: {{printf "%.0f" .DistinctClients}}</p>
+<h2>Collectors</h2>
+<table>
+<tr><th>Collector</th><th>Cluster</th><th>Last upload</th><th>Status</th><th>Total</th><th>Pods</th><th>Failed pods</th></tr>
+{{range .Collectors}}<tr{{if .Missing}} class="missing"{{end}}>
+<td>{{.ID}}</td><td>{{.Cluster}}</td>
+<td>{{if .LastSeen.IsZero}}never{{else}}{{age .AgeSeconds}} ago{{end}}</td>
+<td>{{if .Missing}}MISSING{{else}}ok{{end}}</td>
+<td>{{.Total}}</td><td>{{.Pods}}</td><td>{{.FailedPods}}</td>
+</tr>
+{{end}}</table>
+{{if .Findings}}<h2>Findings</h2>
+<table>
+<tr><th>Severity</th><th>Kind</th><th>Message</th></tr>
+{{range .Findings}}<tr><td>{{.Severity}}</td><td>{{.Kind}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Pods</h2>
+<table>
+<tr><th>Cluster</th><th>Collector</th><th>Namespace</th><th>Pod</th><th>Connections</th><th>Error</th></tr>
+{{range .Pods}}<tr><td>{{.Cluster}}</td><td>{{.Collector}}</td><td>{{.Namespace}}</td><td>{{.Pod}}</td><td>{{.Count}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// handleDashboard renders the merged fleet as an HTML page.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, fleet.view()); err != nil {
+		fmt.Printf("Error rendering dashboard: %v\n", err)
+	}
+}
+
+// runAggregator serves the aggregator API until the process exits.
+func runAggregator() error {
+	if *listenAddr == "" {
+		return fmt.Errorf("aggregator mode needs -listen")
+	}
+	if *aggregatorKeys == "" {
+		return fmt.Errorf("aggregator mode needs -aggregator-keys")
+	}
+	keys, err := loadAggregatorKeys(*aggregatorKeys)
+	if err != nil {
+		return fmt.Errorf("failed to load aggregator keys: %v", err)
+	}
+	fleet.keys = keys
+	fmt.Printf("Aggregating reports from %d collectors\n", len(keys))
+
+	serve(*listenAddr)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startAggregator serves uploads into a fresh fleet that knows the given collector keys.
+func startAggregator(t *testing.T, keys map[string][]byte) *httptest.Server {
+	t.Helper()
+	saved := fleet
+	fleet = newFleet()
+	fleet.keys = keys
+	t.Cleanup(func() { fleet = saved })
+
+	srv := httptest.NewServer(http.HandlerFunc(handleUpload))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// postUpload sends a body to the aggregator with the given signing headers.
+func postUpload(t *testing.T, url, collector, timestamp, signature string, body []byte) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url+"/api/v1/upload", bytes.NewReader(body))
+	req.Header.Set("X-Collector-ID", collector)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signature)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAggregatorUpload(t *testing.T) {
+	srv := startAggregator(t, map[string][]byte{"eks-a": []byte("secret-a"), "eks-b": []byte("secret-b")})
+	setFlag(t, aggregatorURL, srv.URL)
+	setFlag(t, collectorID, "eks-a")
+	setFlag(t, uploadKey, "secret-a")
+
+	s := reportSummary{RunID: "run-1", Cluster: "eks-a", Start: time.Now(), Total: 7, Pods: []podSummary{{Namespace: "fpms", Pod: "client-a-1", Count: 7}}}
+	if err := uploadReport(s); err != nil {
+		t.Fatal(err)
+	}
+	// A replayed run is acknowledged without being counted again
+	if err := uploadReport(s); err != nil {
+		t.Fatal(err)
+	}
+
+	v := fleet.view()
+	if v.Total != 7 || len(v.Collectors) != 2 || v.Collectors[0].Uploads != 1 {
+		t.Errorf("fleet = %+v", v)
+	}
+	// eks-b has a key but never uploaded
+	if len(v.Missing) != 1 || v.Missing[0] != "eks-b" {
+		t.Errorf("missing = %v, want [eks-b]", v.Missing)
+	}
+
+	// A late upload of an older run is counted but does not replace the newer one
+	older := s
+	older.RunID, older.Start, older.Total = "run-0", s.Start.Add(-time.Minute), 3
+	if err := uploadReport(older); err != nil {
+		t.Fatal(err)
+	}
+	if v := fleet.view(); v.Total != 7 || v.Collectors[0].Uploads != 2 || v.Collectors[0].RunID != "run-1" {
+		t.Errorf("after a late upload: %+v", v.Collectors[0])
+	}
+}
+
+func TestAggregatorRejects(t *testing.T) {
+	srv := startAggregator(t, map[string][]byte{"eks-a": []byte("secret-a"), "eks-b": []byte("secret-b")})
+	body, _ := json.Marshal(reportSummary{RunID: "run-1", Start: time.Now()})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-maxUploadSkew-time.Minute).Unix(), 10)
+	ahead := strconv.FormatInt(time.Now().Add(maxUploadSkew+time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name, collector, timestamp, signature string
+		body                                  []byte
+		code                                  int
+	}{
+		{"valid", "eks-a", now, signUpload([]byte("secret-a"), now, body), body, http.StatusOK},
+		{"wrong key", "eks-a", now, signUpload([]byte("secret-b"), now, body), body, http.StatusUnauthorized},
+		{"posing as another collector", "eks-b", now, signUpload([]byte("secret-a"), now, body), body, http.StatusUnauthorized},
+		{"unknown collector", "eks-c", now, signUpload([]byte("secret-a"), now, body), body, http.StatusUnauthorized},
+		{"tampered body", "eks-a", now, signUpload([]byte("secret-a"), now, body), append(body[:len(body):len(body)], ' '), http.StatusUnauthorized},
+		{"signature over another timestamp", "eks-a", now, signUpload([]byte("secret-a"), stale, body), body, http.StatusUnauthorized},
+		{"replayed after the skew", "eks-a", stale, signUpload([]byte("secret-a"), stale, body), body, http.StatusUnauthorized},
+		{"from the future", "eks-a", ahead, signUpload([]byte("secret-a"), ahead, body), body, http.StatusUnauthorized},
+		{"invalid timestamp", "eks-a", "yesterday", signUpload([]byte("secret-a"), "yesterday", body), body, http.StatusUnauthorized},
+		{"no signature", "eks-a", now, "", body, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := postUpload(t, srv.URL, tt.collector, tt.timestamp, tt.signature, tt.body); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+	}
+	if v := fleet.view(); v.Collectors[0].Uploads != 1 || v.Collectors[1].Uploads != 0 {
+		t.Errorf("rejected uploads were merged: %+v", v.Collectors)
+	}
+
+	noRunID := []byte(`{"start": "2024-01-01T00:00:00Z"}`)
+	if code := postUpload(t, srv.URL, "eks-a", now, signUpload([]byte("secret-a"), now, noRunID), noRunID); code != http.StatusBadRequest {
+		t.Errorf("upload without a run ID: status %d, want 400", code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// analyzeManifestEntry maps a dump file to the pod it was taken from.
+type analyzeManifestEntry struct {
+	File      string            `json:"file" yaml:"file"`
+	Pod       string            `json:"pod" yaml:"pod"`
+	Namespace string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// Suffixes stripped from a dump's file name to get the pod name, e.g. "client-a-1_tcp6.txt" -> "client-a-1"
+var dumpNameSuffixes = []string{"_tcp6", "_tcp", "-tcp6", "-tcp", "_ss", "-ss", "_netstat", "-netstat"}
+
+// runAnalyze is the analyze command. It reads captured /proc/net/tcp, `ss -tan` or `netstat -tn` dumps
+// and prints a report on them like a live run would, without sending it anywhere:
+//
+//	check-conn-script analyze [-manifest manifest.yaml] [-namespace ns] [dump ...]
+//
+// Each file's pod comes from the manifest, or else from the file name. Several files for the same pod
+// (e.g. tcp and tcp6) are merged.
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	manifest := fs.String("manifest", "", "JSON/YAML manifest mapping dump files to pods")
+	ns := fs.String("namespace", namespace, "Namespace of pods whose dumps are not in the manifest")
+	fs.Parse(args)
+
+	var entries []analyzeManifestEntry
+	if *manifest != "" {
+		var err error
+		if entries, err = readAnalyzeManifest(*manifest); err != nil {
+			return err
+		}
+	}
+	for _, file := range fs.Args() {
+		entries = append(entries, analyzeManifestEntry{File: file, Pod: podFromDumpName(file)})
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no dumps to analyze")
+	}
+
+	startTime := time.Now()
+	byPod := make(map[string]*PodResult)
+	var order []string
+	for _, e := range entries {
+		if e.Namespace == "" {
+			e.Namespace = *ns
+		}
+		key := e.Namespace + "/" + e.Pod
+		r := byPod[key]
+		if r == nil {
+			labels := map[string]string{"namespace": e.Namespace, "pod": e.Pod}
+			for k, v := range e.Labels {
+				labels["label_"+sanitizeLabelName(k)] = v
+			}
+			r = &PodResult{Target: Target{Namespace: e.Namespace, Pod: e.Pod, Labels: labels}}
+			byPod[key] = r
+			order = append(order, key)
+		}
+
+		data, err := os.ReadFile(e.File)
+		if err != nil {
+			return err
+		}
+		sockets, err := parseSocketDump(data)
+		if err != nil {
+			fmt.Printf("Failed to parse %s: %v\n", e.File, err)
+			r.Err = fmt.Errorf("%s: %v", e.File, err)
+			continue
+		}
+		fmt.Printf("Read %d sockets for pod %s from %s\n", len(sockets), e.Pod, e.File)
+		r.Sockets = append(r.Sockets, sockets...)
+	}
+
+	sort.Strings(order)
+	report := &Report{RunID: newRunID(), Start: startTime}
+	for _, key := range order {
+		r := byPod[key]
+		if r.Err == nil {
+			*r = newPodResult(r.Target, r.Sockets)
+		}
+		report.Pods = append(report.Pods, *r)
+		report.Total += r.Count
+	}
+	report.Duration = time.Since(startTime)
+
+	return printOffline(report)
+}
+
+// printOffline prints the report of dumps and its findings. Dumps are not the cluster as it is now, so
+// unlike process it sends nothing to the sinks or alerts, and checks nothing against the live cluster:
+// no -service EndpointSlices, and a canary split only against weights that don't come from a VirtualService.
+func printOffline(report *Report) error {
+	printReport(report)
+	fmt.Printf("Total TCP connections counted: %d\n", report.Total)
+	printFindings(report.Findings)
+	if *canaryVirtualService != "" {
+		fmt.Println("Skipping the canary split check, its VirtualService is live cluster state")
+		return nil
+	}
+	if canaryEnabled() {
+		return checkCanarySplit(report)
+	}
+	return nil
+}
+
+// readAnalyzeManifest reads a manifest; relative file paths are resolved against the manifest's directory.
+func readAnalyzeManifest(path string) ([]analyzeManifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []analyzeManifestEntry
+	if isYAMLPath(path) {
+		err = yaml.Unmarshal(data, &entries)
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
+	}
+
+	for i, e := range entries {
+		if e.File == "" {
+			return nil, fmt.Errorf("manifest entry %d has no file", i)
+		}
+		if !filepath.IsAbs(e.File) {
+			entries[i].File = filepath.Join(filepath.Dir(path), e.File)
+		}
+		if e.Pod == "" {
+			entries[i].Pod = podFromDumpName(e.File)
+		}
+	}
+	return entries, nil
+}
+
+// podFromDumpName takes the pod name from a dump's file name: everything before the first dot,
+// without a trailing format suffix such as "_tcp6" or "-ss".
+func podFromDumpName(path string) string {
+	name := filepath.Base(path)
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	for _, suffix := range dumpNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
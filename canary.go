@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	canaryVirtualService = flag.String("canary-virtualservice", "", "Verify the connection split against the weights of this Istio VirtualService")
+	canaryWeights        = flag.String("canary-weights", "", `Verify the connection split against explicit weights ("stable=90,canary=10"), or "replicas" to use the replica ratio`)
+	canarySubsetLabel    = flag.String("canary-subset-label", "version", "Pod label whose value names the subset when -canary-weights is used")
+	canaryTolerance      = flag.Float64("canary-tolerance", 5, "Allowed deviation between intended and observed share, in percentage points")
+)
+
+// canarySubset is one group of pods that is meant to receive a given share of the traffic.
+type canarySubset struct {
+	Name   string
+	Weight float64
+	// Labels a pod must carry to belong to the subset
+	Labels map[string]string
+}
+
+func canaryEnabled() bool {
+	return *canaryVirtualService != "" || *canaryWeights != ""
+}
+
+// subsetShare is the intended and observed traffic share of one subset, in percent.
+type subsetShare struct {
+	Name        string  `json:"name"`
+	Pods        int     `json:"pods"`
+	Connections int     `json:"connections"`
+	Intended    float64 `json:"intended"`
+	Observed    float64 `json:"observed"`
+	Deviation   float64 `json:"deviation"`
+	Pass        bool    `json:"pass"`
+}
+
+// splitCheck is the outcome of comparing subsets' intended weights with their observed connections.
+type splitCheck struct {
+	Subsets []subsetShare
+	// Connections on pods that belong to no subset
+	Unassigned int
+	Failed     []string
+}
+
+// evaluateSplit compares the intended weight of each subset with its observed share of connections.
+// Pods whose collection failed are left out.
+func evaluateSplit(report *Report, subsets []canarySubset, tolerance float64) (*splitCheck, error) {
+	var totalWeight float64
+	for _, s := range subsets {
+		totalWeight += s.Weight
+	}
+	if totalWeight <= 0 {
+		return nil, fmt.Errorf("weights add up to zero")
+	}
+
+	pods := make([]int, len(subsets))
+	conns := make([]int, len(subsets))
+	check := &splitCheck{}
+	var assigned int
+	for _, r := range report.Pods {
+		if r.Err != nil {
+			fmt.Printf("Pod %s is left out of the split check: %v\n", r.Target.Pod, r.Err)
+			continue
+		}
+		i := subsetOf(r.Target, subsets)
+		if i < 0 {
+			check.Unassigned += r.Count
+			continue
+		}
+		pods[i]++
+		conns[i] += r.Count
+		assigned += r.Count
+	}
+	if assigned == 0 {
+		return nil, fmt.Errorf("no connections observed in any subset")
+	}
+
+	for i, s := range subsets {
+		share := subsetShare{
+			Name:        s.Name,
+			Pods:        pods[i],
+			Connections: conns[i],
+			Intended:    100 * s.Weight / totalWeight,
+			Observed:    100 * float64(conns[i]) / float64(assigned),
+		}
+		share.Deviation = share.Observed - share.Intended
+		share.Pass = math.Abs(share.Deviation) <= tolerance
+		if !share.Pass {
+			check.Failed = append(check.Failed, s.Name)
+		}
+		check.Subsets = append(check.Subsets, share)
+	}
+	return check, nil
+}
+
+// checkCanarySplit prints the canary split check and returns an error if any subset deviates
+// by more than the tolerance.
+func checkCanarySplit(report *Report) error {
+	subsets, err := canarySubsets(report)
+	if err != nil {
+		return fmt.Errorf("failed to read canary weights: %v", err)
+	}
+	check, err := evaluateSplit(report, subsets, *canaryTolerance)
+	if err != nil {
+		return fmt.Errorf("canary split check: %v", err)
+	}
+
+	fmt.Printf("Canary split check (tolerance ±%.1f percentage points):\n", *canaryTolerance)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  SUBSET\tPODS\tCONNECTIONS\tINTENDED\tOBSERVED\tDEVIATION\tRESULT")
+	for _, s := range check.Subsets {
+		result := "PASS"
+		if !s.Pass {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%.1f%%\t%.1f%%\t%+.1f\t%s\n", s.Name, s.Pods, s.Connections, s.Intended, s.Observed, s.Deviation, result)
+	}
+	w.Flush()
+	if check.Unassigned > 0 {
+		fmt.Printf("Connections on pods outside every subset: %d\n", check.Unassigned)
+	}
+
+	if len(check.Failed) > 0 {
+		return fmt.Errorf("canary split check failed for subsets %v", check.Failed)
+	}
+	fmt.Println("Canary split check passed.")
+	return nil
+}
+
+// subsetOf returns the index of the first subset whose labels all match the pod, or -1.
+func subsetOf(t Target, subsets []canarySubset) int {
+	for i, s := range subsets {
+		matched := true
+		for k, v := range s.Labels {
+			if podLabel(t, k) != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
+
+// podLabel looks up a Kubernetes pod label on a target, whether it was discovered through kubectl
+// (stored as label_<name>) or through file_sd (stored either way).
+func podLabel(t Target, key string) string {
+	if v, ok := t.Labels["label_"+sanitizeLabelName(key)]; ok {
+		return v
+	}
+	return t.Labels[key]
+}
+
+// canarySubsets returns the subsets and their intended weights from whichever source is configured.
+func canarySubsets(report *Report) ([]canarySubset, error) {
+	switch {
+	case *canaryVirtualService != "":
+		return virtualServiceSubsets(*canaryVirtualService)
+	case *canaryWeights == "replicas":
+		return replicaSubsets(report, *canarySubsetLabel), nil
+	default:
+		return explicitSubsets(*canaryWeights)
+	}
+}
+
+// explicitSubsets parses weights in the form "stable=90,canary=10", where each name is a value of the subset label.
+func explicitSubsets(spec string) ([]canarySubset, error) {
+	var subsets []canarySubset
+	for _, part := range strings.Split(spec, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid weight %q, expected name=weight", part)
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q for subset %s", weight, name)
+		}
+		subsets = append(subsets, canarySubset{
+			Name:   name,
+			Weight: w,
+			Labels: map[string]string{*canarySubsetLabel: name},
+		})
+	}
+	return subsets, nil
+}
+
+// replicaSubsets weights each value of a pod label by its number of pods, which is the split
+// plain Service load balancing aims for.
+func replicaSubsets(report *Report, label string) []canarySubset {
+	replicas := make(map[string]int)
+	for _, r := range report.Pods {
+		if v := podLabel(r.Target, label); v != "" {
+			replicas[v]++
+		}
+	}
+
+	var subsets []canarySubset
+	for name, n := range replicas {
+		subsets = append(subsets, canarySubset{
+			Name:   name,
+			Weight: float64(n),
+			Labels: map[string]string{label: name},
+		})
+	}
+	sort.Slice(subsets, func(i, j int) bool { return subsets[i].Name < subsets[j].Name })
+	return subsets
+}
+
+type virtualService struct {
+	Spec struct {
+		HTTP []struct {
+			Match []json.RawMessage `json:"match"`
+			Route []struct {
+				Destination struct {
+					Host   string `json:"host"`
+					Subset string `json:"subset"`
+				} `json:"destination"`
+				Weight *float64 `json:"weight"`
+			} `json:"route"`
+		} `json:"http"`
+	} `json:"spec"`
+}
+
+type destinationRuleList struct {
+	Items []struct {
+		Spec struct {
+			Host    string `json:"host"`
+			Subsets []struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"subsets"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// virtualServiceSubsets reads the weights of the default HTTP route of a VirtualService, and resolves
+// each destination subset to pod labels through the DestinationRule for the same host.
+func virtualServiceSubsets(name string) ([]canarySubset, error) {
+	out, err := runCommand("discovery", kubectl("get", "virtualservice", name, "-n", namespace, "-o", "json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VirtualService %s: %v: %s", name, err, commandStderr(err))
+	}
+	var vs virtualService
+	if err := json.Unmarshal(out, &vs); err != nil {
+		return nil, fmt.Errorf("failed to parse VirtualService %s: %v", name, err)
+	}
+	if len(vs.Spec.HTTP) == 0 {
+		return nil, fmt.Errorf("VirtualService %s has no HTTP routes", name)
+	}
+
+	// The route without match conditions is the one that carries the bulk of the traffic
+	route := vs.Spec.HTTP[0]
+	for _, r := range vs.Spec.HTTP {
+		if len(r.Match) == 0 {
+			route = r
+			break
+		}
+	}
+
+	out, err = runCommand("discovery", kubectl("get", "destinationrules", "-n", namespace, "-o", "json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DestinationRules: %v: %s", err, commandStderr(err))
+	}
+	var rules destinationRuleList
+	if err := json.Unmarshal(out, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse DestinationRules: %v", err)
+	}
+
+	var subsets []canarySubset
+	for _, dest := range route.Route {
+		weight := 100.0
+		if dest.Weight != nil {
+			weight = *dest.Weight
+		} else if len(route.Route) > 1 {
+			weight = 0
+		}
+
+		labels, err := subsetLabels(rules, dest.Destination.Host, dest.Destination.Subset)
+		if err != nil {
+			return nil, err
+		}
+		name := dest.Destination.Subset
+		if name == "" {
+			name = dest.Destination.Host
+		}
+		subsets = append(subsets, canarySubset{Name: name, Weight: weight, Labels: labels})
+	}
+	return subsets, nil
+}
+
+// subsetLabels finds the pod labels of a named subset in the DestinationRule for a host.
+// A destination without a subset matches every pod.
+func subsetLabels(rules destinationRuleList, host, subset string) (map[string]string, error) {
+	if subset == "" {
+		return map[string]string{}, nil
+	}
+	for _, rule := range rules.Items {
+		if shortHost(rule.Spec.Host) != shortHost(host) {
+			continue
+		}
+		for _, s := range rule.Spec.Subsets {
+			if s.Name == subset {
+				return s.Labels, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DestinationRule defines subset %s for host %s", subset, host)
+}
+
+// shortHost reduces "svc.ns.svc.cluster.local" to "svc" so short and fully qualified hosts compare equal.
+func shortHost(host string) string {
+	name, _, _ := strings.Cut(host, ".")
+	return name
+}
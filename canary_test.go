@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// canaryPod is a pod of the given version subset with n connections.
+func canaryPod(name, version string, n int) PodResult {
+	return PodResult{Target: Target{Namespace: "fpms", Pod: name, Labels: map[string]string{"label_version": version}}, Count: n}
+}
+
+func TestEvaluateSplitTolerance(t *testing.T) {
+	subsets, err := explicitSubsets("stable=90,canary=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		stable, canary int
+		failed         []string
+	}{
+		{90, 10, nil},
+		{86, 14, nil},
+		// Exactly the tolerance still passes
+		{85, 15, nil},
+		{84, 16, []string{"stable", "canary"}},
+		{100, 0, []string{"stable", "canary"}},
+	}
+	for _, tt := range tests {
+		report := &Report{Pods: []PodResult{
+			canaryPod("client-stable-1", "stable", tt.stable),
+			canaryPod("client-canary-1", "canary", tt.canary),
+		}}
+		check, err := evaluateSplit(report, subsets, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(check.Failed, tt.failed) {
+			t.Errorf("%d/%d: failed subsets %v, want %v", tt.stable, tt.canary, check.Failed, tt.failed)
+		}
+	}
+}
+
+func TestEvaluateSplitLeavesOut(t *testing.T) {
+	subsets, _ := explicitSubsets("stable=50,canary=50")
+	report := &Report{Pods: []PodResult{
+		canaryPod("client-stable-1", "stable", 30),
+		canaryPod("client-canary-1", "canary", 30),
+		// Failed pods count for nothing, pods outside every subset are reported apart
+		{Target: Target{Pod: "client-canary-2", Labels: map[string]string{"label_version": "canary"}}, Count: 100, Err: errors.New("exec failed")},
+		canaryPod("client-debug-1", "debug", 7),
+	}}
+	check, err := evaluateSplit(report, subsets, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Failed) != 0 || check.Unassigned != 7 {
+		t.Errorf("failed %v, unassigned %d, want none and 7", check.Failed, check.Unassigned)
+	}
+	if s := check.Subsets[1]; s.Pods != 1 || s.Connections != 30 || s.Observed != 50 || s.Intended != 50 {
+		t.Errorf("canary share = %+v", s)
+	}
+
+	if _, err := evaluateSplit(&Report{Pods: []PodResult{canaryPod("client-debug-1", "debug", 7)}}, subsets, 5); err == nil {
+		t.Errorf("no error without connections in any subset")
+	}
+	if _, err := evaluateSplit(report, []canarySubset{{Name: "stable"}}, 5); err == nil {
+		t.Errorf("no error for weights adding up to zero")
+	}
+}
+
+func TestCanarySubsetSources(t *testing.T) {
+	for _, spec := range []string{"stable", "stable=ninety", "stable=-1"} {
+		if _, err := explicitSubsets(spec); err == nil {
+			t.Errorf("explicitSubsets(%q) accepted", spec)
+		}
+	}
+
+	report := &Report{Pods: []PodResult{
+		canaryPod("client-stable-1", "stable", 0),
+		canaryPod("client-stable-2", "stable", 0),
+		canaryPod("client-stable-3", "stable", 0),
+		canaryPod("client-canary-1", "canary", 0),
+	}}
+	got := replicaSubsets(report, "version")
+	want := []canarySubset{
+		{Name: "canary", Weight: 1, Labels: map[string]string{"version": "canary"}},
+		{Name: "stable", Weight: 3, Labels: map[string]string{"version": "stable"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replicaSubsets = %+v, want %+v", got, want)
+	}
+}
+
+func TestVirtualServiceSubsets(t *testing.T) {
+	standInKubectl(t, `case "$2" in
+virtualservice) cat <<'EOF'
+{"spec": {"http": [
+  {"match": [{"headers": {"x-canary": {"exact": "1"}}}], "route": [{"destination": {"host": "client-apiserver", "subset": "canary"}}]},
+  {"route": [
+    {"destination": {"host": "client-apiserver.fpms.svc.cluster.local", "subset": "stable"}, "weight": 80},
+    {"destination": {"host": "client-apiserver", "subset": "canary"}, "weight": 20}
+  ]}
+]}}
+EOF
+;;
+destinationrules) cat <<'EOF'
+{"items": [{"spec": {"host": "client-apiserver.fpms.svc.cluster.local", "subsets": [
+  {"name": "stable", "labels": {"version": "v1"}},
+  {"name": "canary", "labels": {"version": "v2"}}
+]}}]}
+EOF
+;;
+esac
+`)
+	subsets, err := virtualServiceSubsets("client-apiserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The default route, not the header match, with subsets resolved through the DestinationRule
+	want := []canarySubset{
+		{Name: "stable", Weight: 80, Labels: map[string]string{"version": "v1"}},
+		{Name: "canary", Weight: 20, Labels: map[string]string{"version": "v2"}},
+	}
+	if !reflect.DeepEqual(subsets, want) {
+		t.Errorf("subsets = %+v, want %+v", subsets, want)
+	}
+}
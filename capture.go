@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	captureDir      = flag.String("capture-dir", "captures", "Directory capture bundles are written to")
+	captureCooldown = flag.Duration("capture-cooldown", 10*time.Minute, "Minimum time between captures triggered through the API or by Alertmanager")
+)
+
+// captureSections are what the capture script collects in each pod, and the file each is stored in.
+// Nothing is installed during an incident, so the ss sections fall back to netstat and may be missing.
+var captureSections = []struct{ name, command string }{
+	{"tcp.txt", "cat /proc/net/tcp"},
+	{"tcp6.txt", "cat /proc/net/tcp6"},
+	{"ss.txt", "ss -tanoie || netstat -tanpe"},
+	{"listeners.txt", "ss -tlnpe || netstat -tlnpe"},
+	{"sockstat.txt", "cat /proc/net/sockstat /proc/net/sockstat6"},
+	{"snmp.txt", "cat /proc/net/snmp"},
+	{"netstat.txt", "cat /proc/net/netstat"},
+}
+
+// captureMarker starts each section in the script output
+const captureMarker = "@@check-conn-capture "
+
+// captureFile is a file of a bundle, listed in its manifest.
+type captureFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// capturedPod is what was captured from one pod.
+type capturedPod struct {
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	IP        string            `json:"ip,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Files     []captureFile     `json:"files"`
+	Errors    []string          `json:"errors,omitempty"`
+
+	data map[string][]byte
+}
+
+// captureManifest is manifest.json at the root of a bundle.
+type captureManifest struct {
+	Name     string        `json:"name"`
+	Cluster  string        `json:"cluster"`
+	Created  time.Time     `json:"created"`
+	Duration float64       `json:"durationSeconds"`
+	Trigger  string        `json:"trigger"`
+	Reason   string        `json:"reason,omitempty"`
+	Pods     []capturedPod `json:"pods"`
+}
+
+// captureScript prints every section after its marker, with errors inline.
+func captureScript() string {
+	var b strings.Builder
+	for _, s := range captureSections {
+		fmt.Fprintf(&b, "echo '%s%s'; { %s; } 2>&1\n", captureMarker, s.name, s.command)
+	}
+	return b.String()
+}
+
+// splitCaptureOutput splits the script output into its sections.
+func splitCaptureOutput(out []byte) map[string][]byte {
+	sections := make(map[string][]byte)
+	var current string
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		if name, ok := bytes.CutPrefix(line, []byte(captureMarker)); ok {
+			current = strings.TrimSpace(string(name))
+			sections[current] = []byte{}
+			continue
+		}
+		if current != "" {
+			sections[current] = append(sections[current], line...)
+		}
+	}
+	return sections
+}
+
+// capturePod captures one pod, or one EC2 instance over SSH. Failures are recorded with what was captured.
+func capturePod(t Target, token string) capturedPod {
+	c := capturedPod{Namespace: t.Namespace, Pod: t.Pod, IP: t.IP, Labels: t.Labels, data: make(map[string][]byte)}
+	fail := func(format string, args ...interface{}) {
+		c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+	}
+
+	var cmd *exec.Cmd
+	switch t.Backend {
+	case backendSSH:
+		cmd = sshCommand(t, captureScript())
+	case backendAgent:
+		fail("capture is not supported for targets collected through the agent")
+		return c
+	default:
+		cmd = kubectl("exec", "-n", t.Namespace, t.Pod, "--", "sh", "-c", captureScript())
+		cmd.Env = append(cmd.Env, fmt.Sprintf("KUBECONFIG=%s", token))
+	}
+	fmt.Printf("Capturing pod: %s\n", t.Pod)
+	out, err := runCommand("exec", cmd)
+	if err != nil {
+		fail("capture script: %v", err)
+	}
+	for name, data := range splitCaptureOutput(out) {
+		c.data[name] = data
+	}
+
+	if t.Backend == "" {
+		metadata := []struct {
+			name string
+			args []string
+		}{
+			{"pod.yaml", []string{"get", "pod", "-n", t.Namespace, t.Pod, "-o", "yaml"}},
+			{"events.yaml", []string{"get", "events", "-n", t.Namespace, "--field-selector", "involvedObject.name=" + t.Pod, "-o", "yaml"}},
+		}
+		for _, m := range metadata {
+			out, err := runCommand("discovery", kubectl(m.args...))
+			if err != nil {
+				fail("%s: %v", m.name, err)
+				continue
+			}
+			c.data[m.name] = out
+		}
+	}
+
+	for name, data := range c.data {
+		sum := sha256.Sum256(data)
+		c.Files = append(c.Files, captureFile{Name: name, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Name < c.Files[j].Name })
+	return c
+}
+
+// captureTargets captures every target in parallel and writes the bundle to -capture-dir, returning its path.
+func captureTargets(name string, targets []Target, trigger, reason string) (string, error) {
+	startTime := time.Now()
+	var token string
+	for _, t := range targets {
+		if t.Backend != "" {
+			continue
+		}
+		var err error
+		if token, err = getToken(); err != nil {
+			return "", fmt.Errorf("error fetching token: %v", err)
+		}
+		break
+	}
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, maxConcurrentConnections)
+	pods := make([]capturedPod, len(targets))
+	for i, t := range targets {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, t Target) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			pods[i] = capturePod(t, token)
+		}(i, t)
+	}
+	wg.Wait()
+
+	m := captureManifest{
+		Name:     name,
+		Cluster:  clusterName,
+		Created:  startTime.UTC(),
+		Duration: time.Since(startTime).Seconds(),
+		Trigger:  trigger,
+		Reason:   reason,
+		Pods:     pods,
+	}
+	return writeCaptureBundle(m)
+}
+
+// writeCaptureBundle writes the bundle as <name>.tar.gz, holding manifest.json, pods/<namespace>/<pod>/
+// and analyze.json, a manifest for the analyze command over the captured /proc/net/tcp tables.
+func writeCaptureBundle(m captureManifest) (string, error) {
+	if err := os.MkdirAll(*captureDir, 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(*captureDir, "."+m.Name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: path.Join(m.Name, name), Mode: 0o644, Size: int64(len(data)), ModTime: m.Created.Truncate(time.Second)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	analyze := []analyzeManifestEntry{}
+	for _, p := range m.Pods {
+		dir := path.Join("pods", p.Namespace, p.Pod)
+		for _, f := range p.Files {
+			if err := add(path.Join(dir, f.Name), p.data[f.Name]); err != nil {
+				tmp.Close()
+				return "", err
+			}
+			// Only tables that were read, not the error of a missing tcp6
+			if (f.Name == "tcp.txt" || f.Name == "tcp6.txt") && bytes.HasPrefix(bytes.TrimSpace(p.data[f.Name]), []byte("sl")) {
+				analyze = append(analyze, analyzeManifestEntry{File: path.Join(dir, f.Name), Pod: p.Pod, Namespace: p.Namespace})
+			}
+		}
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = add("manifest.json", manifest)
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(analyze, "", "  "); err == nil {
+			err = add("analyze.json", data)
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	bundle := filepath.Join(*captureDir, m.Name+".tar.gz")
+	if err := os.Rename(tmp.Name(), bundle); err != nil {
+		return "", err
+	}
+	fmt.Printf("Wrote capture bundle %s (%d pods)\n", bundle, len(m.Pods))
+	return bundle, nil
+}
+
+func newCaptureName(t time.Time) string {
+	return "capture-" + clusterName + "-" + t.UTC().Format("20060102T150405Z")
+}
+
+// runCapture is the capture command. It captures the socket tables, kernel counters, pod metadata and
+// events of every matched pod into a bundle for offline analysis:
+//
+//	check-conn-script [-capture-dir captures] capture [-reason "api latency page"]
+//	tar xzf captures/capture-fpms-prod-20240101T120000Z.tar.gz
+//	check-conn-script analyze -manifest capture-fpms-prod-20240101T120000Z/analyze.json
+func runCapture(args []string) error {
+	fs := flag.NewFlagSet("capture", flag.ExitOnError)
+	reason := fs.String("reason", "", "Why the capture was taken, recorded in the manifest")
+	fs.Parse(args)
+	if privacyEnabled() {
+		fmt.Printf("Warning: capture bundles hold the raw socket tables, -privacy does not apply to them\n")
+	}
+
+	targets, err := discoverTargets()
+	if err != nil {
+		return err
+	}
+	_, err = captureTargets(newCaptureName(time.Now()), targets, "command", *reason)
+	return err
+}
+
+// captureStatus is the state of captures triggered through the API.
+type captureStatus struct {
+	Running  bool      `json:"running"`
+	Bundle   string    `json:"bundle,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	captureMu   sync.Mutex
+	lastCapture captureStatus
+)
+
+// errCapturePrivacy refuses captures and downloads through the API while peers are anonymized, since
+// bundles hold the raw socket tables.
+var errCapturePrivacy = fmt.Errorf("capture bundles hold raw peer addresses; run with -privacy none to capture through the API")
+
+// startCapture starts a capture in the background unless one is running, or one started within the
+// cooldown. It returns the bundle name, or the reason it did not start.
+func startCapture(trigger, reason string, cooldown time.Duration, match func(Target) bool) (string, error) {
+	if privacyEnabled() {
+		return "", errCapturePrivacy
+	}
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if lastCapture.Running {
+		return "", fmt.Errorf("capture %s is still running", lastCapture.Bundle)
+	}
+	now := time.Now()
+	if cooldown > 0 && now.Sub(lastCapture.Started) < cooldown {
+		return "", fmt.Errorf("capture %s started less than %v ago", lastCapture.Bundle, cooldown)
+	}
+
+	name := newCaptureName(now)
+	lastCapture = captureStatus{Running: true, Bundle: name, Started: now}
+	go func() {
+		targets, err := discoverTargets()
+		var bundle string
+		if err == nil {
+			var matched []Target
+			for _, t := range targets {
+				if match == nil || match(t) {
+					matched = append(matched, t)
+				}
+			}
+			bundle, err = captureTargets(name, matched, trigger, reason)
+		}
+
+		captureMu.Lock()
+		defer captureMu.Unlock()
+		lastCapture.Running = false
+		lastCapture.Finished = time.Now()
+		if err != nil {
+			fmt.Printf("Capture failed: %v\n", err)
+			lastCapture.Error = err.Error()
+		} else {
+			lastCapture.Bundle = bundle
+		}
+	}()
+	return name, nil
+}
+
+// handleCapture starts a capture on POST, with an optional reason parameter, at most once per
+// -capture-cooldown. GET returns the state of the last capture, or with a bundle parameter downloads
+// that bundle from -capture-dir.
+func handleCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if name := r.URL.Query().Get("bundle"); name != "" {
+			serveCaptureBundle(w, r, name)
+			return
+		}
+		captureMu.Lock()
+		status := lastCapture
+		captureMu.Unlock()
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodPost:
+		name, err := startCapture("api", r.URL.Query().Get("reason"), *captureCooldown, nil)
+		if err == errCapturePrivacy {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"bundle": name})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveCaptureBundle sends a bundle of -capture-dir, named with or without its .tar.gz suffix.
+func serveCaptureBundle(w http.ResponseWriter, r *http.Request, name string) {
+	if privacyEnabled() {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": errCapturePrivacy.Error()})
+		return
+	}
+	name = strings.TrimSuffix(name, ".tar.gz")
+	if !strings.HasPrefix(name, "capture-") || name != filepath.Base(name) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid bundle name %q", name)})
+		return
+	}
+	f, err := os.Open(filepath.Join(*captureDir, name+".tar.gz"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("no bundle %s", name)})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	http.ServeContent(w, r, name+".tar.gz", info.ModTime(), f)
+}
+
+// alertmanagerWebhook is the part of the Alertmanager webhook payload captures look at.
+type alertmanagerWebhook struct {
+	Status string `json:"status"`
+	Alerts []struct {
+		Status string            `json:"status"`
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+// handleCaptureAlertmanager is an Alertmanager webhook receiver that captures while alerts fire, at most
+// once per -capture-cooldown. When every firing alert names a pod, only those pods are captured.
+// Skipped captures still answer 200 so Alertmanager does not retry them.
+func handleCaptureAlertmanager(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var hook alertmanagerWebhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, fmt.Sprintf("invalid webhook payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	pods := make(map[string]bool)
+	allPods := true
+	for _, a := range hook.Alerts {
+		if a.Status != "firing" {
+			continue
+		}
+		if name := a.Labels["alertname"]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		if a.Labels["pod"] == "" {
+			allPods = false
+			continue
+		}
+		ns := a.Labels["namespace"]
+		if ns == "" {
+			ns = namespace
+		}
+		pods[ns+"/"+a.Labels["pod"]] = true
+	}
+	if len(names) == 0 {
+		writeJSON(w, http.StatusOK, map[string]string{"skipped": "no firing alerts"})
+		return
+	}
+
+	var match func(Target) bool
+	if allPods {
+		match = func(t Target) bool { return pods[t.Namespace+"/"+t.Pod] }
+	}
+	sort.Strings(names)
+	reason := "alerts: " + strings.Join(names, ", ")
+	name, err := startCapture("alertmanager", reason, *captureCooldown, match)
+	if err != nil {
+		fmt.Printf("Skipping capture for %s: %v\n", reason, err)
+		writeJSON(w, http.StatusOK, map[string]string{"skipped": err.Error()})
+		return
+	}
+	fmt.Printf("Capturing for %s\n", reason)
+	writeJSON(w, http.StatusAccepted, map[string]string{"bundle": name})
+}
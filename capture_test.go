@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// captureRequest sends a request to the capture API.
+func captureRequest(method, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleCapture(rec, httptest.NewRequest(method, "/api/v1/capture"+query, nil))
+	return rec
+}
+
+func TestCaptureAPICooldown(t *testing.T) {
+	captureMu.Lock()
+	lastCapture = captureStatus{Bundle: "capture-test-1", Started: time.Now().Add(-time.Minute), Finished: time.Now()}
+	captureMu.Unlock()
+	t.Cleanup(func() { lastCapture = captureStatus{} })
+
+	rec := captureRequest(http.MethodPost, "?reason=test")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("capture a minute after the last one: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCaptureAPIDownload(t *testing.T) {
+	setFlag(t, captureDir, t.TempDir())
+	m := captureManifest{
+		Name:    "capture-test-20240101T120000Z",
+		Cluster: clusterName,
+		Created: time.Now(),
+		Pods: []capturedPod{{
+			Namespace: "fpms",
+			Pod:       "client-a-1",
+			Files:     []captureFile{{Name: "tcp.txt"}},
+			data:      map[string][]byte{"tcp.txt": []byte("  sl  local_address rem_address   st\n")},
+		}},
+	}
+	if _, err := writeCaptureBundle(m); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{m.Name, m.Name + ".tar.gz"} {
+		rec := captureRequest(http.MethodGet, "?bundle="+name)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("download %s: status %d: %s", name, rec.Code, rec.Body)
+		}
+		if body, _ := io.ReadAll(rec.Body); !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+			t.Errorf("download %s is not gzipped", name)
+		}
+	}
+
+	tests := []struct {
+		bundle string
+		code   int
+	}{
+		{"../" + m.Name, http.StatusBadRequest},
+		{"manifest.json", http.StatusBadRequest},
+		{"capture-test-20240101T130000Z", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := captureRequest(http.MethodGet, "?bundle="+tt.bundle); rec.Code != tt.code {
+			t.Errorf("download %s: status %d, want %d", tt.bundle, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestCaptureAPIRefusedWithPrivacy(t *testing.T) {
+	setFlag(t, privacyMode, "truncate")
+	if rec := captureRequest(http.MethodPost, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("capture with -privacy truncate: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := captureRequest(http.MethodGet, "?bundle=capture-test-20240101T120000Z"); rec.Code != http.StatusForbidden {
+		t.Errorf("download with -privacy truncate: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	chaosSpec = flag.String("chaos", "", `Inject faults for resilience testing: "layer:fault=rate[@duration],..." with layers discovery, token, exec and sink and faults latency, error, truncate, garbage and hang, e.g. "exec:hang=0.1,exec:latency=0.5@2s,sink:error=0.2"`)
+	chaosSeed = flag.Int64("chaos-seed", 0, "Seed for -chaos, for reproducible runs (default: random)")
+)
+
+// Layers faults can be injected into
+var chaosLayers = map[string]bool{"discovery": true, "token": true, "exec": true, "sink": true}
+
+// Faults: latency delays the call, error fails it, truncate cuts its output short in the middle of a line,
+// garbage replaces the output with random bytes and hang makes it never finish, leaving it to the timeouts.
+var chaosKinds = map[string]bool{"latency": true, "error": true, "truncate": true, "garbage": true, "hang": true}
+
+type chaosFault struct {
+	layer, kind string
+	rate        float64
+	latency     time.Duration
+}
+
+var (
+	chaosFaults []chaosFault
+	chaosMu     sync.Mutex
+	chaosRand   *rand.Rand
+	// Faults injected so far, by layer:fault
+	chaosInjected = make(map[string]int)
+)
+
+// setupChaos parses -chaos.
+func setupChaos() error {
+	if *chaosSpec == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(*chaosSpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		layer, kind, ok2 := strings.Cut(name, ":")
+		if !ok || !ok2 || !chaosLayers[layer] || !chaosKinds[kind] {
+			return fmt.Errorf("invalid -chaos entry %q: want layer:fault=rate with a layer of discovery, token, exec or sink and a fault of latency, error, truncate, garbage or hang", entry)
+		}
+		f := chaosFault{layer: layer, kind: kind}
+		rate, duration, hasDuration := strings.Cut(value, "@")
+		var err error
+		if f.rate, err = strconv.ParseFloat(rate, 64); err != nil || f.rate < 0 || f.rate > 1 {
+			return fmt.Errorf("invalid -chaos rate %q: must be between 0 and 1", rate)
+		}
+		if kind == "latency" {
+			if !hasDuration {
+				return fmt.Errorf("-chaos latency needs a duration, e.g. %s=%s@2s", name, rate)
+			}
+			if f.latency, err = time.ParseDuration(duration); err != nil {
+				return fmt.Errorf("invalid -chaos latency %q: %v", duration, err)
+			}
+		}
+		chaosFaults = append(chaosFaults, f)
+	}
+
+	seed := *chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	chaosRand = rand.New(rand.NewSource(seed))
+	sinkClient.Transport = chaosTransport{layer: "sink", next: sinkClient.Transport}
+	agentClient.Transport = chaosTransport{layer: "exec", next: agentClient.Transport}
+	fmt.Printf("Chaos enabled with seed %d: %s\n", seed, *chaosSpec)
+	return nil
+}
+
+// chaosFor rolls the faults of a layer for one call. It returns the latency to add and the one other
+// fault to inject, if any.
+func chaosFor(layer string) (time.Duration, string) {
+	if len(chaosFaults) == 0 {
+		return 0, ""
+	}
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+
+	var latency time.Duration
+	kind := ""
+	for _, f := range chaosFaults {
+		if f.layer != layer || chaosRand.Float64() >= f.rate {
+			continue
+		}
+		if f.kind == "latency" {
+			latency += f.latency
+		} else if kind == "" {
+			kind = f.kind
+		} else {
+			continue
+		}
+		chaosInjected[layer+":"+f.kind]++
+	}
+	return latency, kind
+}
+
+// chaosOutput applies an output fault to what a call returned.
+func chaosOutput(kind string, out []byte) []byte {
+	switch kind {
+	case "truncate":
+		if len(out) == 0 {
+			return out
+		}
+		chaosMu.Lock()
+		defer chaosMu.Unlock()
+		// Output cut right after a newline reads as a complete table with fewer sockets, which nothing
+		// downstream can tell from the real thing, so the cut always falls within a line
+		n := chaosRand.Intn(len(out))
+		for n > 0 && out[n-1] == '\n' {
+			n--
+		}
+		return out[:n]
+	case "garbage":
+		chaosMu.Lock()
+		defer chaosMu.Unlock()
+		garbage := make([]byte, max(len(out), 64))
+		chaosRand.Read(garbage)
+		return garbage
+	}
+	return out
+}
+
+// chaosCommand injects the faults of a layer around a command. A hang replaces the command with one that
+// never finishes, so the command timeout has to deal with it exactly as with a real one.
+func chaosCommand(layer string, cmd *exec.Cmd, run func(*exec.Cmd) ([]byte, error)) ([]byte, error) {
+	latency, kind := chaosFor(layer)
+	time.Sleep(latency)
+	switch kind {
+	case "error":
+		return nil, fmt.Errorf("chaos: injected %s error", layer)
+	case "hang":
+		cmd = exec.Command("sleep", "2147483647")
+	}
+	out, err := run(cmd)
+	return chaosOutput(kind, out), err
+}
+
+// chaosTransport injects the faults of a layer into HTTP requests. A hang blocks until the client
+// timeout cancels the request.
+type chaosTransport struct {
+	layer string
+	next  http.RoundTripper
+}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	latency, kind := chaosFor(t.layer)
+	time.Sleep(latency)
+	switch kind {
+	case "error":
+		return nil, fmt.Errorf("chaos: injected %s error", t.layer)
+	case "hang":
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil || (kind != "truncate" && kind != "garbage") {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = chaosOutput(kind, body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// printChaos lists the faults injected so far.
+func printChaos() {
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+	keys := make([]string, 0, len(chaosInjected))
+	for k := range chaosInjected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{"none"}
+	if len(keys) > 0 {
+		parts = parts[:0]
+	}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, chaosInjected[k]))
+	}
+	fmt.Printf("Chaos faults injected so far: %s\n", strings.Join(parts, " "))
+}
+
+// addChaos exports the faults injected so far.
+func (m *metricWriter) addChaos() {
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+	keys := make([]string, 0, len(chaosInjected))
+	for k := range chaosInjected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		layer, kind, _ := strings.Cut(k, ":")
+		m.add("client_tcp_chaos_injected_total", "Faults injected by -chaos since start, by layer and fault.", map[string]string{"layer": layer, "fault": kind}, float64(chaosInjected[k]))
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	cloudWatchNamespace   = flag.String("cloudwatch-namespace", "", "Publish totals and per-workload aggregates to CloudWatch under this metric namespace")
+	cloudWatchRegion      = flag.String("cloudwatch-region", "", "Region for the CloudWatch sink, defaulting to the aws CLI configuration")
+	cloudWatchEndpointURL = flag.String("cloudwatch-endpoint-url", "", "CloudWatch API endpoint, e.g. a local stand-in")
+	cloudWatchHighRes     = flag.Bool("cloudwatch-high-resolution", false, "Publish CloudWatch metrics at 1 second resolution")
+	cloudWatchEMF         = flag.String("cloudwatch-emf", "", "Write the CloudWatch metrics as Embedded Metric Format log lines to this file (- for stdout) instead of calling PutMetricData")
+)
+
+const (
+	// Most metrics PutMetricData accepts per call
+	cloudWatchBatchSize = 1000
+	// Most metrics an EMF document may hold
+	emfMaxMetrics = 100
+)
+
+type cloudWatchDimension struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// cloudWatchDatum is one entry of the PutMetricData MetricData list.
+type cloudWatchDatum struct {
+	MetricName        string                `json:"MetricName"`
+	Dimensions        []cloudWatchDimension `json:"Dimensions"`
+	Timestamp         time.Time             `json:"Timestamp"`
+	Value             float64               `json:"Value"`
+	Unit              string                `json:"Unit"`
+	StorageResolution int                   `json:"StorageResolution,omitempty"`
+}
+
+// Pod name suffixes workloads add: StatefulSet ordinals and DaemonSet/Job random suffixes
+var (
+	ordinalSuffix = regexp.MustCompile(`-[0-9]+$`)
+	randomSuffix  = regexp.MustCompile(`-[a-z0-9]{5}$`)
+)
+
+// workloadOf names the workload a target belongs to: the pod name without the ReplicaSet hash and random
+// suffix for Deployments and Rollouts, or without the ordinal or random suffix otherwise. EC2 instances
+// belong to their Auto Scaling group, or stand alone.
+func workloadOf(t Target) string {
+	if t.Namespace == ec2Namespace {
+		if asg := t.Labels["tag_aws_autoscaling_groupName"]; asg != "" {
+			return asg
+		}
+		return t.Pod
+	}
+	for _, label := range []string{"label_" + sanitizeLabelName(defaultRevisionLabel), "label_" + sanitizeLabelName(fallbackRevisionLabel)} {
+		if hash := t.Labels[label]; hash != "" {
+			if i := strings.LastIndex(t.Pod, "-"+hash+"-"); i > 0 {
+				return t.Pod[:i]
+			}
+		}
+	}
+	if loc := ordinalSuffix.FindStringIndex(t.Pod); loc != nil && loc[0] > 0 {
+		return t.Pod[:loc[0]]
+	}
+	if loc := randomSuffix.FindStringIndex(t.Pod); loc != nil && loc[0] > 0 {
+		return t.Pod[:loc[0]]
+	}
+	return t.Pod
+}
+
+// cloudWatchData turns a report into CloudWatch metrics: the totals with a Cluster dimension, and per
+// workload with Cluster, Namespace and Workload dimensions.
+func cloudWatchData(r *Report) []cloudWatchDatum {
+	resolution := 0
+	if *cloudWatchHighRes {
+		resolution = 1
+	}
+	var data []cloudWatchDatum
+	add := func(name, unit string, v float64, dims ...cloudWatchDimension) {
+		data = append(data, cloudWatchDatum{
+			MetricName:        name,
+			Dimensions:        dims,
+			Timestamp:         r.Start,
+			Value:             v,
+			Unit:              unit,
+			StorageResolution: resolution,
+		})
+	}
+	cluster := cloudWatchDimension{Name: "Cluster", Value: clusterName}
+	if r.Skipped != "" {
+		add("SkippedRuns", "Count", 1, cluster)
+		return data
+	}
+	add("SkippedRuns", "Count", 0, cluster)
+
+	failed := 0
+	for _, p := range r.Pods {
+		if p.Err != nil {
+			failed++
+		}
+	}
+	add("Connections", "Count", float64(r.Total), cluster)
+	add("Pods", "Count", float64(len(r.Pods)), cluster)
+	add("FailedPods", "Count", float64(failed), cluster)
+
+	type workload struct {
+		namespace, name           string
+		conns, pods, failed, idle int
+		max                       int
+		hasTCPInfo                bool
+	}
+	workloads := make(map[string]*workload)
+	var order []string
+	for _, p := range r.Pods {
+		name := workloadOf(p.Target)
+		key := p.Target.Namespace + "/" + name
+		w := workloads[key]
+		if w == nil {
+			w = &workload{namespace: p.Target.Namespace, name: name}
+			workloads[key] = w
+			order = append(order, key)
+		}
+		w.pods++
+		if p.Err != nil {
+			w.failed++
+			continue
+		}
+		w.conns += p.Count
+		w.max = max(w.max, p.Count)
+		if p.TCPInfo != nil {
+			w.hasTCPInfo = true
+			w.idle += p.TCPInfo.Idle
+		}
+	}
+	for _, key := range order {
+		w := workloads[key]
+		dims := []cloudWatchDimension{cluster, {Name: "Namespace", Value: w.namespace}, {Name: "Workload", Value: w.name}}
+		add("Connections", "Count", float64(w.conns), dims...)
+		add("Pods", "Count", float64(w.pods), dims...)
+		add("FailedPods", "Count", float64(w.failed), dims...)
+		add("MaxPodConnections", "Count", float64(w.max), dims...)
+		if w.hasTCPInfo {
+			add("IdleConnections", "Count", float64(w.idle), dims...)
+		}
+	}
+	return data
+}
+
+// sendToCloudWatch publishes the report's metrics with PutMetricData, or writes them as EMF log lines.
+func sendToCloudWatch(r *Report) error {
+	data := cloudWatchData(r)
+	if *cloudWatchEMF != "" {
+		return writeEMF(*cloudWatchEMF, data)
+	}
+	for start := 0; start < len(data); start += cloudWatchBatchSize {
+		if err := putMetricData(data[start:min(start+cloudWatchBatchSize, len(data))]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Sent %d metrics to CloudWatch namespace %s\n", len(data), *cloudWatchNamespace)
+	return nil
+}
+
+// putMetricData makes one PutMetricData call through the aws CLI, which uses the same credential
+// configuration as the EKS token.
+func putMetricData(batch []cloudWatchDatum) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	// Batches are too large for a command line argument
+	tmp, err := os.CreateTemp("", "cloudwatch-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	args := []string{"cloudwatch", "put-metric-data", "--namespace", *cloudWatchNamespace, "--metric-data", "file://" + tmp.Name()}
+	if *cloudWatchRegion != "" {
+		args = append(args, "--region", *cloudWatchRegion)
+	}
+	if *cloudWatchEndpointURL != "" {
+		args = append(args, "--endpoint-url", *cloudWatchEndpointURL)
+	}
+	if _, err := runCommand("sink", awsCommand(args...)); err != nil {
+		return fmt.Errorf("PutMetricData failed: %v: %s", err, commandStderr(err))
+	}
+	return nil
+}
+
+// writeEMF appends one Embedded Metric Format document per dimension set to path, for the CloudWatch agent
+// or Lambda to turn into metrics.
+func writeEMF(path string, data []cloudWatchDatum) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	type emfMetric struct {
+		Name              string `json:"Name"`
+		Unit              string `json:"Unit"`
+		StorageResolution int    `json:"StorageResolution,omitempty"`
+	}
+	type emfDoc struct {
+		fields    map[string]interface{}
+		dims      []string
+		metrics   []emfMetric
+		timestamp time.Time
+	}
+	var docs []*emfDoc
+	byDims := make(map[string]*emfDoc)
+	for _, d := range data {
+		var names, values []string
+		for _, dim := range d.Dimensions {
+			names = append(names, dim.Name)
+			values = append(values, dim.Value)
+		}
+		// A document has one timestamp, so data of another time goes into another document
+		key := strings.Join(names, "\x00") + "\x01" + strings.Join(values, "\x00") + "\x01" + fmt.Sprint(d.Timestamp.UnixMilli())
+		doc := byDims[key]
+		if doc == nil || len(doc.metrics) == emfMaxMetrics {
+			doc = &emfDoc{fields: make(map[string]interface{}), dims: names, timestamp: d.Timestamp}
+			for _, dim := range d.Dimensions {
+				doc.fields[dim.Name] = dim.Value
+			}
+			byDims[key] = doc
+			docs = append(docs, doc)
+		}
+		doc.fields[d.MetricName] = d.Value
+		doc.metrics = append(doc.metrics, emfMetric{Name: d.MetricName, Unit: d.Unit, StorageResolution: d.StorageResolution})
+	}
+
+	for _, doc := range docs {
+		doc.fields["_aws"] = map[string]interface{}{
+			"Timestamp": doc.timestamp.UnixMilli(),
+			"CloudWatchMetrics": []interface{}{map[string]interface{}{
+				"Namespace":  *cloudWatchNamespace,
+				"Dimensions": [][]string{doc.dims},
+				"Metrics":    doc.metrics,
+			}},
+		}
+		line, err := json.Marshal(doc.fields)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	if path != "-" {
+		fmt.Printf("Wrote %d CloudWatch EMF documents to %s\n", len(docs), path)
+	}
+	return nil
+}
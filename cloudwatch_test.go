@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCloudWatchHelperProcess is not a test: it is the aws stand-in standInCloudWatch installs, enabled by
+// CHECK_CONN_TEST_AWS.
+func TestCloudWatchHelperProcess(t *testing.T) {
+	if os.Getenv("CHECK_CONN_TEST_AWS") != "1" {
+		return
+	}
+	args := os.Args
+	for i, a := range args {
+		if a == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Exit(fakeAWS(args))
+}
+
+// fakeAWS handles `aws cloudwatch put-metric-data`: it checks the request against the PutMetricData API
+// and posts the namespace and metric data as JSON to the --endpoint-url, leaving request signing and the
+// query protocol out. Invalid requests fail the way the CLI does.
+func fakeAWS(args []string) int {
+	if len(args) < 2 || args[0] != "cloudwatch" || args[1] != "put-metric-data" {
+		fmt.Fprintf(os.Stderr, "unsupported command %q\n", args)
+		return 2
+	}
+	var namespace, endpoint string
+	var data []byte
+	for i := 2; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--namespace":
+			namespace = args[i+1]
+		case "--endpoint-url":
+			endpoint = args[i+1]
+		case "--metric-data":
+			b, err := os.ReadFile(strings.TrimPrefix(args[i+1], "file://"))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 255
+			}
+			data = b
+		}
+	}
+	if err := checkPutMetricData(namespace, data); err != nil {
+		fmt.Fprintf(os.Stderr, "An error occurred (InvalidParameterValue) when calling the PutMetricData operation: %v\n", err)
+		return 254
+	}
+	body, _ := json.Marshal(map[string]interface{}{"Namespace": namespace, "MetricData": json.RawMessage(data)})
+	resp, err := http.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 255
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "An error occurred (%d) when calling the PutMetricData operation\n", resp.StatusCode)
+		return 254
+	}
+	return 0
+}
+
+// putMetricDataDatum is a MetricDatum as the PutMetricData API documents it.
+type putMetricDataDatum struct {
+	MetricName string
+	Dimensions []struct {
+		Name  string
+		Value string
+	}
+	Timestamp       *time.Time
+	Value           *float64
+	StatisticValues *struct{ SampleCount, Sum, Minimum, Maximum float64 }
+	Values          []float64
+	Counts          []float64
+	Unit            string
+	// 1 for high resolution, 60 for standard; 0 is left out
+	StorageResolution int
+}
+
+// cloudWatchUnits are the units PutMetricData accepts.
+var cloudWatchUnits = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true, "Bytes": true, "Kilobytes": true,
+	"Megabytes": true, "Gigabytes": true, "Terabytes": true, "Bits": true, "Kilobits": true, "Megabits": true,
+	"Gigabits": true, "Terabits": true, "Percent": true, "Count": true, "Bytes/Second": true,
+	"Kilobytes/Second": true, "Megabytes/Second": true, "Gigabytes/Second": true, "Terabytes/Second": true,
+	"Bits/Second": true, "Kilobits/Second": true, "Megabits/Second": true, "Gigabits/Second": true,
+	"Terabits/Second": true, "Count/Second": true, "None": true,
+}
+
+// checkPutMetricData checks a --metric-data document against the PutMetricData limits: at most 1000
+// metrics in at most 1 MB, no fields the API does not know, names and dimensions within their lengths,
+// a documented unit and a storage resolution of 1 or 60 seconds.
+func checkPutMetricData(namespace string, data []byte) error {
+	if namespace == "" || len(namespace) > 255 || strings.HasPrefix(namespace, "AWS/") {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	if len(data) > 1<<20 {
+		return fmt.Errorf("request of %d bytes exceeds 1 MB", len(data))
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var metrics []putMetricDataDatum
+	if err := dec.Decode(&metrics); err != nil {
+		return fmt.Errorf("invalid metric data: %v", err)
+	}
+	if len(metrics) == 0 || len(metrics) > 1000 {
+		return fmt.Errorf("%d metrics, want 1 to 1000", len(metrics))
+	}
+	for i, m := range metrics {
+		if m.MetricName == "" || len(m.MetricName) > 255 {
+			return fmt.Errorf("metric %d: invalid MetricName %q", i, m.MetricName)
+		}
+		if len(m.Dimensions) > 30 {
+			return fmt.Errorf("%s: %d dimensions, at most 30", m.MetricName, len(m.Dimensions))
+		}
+		for _, d := range m.Dimensions {
+			if d.Name == "" || len(d.Name) > 255 || d.Value == "" || len(d.Value) > 1024 {
+				return fmt.Errorf("%s: invalid dimension %q=%q", m.MetricName, d.Name, d.Value)
+			}
+		}
+		if m.Value == nil && m.StatisticValues == nil && m.Values == nil {
+			return fmt.Errorf("%s: no Value, StatisticValues or Values", m.MetricName)
+		}
+		if m.Unit != "" && !cloudWatchUnits[m.Unit] {
+			return fmt.Errorf("%s: unknown unit %q", m.MetricName, m.Unit)
+		}
+		if m.StorageResolution != 0 && m.StorageResolution != 1 && m.StorageResolution != 60 {
+			return fmt.Errorf("%s: StorageResolution %d, want 1 or 60", m.MetricName, m.StorageResolution)
+		}
+	}
+	return nil
+}
+
+type putMetricDataCall struct {
+	Namespace  string
+	MetricData []cloudWatchDatum
+}
+
+// standInCloudWatch serves PutMetricData on a local HTTP stand-in and points -cloudwatch-endpoint-url
+// at it, with TestCloudWatchHelperProcess as the aws CLI.
+func standInCloudWatch(t *testing.T) func() []putMetricDataCall {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []putMetricDataCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call putMetricDataCall
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\nexec '" + self + "' -test.run='^TestCloudWatchHelperProcess$' -- \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "aws"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("CHECK_CONN_TEST_AWS", "1")
+	setFlag(t, cloudWatchEndpointURL, server.URL)
+	setFlag(t, cloudWatchNamespace, "CheckConn")
+
+	return func() []putMetricDataCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func TestSendToCloudWatch(t *testing.T) {
+	calls := standInCloudWatch(t)
+	*cloudWatchHighRes = true
+	t.Cleanup(func() { *cloudWatchHighRes = false })
+
+	// 250 workloads of 4 metrics each and 4 cluster metrics need two calls
+	r := &Report{RunID: newRunID(), Start: time.Now().Truncate(time.Millisecond)}
+	for i := 0; i < 250; i++ {
+		target := Target{Namespace: "fpms", Pod: fmt.Sprintf("client-%d-0", i)}
+		r.Pods = append(r.Pods, PodResult{Target: target, Count: i})
+		r.Total += i
+	}
+	if err := sendToCloudWatch(r); err != nil {
+		t.Fatal(err)
+	}
+
+	got := calls()
+	if len(got) != 2 || len(got[0].MetricData) != 1000 || len(got[1].MetricData) != 4 {
+		var sizes []int
+		for _, c := range got {
+			sizes = append(sizes, len(c.MetricData))
+		}
+		t.Fatalf("got calls of %v metrics, want [1000 4]", sizes)
+	}
+	for _, call := range got {
+		if call.Namespace != "CheckConn" {
+			t.Errorf("namespace = %q", call.Namespace)
+		}
+		for _, d := range call.MetricData {
+			if d.StorageResolution != 1 {
+				t.Fatalf("%s has StorageResolution %d, want 1", d.MetricName, d.StorageResolution)
+			}
+			if !d.Timestamp.Equal(r.Start) {
+				t.Fatalf("%s has timestamp %v, want %v", d.MetricName, d.Timestamp, r.Start)
+			}
+		}
+	}
+
+	first := got[0].MetricData
+	if first[0].MetricName != "SkippedRuns" || len(first[0].Dimensions) != 1 || first[0].Dimensions[0] != (cloudWatchDimension{"Cluster", clusterName}) {
+		t.Errorf("first metric = %+v, want SkippedRuns by cluster", first[0])
+	}
+	if first[1].MetricName != "Connections" || first[1].Value != float64(r.Total) {
+		t.Errorf("second metric = %+v, want the total connections", first[1])
+	}
+	want := []cloudWatchDimension{{"Cluster", clusterName}, {"Namespace", "fpms"}, {"Workload", "client-7"}}
+	for _, d := range append(first, got[1].MetricData...) {
+		if d.MetricName == "Connections" && len(d.Dimensions) == 3 && d.Dimensions[2].Value == "client-7" {
+			if fmt.Sprint(d.Dimensions) != fmt.Sprint(want) || d.Value != 7 {
+				t.Errorf("client-7 connections = %+v, want 7 with dimensions %v", d, want)
+			}
+			return
+		}
+	}
+	t.Errorf("no Connections metric for workload client-7")
+}
+
+func TestWriteEMF(t *testing.T) {
+	setFlag(t, cloudWatchNamespace, "CheckConn")
+	now := time.Now().Truncate(time.Millisecond)
+	earlier := now.Add(-time.Minute)
+	dims := []cloudWatchDimension{{"Cluster", clusterName}}
+	var data []cloudWatchDatum
+	for i := 0; i < 150; i++ {
+		data = append(data, cloudWatchDatum{MetricName: fmt.Sprintf("M%d", i), Dimensions: dims, Timestamp: now, Value: float64(i), Unit: "Count"})
+	}
+	data = append(data, cloudWatchDatum{MetricName: "Earlier", Dimensions: dims, Timestamp: earlier, Value: 1, Unit: "Count"})
+
+	path := filepath.Join(t.TempDir(), "emf.log")
+	if err := writeEMF(path, data); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	type emfLine struct {
+		AWS struct {
+			Timestamp         int64 `json:"Timestamp"`
+			CloudWatchMetrics []struct {
+				Namespace  string     `json:"Namespace"`
+				Dimensions [][]string `json:"Dimensions"`
+				Metrics    []struct {
+					Name string `json:"Name"`
+				} `json:"Metrics"`
+			} `json:"CloudWatchMetrics"`
+		} `json:"_aws"`
+		Cluster string `json:"Cluster"`
+	}
+	var lines []emfLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var line emfLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d documents, want 3", len(lines))
+	}
+	wantMetrics := []int{100, 50, 1}
+	wantTimes := []int64{now.UnixMilli(), now.UnixMilli(), earlier.UnixMilli()}
+	for i, line := range lines {
+		cw := line.AWS.CloudWatchMetrics
+		if len(cw) != 1 || cw[0].Namespace != "CheckConn" || fmt.Sprint(cw[0].Dimensions) != "[[Cluster]]" || line.Cluster != clusterName {
+			t.Errorf("document %d: %+v", i, line)
+			continue
+		}
+		if len(cw[0].Metrics) != wantMetrics[i] {
+			t.Errorf("document %d has %d metrics, want %d", i, len(cw[0].Metrics), wantMetrics[i])
+		}
+		if line.AWS.Timestamp != wantTimes[i] {
+			t.Errorf("document %d has timestamp %d, want %d", i, line.AWS.Timestamp, wantTimes[i])
+		}
+	}
+}
+
+func TestCheckPutMetricData(t *testing.T) {
+	datum := cloudWatchDatum{MetricName: "Connections", Dimensions: []cloudWatchDimension{{"Cluster", clusterName}}, Timestamp: time.Now(), Value: 1, Unit: "Count"}
+	batch := func(n int, edit func(*cloudWatchDatum)) []byte {
+		var data []cloudWatchDatum
+		for i := 0; i < n; i++ {
+			d := datum
+			if edit != nil {
+				edit(&d)
+			}
+			data = append(data, d)
+		}
+		b, _ := json.Marshal(data)
+		return b
+	}
+	tests := []struct {
+		name      string
+		namespace string
+		data      []byte
+		ok        bool
+	}{
+		{"valid", "CheckConn", batch(1000, nil), true},
+		{"high resolution", "CheckConn", batch(1, func(d *cloudWatchDatum) { d.StorageResolution = 1 }), true},
+		{"too many metrics", "CheckConn", batch(1001, nil), false},
+		{"AWS namespace", "AWS/EC2", batch(1, nil), false},
+		{"unknown unit", "CheckConn", batch(1, func(d *cloudWatchDatum) { d.Unit = "Connections" }), false},
+		{"bad resolution", "CheckConn", batch(1, func(d *cloudWatchDatum) { d.StorageResolution = 5 }), false},
+		{"empty dimension", "CheckConn", batch(1, func(d *cloudWatchDatum) { d.Dimensions = []cloudWatchDimension{{"Workload", ""}} }), false},
+		{"unknown field", "CheckConn", []byte(`[{"MetricName": "Connections", "Value": 1, "Dimension": []}]`), false},
+		{"too large", "CheckConn", []byte(`[{"MetricName": "` + strings.Repeat("x", 1<<20) + `", "Value": 1}]`), false},
+	}
+	for _, tt := range tests {
+		if err := checkPutMetricData(tt.namespace, tt.data); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	configMapName      = flag.String("configmap", "", "Write a summary of each run to this ConfigMap ([namespace/]name) for in-cluster consumers")
+	configMapThreshold = flag.Float64("configmap-threshold", 0.1, "Relative change of the total or a pod's count that updates the ConfigMap")
+	configMapMaxAge    = flag.Duration("configmap-max-age", 10*time.Minute, "Update the ConfigMap at least this often even when nothing changed, so consumers can tell it is fresh")
+	configMapForce     = flag.Bool("configmap-force-conflicts", false, "Take over ConfigMap fields owned by another field manager instead of failing")
+)
+
+const (
+	configMapFieldManager = "check-conn"
+	// ConfigMaps are limited to 1MiB; leave room for the object metadata
+	configMapMaxBytes = 900 * 1024
+	// Longest error message kept per pod
+	configMapMaxError = 256
+)
+
+// configMapSummary is the summary.json key of the ConfigMap.
+type configMapSummary struct {
+	RunID     string            `json:"runId"`
+	Cluster   string            `json:"cluster"`
+	Timestamp time.Time         `json:"timestamp"`
+	Total     int               `json:"total"`
+	Pods      map[string]int    `json:"pods"`
+	Errors    map[string]string `json:"errors,omitempty"`
+	// Pods left out to stay within the size limit, the ones with the fewest connections
+	Omitted int `json:"omitted,omitempty"`
+}
+
+var (
+	configMapMu   sync.Mutex
+	lastConfigMap *configMapSummary
+)
+
+// newConfigMapSummary summarizes a report, keyed by namespace/pod.
+func newConfigMapSummary(r *Report) configMapSummary {
+	s := configMapSummary{
+		RunID:     r.RunID,
+		Cluster:   clusterName,
+		Timestamp: r.Start.UTC(),
+		Total:     r.Total,
+		Pods:      make(map[string]int),
+	}
+	for _, p := range r.Pods {
+		key := p.Target.Namespace + "/" + p.Target.Pod
+		if p.Err != nil {
+			if s.Errors == nil {
+				s.Errors = make(map[string]string)
+			}
+			msg := p.Err.Error()
+			if len(msg) > configMapMaxError {
+				msg = msg[:configMapMaxError] + "..."
+			}
+			s.Errors[key] = msg
+			continue
+		}
+		s.Pods[key] = p.Count
+	}
+	return s
+}
+
+// significantChange reports whether cur differs enough from the summary last written to be worth an update.
+func significantChange(prev, cur *configMapSummary) bool {
+	if prev == nil || cur.Timestamp.Sub(prev.Timestamp) >= *configMapMaxAge {
+		return true
+	}
+	changed := func(a, b int) bool {
+		if a == b {
+			return false
+		}
+		return a == 0 || math.Abs(float64(b-a))/float64(a) > *configMapThreshold
+	}
+	// A summary read back from the ConfigMap may have left out the pods with the fewest connections,
+	// so only the pods it kept are compared one by one
+	if changed(prev.Total, cur.Total) || len(prev.Pods)+prev.Omitted != len(cur.Pods) || len(prev.Errors) != len(cur.Errors) {
+		return true
+	}
+	for pod, n := range cur.Pods {
+		prevN, ok := prev.Pods[pod]
+		if !ok && prev.Omitted == 0 || ok && changed(prevN, n) {
+			return true
+		}
+	}
+	for pod := range cur.Errors {
+		if _, ok := prev.Errors[pod]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeConfigMapSummary encodes the summary, leaving out the pods with the fewest connections when it is
+// over the size limit.
+func encodeConfigMapSummary(s configMapSummary) ([]byte, error) {
+	data, err := json.Marshal(s)
+	if err != nil || len(data) <= configMapMaxBytes {
+		return data, err
+	}
+
+	pods := make([]string, 0, len(s.Pods))
+	for pod := range s.Pods {
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if s.Pods[pods[i]] != s.Pods[pods[j]] {
+			return s.Pods[pods[i]] > s.Pods[pods[j]]
+		}
+		return pods[i] < pods[j]
+	})
+	// Shrink in proportion to the overshoot until it fits
+	keep := len(pods)
+	for len(data) > configMapMaxBytes && keep > 0 {
+		keep = min(keep-1, keep*configMapMaxBytes/len(data))
+		trimmed := s
+		trimmed.Pods = make(map[string]int, keep)
+		for _, pod := range pods[:keep] {
+			trimmed.Pods[pod] = s.Pods[pod]
+		}
+		trimmed.Omitted = len(pods) - keep
+		if data, err = json.Marshal(trimmed); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > configMapMaxBytes {
+		return nil, fmt.Errorf("summary is %d bytes even without pods", len(data))
+	}
+	return data, nil
+}
+
+// readConfigMapSummary reads the summary the ConfigMap holds, or nil when it does not exist yet.
+func readConfigMapSummary(ns, name string) (*configMapSummary, error) {
+	out, err := runCommand("discovery", kubectl("get", "configmap", "-n", ns, name, "-o", "json"))
+	if err != nil {
+		if strings.Contains(commandStderr(err), "NotFound") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v: %s", err, commandStderr(err))
+	}
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(out, &cm); err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data["summary.json"]
+	if !ok {
+		return nil, nil
+	}
+	var s configMapSummary
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, fmt.Errorf("invalid summary.json: %v", err)
+	}
+	return &s, nil
+}
+
+// writeConfigMap server-side applies the run's summary to the ConfigMap when it changed significantly.
+// The ConfigMap has the total and timestamp as plain keys and the full summary as summary.json.
+func writeConfigMap(r *Report) error {
+	configMapMu.Lock()
+	defer configMapMu.Unlock()
+
+	ns, name := namespace, *configMapName
+	if i := strings.Index(name, "/"); i >= 0 {
+		ns, name = name[:i], name[i+1:]
+	}
+	if lastConfigMap == nil {
+		// On a cold start, such as every one-shot run, compare with what the ConfigMap holds
+		prev, err := readConfigMapSummary(ns, name)
+		if err != nil {
+			fmt.Printf("Error reading ConfigMap %s/%s, updating it regardless: %v\n", ns, name, err)
+		}
+		lastConfigMap = prev
+	}
+
+	s := newConfigMapSummary(r)
+	if !significantChange(lastConfigMap, &s) {
+		fmt.Printf("ConfigMap %s/%s unchanged within %.0f%%, not updating\n", ns, name, *configMapThreshold*100)
+		return nil
+	}
+	summary, err := encodeConfigMapSummary(s)
+	if err != nil {
+		return err
+	}
+
+	obj := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": ns,
+			"labels":    map[string]string{"app.kubernetes.io/managed-by": configMapFieldManager},
+		},
+		"data": map[string]string{
+			"total":        strconv.Itoa(s.Total),
+			"timestamp":    s.Timestamp.Format(time.RFC3339),
+			"summary.json": string(summary),
+		},
+	}
+	manifest, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"apply", "--server-side", "--field-manager=" + configMapFieldManager, "-f", "-"}
+	if *configMapForce {
+		args = append(args, "--force-conflicts")
+	}
+	cmd := kubectl(args...)
+	cmd.Stdin = bytes.NewReader(manifest)
+	if _, err := runCommand("sink", cmd); err != nil {
+		msg := commandStderr(err)
+		if strings.Contains(msg, "conflict") {
+			return fmt.Errorf("ConfigMap %s/%s has fields owned by another manager (use -configmap-force-conflicts to take them over): %s", ns, name, msg)
+		}
+		return fmt.Errorf("failed to apply ConfigMap %s/%s: %v: %s", ns, name, err, msg)
+	}
+
+	lastConfigMap = &s
+	fmt.Printf("Updated ConfigMap %s/%s\n", ns, name)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSignificantChangeAfterTrimming(t *testing.T) {
+	start := time.Now()
+	r := &Report{Start: start}
+	for i := 0; i < 40000; i++ {
+		p := PodResult{Target: Target{Namespace: "fpms", Pod: fmt.Sprintf("client-apiserver-canary-%06d", i)}, Count: i % 50}
+		r.Pods = append(r.Pods, p)
+		r.Total += p.Count
+	}
+	cur := newConfigMapSummary(r)
+
+	// The summary as read back from a ConfigMap that had to leave pods out
+	data, err := encodeConfigMapSummary(cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored configMapSummary
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Omitted == 0 {
+		t.Fatalf("summary of %d bytes was not trimmed", len(data))
+	}
+
+	next := newConfigMapSummary(&Report{Start: start.Add(time.Minute), Pods: r.Pods, Total: r.Total})
+	if significantChange(&stored, &next) {
+		t.Errorf("an unchanged run counts as a significant change from the trimmed summary")
+	}
+
+	// A pod that was kept changing, or a pod going away, still counts
+	grown := newConfigMapSummary(&Report{Start: start.Add(time.Minute), Pods: r.Pods, Total: r.Total})
+	grown.Pods["fpms/client-apiserver-canary-000049"] = 100
+	if !significantChange(&stored, &grown) {
+		t.Errorf("a kept pod going from 49 to 100 connections is not a significant change")
+	}
+	fewer := newConfigMapSummary(&Report{Start: start.Add(time.Minute), Pods: r.Pods[1:], Total: r.Total})
+	if !significantChange(&stored, &fewer) {
+		t.Errorf("a pod going away is not a significant change")
+	}
+}
+
+func TestSignificantChange(t *testing.T) {
+	start := time.Now()
+	prev := &configMapSummary{Timestamp: start, Total: 100, Pods: map[string]int{"fpms/a": 50, "fpms/b": 50}}
+	tests := []struct {
+		name string
+		cur  configMapSummary
+		want bool
+	}{
+		{"unchanged", configMapSummary{Timestamp: start.Add(time.Minute), Total: 100, Pods: map[string]int{"fpms/a": 50, "fpms/b": 50}}, false},
+		{"within the threshold", configMapSummary{Timestamp: start.Add(time.Minute), Total: 104, Pods: map[string]int{"fpms/a": 54, "fpms/b": 50}}, false},
+		{"pod over the threshold", configMapSummary{Timestamp: start.Add(time.Minute), Total: 104, Pods: map[string]int{"fpms/a": 44, "fpms/b": 60}}, true},
+		{"pod replaced", configMapSummary{Timestamp: start.Add(time.Minute), Total: 100, Pods: map[string]int{"fpms/a": 50, "fpms/c": 50}}, true},
+		{"new error", configMapSummary{Timestamp: start.Add(time.Minute), Total: 100, Pods: map[string]int{"fpms/a": 50, "fpms/b": 50}, Errors: map[string]string{"fpms/c": "exec failed"}}, true},
+		{"too old", configMapSummary{Timestamp: start.Add(*configMapMaxAge), Total: 100, Pods: map[string]int{"fpms/a": 50, "fpms/b": 50}}, true},
+	}
+	for _, tt := range tests {
+		if got := significantChange(prev, &tt.cur); got != tt.want {
+			t.Errorf("%s: significantChange = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ec2Tags          = flag.String("ec2-tags", "", "Discover EC2 instances with these tags along with the pods: key=value,... (values may use * and ? wildcards, a bare key matches any value)")
+	ec2States        = flag.String("ec2-states", "running", "Comma-separated instance states EC2 discovery keeps")
+	ec2Region        = flag.String("ec2-region", "", "Region for EC2 discovery, defaulting to the aws CLI configuration")
+	ec2EndpointURL   = flag.String("ec2-endpoint-url", "", "EC2 API endpoint for discovery, e.g. a local stand-in such as moto or LocalStack")
+	ec2InstancesFile = flag.String("ec2-instances-file", "", "Read instances from this describe-instances JSON file instead of calling the EC2 API")
+	ec2Address       = flag.String("ec2-address", "private", "Instance address to collect from: private or public")
+	ec2Collect       = flag.String("ec2-collect", backendSSH, "How to collect from EC2 instances: ssh (runs ss over SSH) or agent (the sidecar command running on the instance with -serve-sockets)")
+	ec2SSHUser       = flag.String("ec2-ssh-user", "ec2-user", "SSH user for EC2 collection")
+	ec2SSHIdentity   = flag.String("ec2-ssh-identity", "", "Private key for EC2 collection over SSH")
+	ec2AgentPort     = flag.Int("ec2-agent-port", 9281, "Port the agent on EC2 instances serves its API on")
+)
+
+// Collection backends of targets that are not pods
+const (
+	backendSSH   = "ssh"
+	backendAgent = "agent"
+)
+
+// ec2Namespace is the namespace instances are reported under.
+const ec2Namespace = "ec2"
+
+// agentClient fetches sockets from agents, which are reached directly rather than through the sink proxy.
+var agentClient = &http.Client{Timeout: 10 * time.Second}
+
+// ec2Enabled reports whether EC2 instances are discovered along with the pods.
+func ec2Enabled() bool {
+	return *ec2Tags != "" || *ec2InstancesFile != ""
+}
+
+type ec2Instance struct {
+	InstanceID       string `json:"InstanceId"`
+	InstanceType     string `json:"InstanceType"`
+	PrivateIPAddress string `json:"PrivateIpAddress"`
+	PublicIPAddress  string `json:"PublicIpAddress"`
+	State            struct {
+		Name string `json:"Name"`
+	} `json:"State"`
+	Placement struct {
+		AvailabilityZone string `json:"AvailabilityZone"`
+	} `json:"Placement"`
+	Tags []struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	} `json:"Tags"`
+}
+
+type ec2DescribeInstances struct {
+	Reservations []struct {
+		Instances []ec2Instance `json:"Instances"`
+	} `json:"Reservations"`
+}
+
+// ec2TagFilter matches one tag. A nil value matches any value.
+type ec2TagFilter struct {
+	key   string
+	raw   string
+	value *regexp.Regexp
+}
+
+// parseEC2Tags parses -ec2-tags.
+func parseEC2Tags(s string) ([]ec2TagFilter, error) {
+	var filters []ec2TagFilter
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(part, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid EC2 tag filter %q", part)
+		}
+		f := ec2TagFilter{key: key}
+		if hasValue {
+			// EC2 filter wildcards: * is any run of characters, ? a single character
+			re := strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(regexp.QuoteMeta(value))
+			f.raw = value
+			f.value = regexp.MustCompile("^" + re + "$")
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// ec2FilterArgs are the --filters of describe-instances for the tag filters and states.
+func ec2FilterArgs(filters []ec2TagFilter, states []string) []string {
+	args := []string{"--filters", "Name=instance-state-name,Values=" + strings.Join(states, ",")}
+	for _, f := range filters {
+		if f.value == nil {
+			args = append(args, "Name=tag-key,Values="+f.key)
+		} else {
+			args = append(args, "Name=tag:"+f.key+",Values="+f.raw)
+		}
+	}
+	return args
+}
+
+// describeInstances lists instances with the aws CLI, or reads them from -ec2-instances-file.
+func describeInstances(filters []ec2TagFilter, states []string) ([]ec2Instance, error) {
+	var out []byte
+	var err error
+	if *ec2InstancesFile != "" {
+		out, err = os.ReadFile(*ec2InstancesFile)
+	} else {
+		args := append([]string{"ec2", "describe-instances", "--output", "json"}, ec2FilterArgs(filters, states)...)
+		if *ec2Region != "" {
+			args = append(args, "--region", *ec2Region)
+		}
+		if *ec2EndpointURL != "" {
+			args = append(args, "--endpoint-url", *ec2EndpointURL)
+		}
+		out, err = runCommand("discovery", awsCommand(args...))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe EC2 instances: %v", err)
+	}
+
+	var resp ec2DescribeInstances
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse EC2 instances: %v", err)
+	}
+	var instances []ec2Instance
+	for _, r := range resp.Reservations {
+		instances = append(instances, r.Instances...)
+	}
+	return instances, nil
+}
+
+// matches applies the filters locally too, so the instances file and stand-ins that ignore filters behave
+// like the EC2 API.
+func (i ec2Instance) matches(filters []ec2TagFilter, states []string) bool {
+	stateOK := false
+	for _, s := range states {
+		stateOK = stateOK || i.State.Name == s
+	}
+	if !stateOK {
+		return false
+	}
+	for _, f := range filters {
+		found := false
+		for _, tag := range i.Tags {
+			if tag.Key == f.key && (f.value == nil || f.value.MatchString(tag.Value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ec2Instances discovers the instances to collect from. Each becomes a target in the ec2 namespace named
+// by its instance ID, labeled with the instance ID, availability zone, type and tags.
+func ec2Instances() ([]Target, error) {
+	filters, err := parseEC2Tags(*ec2Tags)
+	if err != nil {
+		return nil, err
+	}
+	if *ec2Collect != backendSSH && *ec2Collect != backendAgent {
+		return nil, fmt.Errorf("-ec2-collect must be ssh or agent")
+	}
+	var states []string
+	for _, s := range strings.Split(*ec2States, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			states = append(states, s)
+		}
+	}
+
+	fmt.Println("Fetching EC2 instances...")
+	instances, err := describeInstances(filters, states)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	var ids []string
+	for _, i := range instances {
+		if !i.matches(filters, states) {
+			continue
+		}
+		ip := i.PrivateIPAddress
+		if *ec2Address == "public" {
+			ip = i.PublicIPAddress
+		}
+		if ip == "" {
+			fmt.Printf("Skipping EC2 instance %s without a %s address\n", i.InstanceID, *ec2Address)
+			continue
+		}
+		labels := map[string]string{
+			"namespace":     ec2Namespace,
+			"pod":           i.InstanceID,
+			"instance_id":   i.InstanceID,
+			"az":            i.Placement.AvailabilityZone,
+			"instance_type": i.InstanceType,
+		}
+		for _, tag := range i.Tags {
+			labels["tag_"+sanitizeLabelName(tag.Key)] = tag.Value
+		}
+		targets = append(targets, Target{
+			Namespace: ec2Namespace,
+			Pod:       i.InstanceID,
+			IP:        ip,
+			Labels:    labels,
+			Backend:   *ec2Collect,
+		})
+		ids = append(ids, i.InstanceID)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Pod < targets[j].Pod })
+
+	fmt.Printf("EC2 instances found: %v\n", ids)
+	return targets, nil
+}
+
+// sshSockets lists the TCP sockets of an instance by running ss over SSH. Unlike pod images, instances
+// are expected to have ss installed.
+func sshSockets(t Target) ([]Socket, error) {
+	command := "ss -tn"
+	if *collectTCPInfo {
+		command = "ss -tino"
+	}
+
+	fmt.Printf("Counting TCP connections on instance: %s\n", t.Pod)
+	out, err := runCommand("exec", sshCommand(t, command))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSocketOutput(out, "State"); err != nil {
+		return nil, fmt.Errorf("invalid socket table from instance %s: %v", t.Pod, err)
+	}
+	sockets, err := parseSS(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sockets for instance %s: %v", t.Pod, err)
+	}
+	return sockets, nil
+}
+
+// sshCommand runs a shell command on an instance over SSH.
+func sshCommand(t Target, command string) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-o", "StrictHostKeyChecking=accept-new"}
+	args = append(args, sshProxyOptions()...)
+	if *ec2SSHIdentity != "" {
+		args = append(args, "-i", *ec2SSHIdentity)
+	}
+	args = append(args, *ec2SSHUser+"@"+t.IP, command)
+	return exec.Command("ssh", args...)
+}
+
+// agentSockets fetches the target port sockets of an instance from the agent running on it.
+func agentSockets(t Target) ([]Socket, error) {
+	url := "http://" + net.JoinHostPort(t.IP, strconv.Itoa(*ec2AgentPort)) + "/api/v1/sockets"
+	fmt.Printf("Fetching TCP connections from agent on instance: %s\n", t.Pod)
+	resp, err := agentClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("agent returned %s", resp.Status)
+	}
+
+	var sockets []Socket
+	if err := json.NewDecoder(resp.Body).Decode(&sockets); err != nil {
+		return nil, fmt.Errorf("failed to parse agent response: %v", err)
+	}
+	return sockets, nil
+}
+
+// handleSockets serves the raw target port sockets of the local network namespace to collectors using
+// -ec2-collect agent. Peers can't be anonymized in raw sockets, so it refuses when the API output is.
+func handleSockets(w http.ResponseWriter, r *http.Request) {
+	if anonymizerFor(sinkAPI) != "none" {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "raw sockets are not served when the api output is anonymized"})
+		return
+	}
+	sockets, err := localSockets()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if sockets == nil {
+		sockets = []Socket{}
+	}
+	writeJSON(w, http.StatusOK, sockets)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// standInAWS puts an aws CLI stand-in on PATH that answers describe-instances with the fixture, which
+// like moto and LocalStack ignores the filters, and records its arguments.
+func standInAWS(t *testing.T) (argsFile string) {
+	t.Helper()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	fixture, err := filepath.Abs("testdata/ec2/describe-instances.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\ncat " + fixture + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "aws"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestEC2Instances(t *testing.T) {
+	argsFile := standInAWS(t)
+	setFlag(t, ec2EndpointURL, "http://127.0.0.1:5000")
+	setFlag(t, ec2Region, "ap-southeast-1")
+
+	tests := []struct {
+		tags, states string
+		want         []string
+	}{
+		{"role=client,env=prod", "running", []string{"i-0a1b2c3d4e5f60001"}},
+		{"role=client", "running,stopped", []string{"i-0a1b2c3d4e5f60001", "i-0a1b2c3d4e5f60002"}},
+		{"env=pro?", "running", []string{"i-0a1b2c3d4e5f60001"}},
+		{"env=*", "running", []string{"i-0a1b2c3d4e5f60001", "i-0a1b2c3d4e5f60003"}},
+		{"Name", "running,stopped", []string{"i-0a1b2c3d4e5f60001"}},
+		{"role=web", "running", nil},
+	}
+	for _, tt := range tests {
+		setFlag(t, ec2Tags, tt.tags)
+		setFlag(t, ec2States, tt.states)
+		targets, err := ec2Instances()
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.tags, tt.states, err)
+		}
+		var got []string
+		for _, target := range targets {
+			got = append(got, target.Pod)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("tags %q states %q: got %v, want %v", tt.tags, tt.states, got, tt.want)
+		}
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ec2 describe-instances", "Name=instance-state-name,Values=running", "Name=tag:role,Values=web", "--endpoint-url http://127.0.0.1:5000", "--region ap-southeast-1"} {
+		if !strings.Contains(string(args), want) {
+			t.Errorf("aws called with %q, missing %q", strings.TrimSpace(string(args)), want)
+		}
+	}
+}
+
+func TestEC2InstanceLabels(t *testing.T) {
+	standInAWS(t)
+	setFlag(t, ec2Tags, "role=client")
+	setFlag(t, ec2States, "running")
+
+	targets, err := ec2Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 {
+		t.Fatalf("got %d targets, want 1", len(targets))
+	}
+	target := targets[0]
+	if target.Namespace != ec2Namespace || target.IP != "127.0.0.1" || target.Backend != backendSSH {
+		t.Errorf("target = %+v", target)
+	}
+	want := map[string]string{
+		"namespace":     "ec2",
+		"pod":           "i-0a1b2c3d4e5f60001",
+		"instance_id":   "i-0a1b2c3d4e5f60001",
+		"az":            "ap-southeast-1a",
+		"instance_type": "c6i.large",
+		"tag_role":      "client",
+		"tag_env":       "prod",
+		"tag_Name":      "client-vm-1",
+	}
+	for k, v := range want {
+		if target.Labels[k] != v {
+			t.Errorf("label %s = %q, want %q", k, target.Labels[k], v)
+		}
+	}
+	if len(target.Labels) != len(want) {
+		t.Errorf("labels = %v, want %v", target.Labels, want)
+	}
+}
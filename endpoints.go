@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+var serviceName = flag.String("service", "", "Check pods against the EndpointSlices of this Service and flag inconsistencies as findings")
+
+// Endpoint conditions of a pod, as shown in reports
+const (
+	endpointReady       = "ready"
+	endpointServing     = "serving"
+	endpointTerminating = "terminating"
+	endpointNotReady    = "not-ready"
+	endpointAbsent      = "absent"
+)
+
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready       *bool `json:"ready"`
+				Serving     *bool `json:"serving"`
+				Terminating *bool `json:"terminating"`
+			} `json:"conditions"`
+			TargetRef *struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"targetRef"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+// serviceEndpoints returns the endpoint condition of each pod in the Service's EndpointSlices, keyed by
+// pod name, and by address for endpoints without a pod reference.
+func serviceEndpoints(ns, service string) (map[string]string, error) {
+	out, err := runCommand("discovery", kubectl("get", "endpointslices", "-n", ns, "-l", "kubernetes.io/service-name="+service, "-o", "json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get EndpointSlices of %s/%s: %v: %s", ns, service, err, commandStderr(err))
+	}
+	var list endpointSliceList
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse EndpointSlices: %v", err)
+	}
+
+	conditions := make(map[string]string)
+	for _, slice := range list.Items {
+		for _, e := range slice.Endpoints {
+			// A nil condition means unknown, which consumers treat as ready/serving and not terminating
+			c := e.Conditions
+			state := endpointNotReady
+			switch {
+			case c.Terminating != nil && *c.Terminating:
+				state = endpointTerminating
+				if c.Serving != nil && *c.Serving {
+					state = endpointServing
+				}
+			case c.Ready == nil || *c.Ready:
+				state = endpointReady
+			}
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				conditions[e.TargetRef.Name] = state
+			}
+			for _, addr := range e.Addresses {
+				conditions[addr] = state
+			}
+		}
+	}
+	return conditions, nil
+}
+
+// checkEndpoints records each pod's endpoint condition in the report and returns findings for pods whose
+// connections disagree with it: connections to pods that are not (ready) endpoints, and ready endpoints
+// without connections. EC2 instances are not pods and are left out. Namespaces whose EndpointSlices cannot
+// be read are skipped, and their errors returned with the findings of the others.
+func checkEndpoints(r *Report, service string) ([]Finding, error) {
+	byNamespace := make(map[string]map[string]string)
+	var findings []Finding
+	var errs []error
+	for i := range r.Pods {
+		p := &r.Pods[i]
+		if p.Target.Backend != "" {
+			continue
+		}
+		conditions, ok := byNamespace[p.Target.Namespace]
+		if !ok {
+			var err error
+			if conditions, err = serviceEndpoints(p.Target.Namespace, service); err != nil {
+				errs = append(errs, err)
+			}
+			byNamespace[p.Target.Namespace] = conditions
+		}
+		if conditions == nil {
+			continue
+		}
+
+		state, ok := conditions[p.Target.Pod]
+		if !ok && p.Target.IP != "" {
+			state, ok = conditions[p.Target.IP]
+		}
+		if !ok {
+			state = endpointAbsent
+		}
+		p.Endpoint = state
+		if p.Err != nil {
+			continue
+		}
+
+		finding := func(kind, severity, format string, args ...interface{}) {
+			findings = append(findings, Finding{
+				Kind:      kind,
+				Severity:  severity,
+				Namespace: p.Target.Namespace,
+				Pod:       p.Target.Pod,
+				Message:   fmt.Sprintf("pod %s/%s: ", p.Target.Namespace, p.Target.Pod) + fmt.Sprintf(format, args...),
+				Labels:    map[string]string{"service": service, "endpoint": state},
+			})
+		}
+		switch {
+		case p.Count > 0 && state == endpointAbsent:
+			finding("connections_outside_endpoints", "warning", "%d connections but not an endpoint of service %s", p.Count, service)
+		case p.Count > 0 && state == endpointNotReady:
+			finding("connections_while_not_ready", "warning", "%d connections while not ready in service %s", p.Count, service)
+		case p.Count > 0 && (state == endpointTerminating || state == endpointServing):
+			finding("connections_while_terminating", "info", "%d connections while terminating in service %s", p.Count, service)
+		case p.Count == 0 && state == endpointReady:
+			finding("idle_endpoint", "warning", "ready endpoint of service %s without connections", service)
+		}
+	}
+	return findings, errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// standInKubectl puts a kubectl on PATH that runs script with sh.
+func standInKubectl(t *testing.T, script string) {
+	t.Helper()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "kubectl"), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCheckEndpointsPartial(t *testing.T) {
+	// Listing EndpointSlices is forbidden in the payments namespace
+	standInKubectl(t, `case "$*" in
+*"-n payments"*) echo 'Error from server (Forbidden): endpointslices.discovery.k8s.io is forbidden' >&2; exit 1 ;;
+esac
+cat <<'EOF'
+{"items": [{"endpoints": [{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "targetRef": {"kind": "Pod", "name": "client-a-1"}}]}]}
+EOF
+`)
+
+	r := &Report{Pods: []PodResult{
+		{Target: Target{Namespace: "payments", Pod: "payments-1", IP: "10.0.1.1"}, Count: 3},
+		{Target: Target{Namespace: "fpms", Pod: "client-a-1", IP: "10.0.0.1"}},
+		{Target: Target{Namespace: "fpms", Pod: "client-b-1", IP: "10.0.0.2"}, Count: 2},
+		{Target: Target{Namespace: "payments", Pod: "payments-2", IP: "10.0.1.2"}, Count: 1},
+		// EC2 instances have no EndpointSlices to look in
+		{Target: Target{Namespace: ec2Namespace, Pod: "i-0abc", IP: "10.0.2.1", Backend: backendSSH}, Count: 4},
+		{Target: Target{Namespace: ec2Namespace, Pod: "i-0def", IP: "10.0.2.2", Backend: backendAgent}},
+	}}
+	findings, err := checkEndpoints(r, "api")
+	if err == nil || !strings.Contains(err.Error(), "payments/api") {
+		t.Fatalf("got error %v, want the payments namespace failure", err)
+	}
+	if strings.Count(err.Error(), "payments/api") != 1 {
+		t.Errorf("payments namespace failure reported more than once: %v", err)
+	}
+
+	wantEndpoints := []string{"", endpointReady, endpointAbsent, "", "", ""}
+	for i, p := range r.Pods {
+		if p.Endpoint != wantEndpoints[i] {
+			t.Errorf("%s endpoint = %q, want %q", p.Target.Pod, p.Endpoint, wantEndpoints[i])
+		}
+	}
+	if len(findings) != 2 || findings[0].Kind != "idle_endpoint" || findings[1].Kind != "connections_outside_endpoints" {
+		t.Fatalf("findings = %+v, want idle_endpoint for client-a-1 and connections_outside_endpoints for client-b-1", findings)
+	}
+}
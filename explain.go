@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Ports of the Istio sidecar: Envoy's outbound and inbound capture, health and telemetry ports
+var sidecarPorts = map[uint16]bool{15001: true, 15006: true, 15021: true, 15090: true}
+
+// Address the Istio sidecar connects to the application from on inbound traffic
+var sidecarInboundAddr = netip.MustParseAddr("127.0.0.6")
+
+// socketExplanation is the decision on one socket.
+type socketExplanation struct {
+	Socket    Socket
+	Counted   bool
+	Rule      string
+	Direction string
+	Loopback  bool
+	Sidecar   bool
+}
+
+// explainSocket describes the rule socketRule decided a socket by. Direction, loopback and sidecar are
+// annotations only.
+func explainSocket(s Socket) socketExplanation {
+	e := socketExplanation{Socket: s}
+	rule := socketRule(s)
+	switch rule {
+	case rulePort:
+		e.Rule = fmt.Sprintf("port: neither %d nor %d is %s", s.Local.Port(), s.Remote.Port(), *targetPort)
+	case ruleState:
+		e.Rule = fmt.Sprintf("state: %s, only ESTABLISHED counts", s.State)
+	case ruleCounted:
+		e.Counted = true
+		e.Rule = "port " + *targetPort + " and ESTABLISHED"
+	}
+
+	if rule != rulePort {
+		e.Direction = "outbound"
+		if strconv.Itoa(int(s.Local.Port())) == *targetPort {
+			e.Direction = "inbound"
+		}
+	}
+	remote := s.Remote.Addr()
+	e.Loopback = remote.IsLoopback()
+	e.Sidecar = remote == sidecarInboundAddr || sidecarPorts[s.Local.Port()] || sidecarPorts[s.Remote.Port()]
+	return e
+}
+
+// runExplain is the explain command. It lists the sockets of one pod with the rule that counted or
+// excluded each, and derives the pod's count step by step:
+//
+//	check-conn-script explain -pod client-a-1
+//	check-conn-script explain -pod client-a-1 -file capture/pods/fpms/client-a-1/tcp.txt
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	pod := fs.String("pod", "", "Pod to explain")
+	ns := fs.String("namespace", "", "Namespace of the pod, when the pod name is ambiguous")
+	file := fs.String("file", "", "Explain this captured /proc/net/tcp, ss or netstat dump instead of the live pod")
+	fs.Parse(args)
+	if *pod == "" {
+		return fmt.Errorf("-pod is required")
+	}
+
+	var target Target
+	var sockets []Socket
+	if *file != "" {
+		target = Target{Namespace: *ns, Pod: *pod}
+		if target.Namespace == "" {
+			target.Namespace = namespace
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		if sockets, err = parseSocketDump(data); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", *file, err)
+		}
+	} else {
+		targets, err := discoverTargets()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, t := range targets {
+			if t.Pod == *pod && (*ns == "" || t.Namespace == *ns) {
+				target, found = t, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("pod %s is not among the discovered targets", *pod)
+		}
+		token := ""
+		if target.Backend == "" {
+			if token, err = getToken(); err != nil {
+				return fmt.Errorf("error fetching token: %v", err)
+			}
+		}
+		if sockets, err = getSockets(target, token); err != nil {
+			return err
+		}
+	}
+
+	printExplanation(target, sockets)
+	return nil
+}
+
+// printExplanation prints the decision on every socket and the derivation of the count.
+func printExplanation(t Target, sockets []Socket) {
+	anon := anonymizerFor(sinkReport)
+	fmt.Printf("Sockets of %s/%s (target port %s):\n", t.Namespace, t.Pod, *targetPort)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  #\tLOCAL\tREMOTE\tSTATE\tDIRECTION\tCOUNTED\tRULE\tNOTES")
+
+	var portExcluded, stateExcluded, counted, inbound, loopback, sidecar int
+	states := make(map[string]int)
+	for i, s := range sockets {
+		e := explainSocket(s)
+		switch {
+		case e.Counted:
+			counted++
+			if e.Direction == "inbound" {
+				inbound++
+			}
+			if e.Loopback {
+				loopback++
+			}
+			if e.Sidecar {
+				sidecar++
+			}
+		case e.Direction == "":
+			portExcluded++
+		default:
+			stateExcluded++
+		}
+		if e.Direction != "" {
+			states[s.State]++
+		}
+
+		notes := ""
+		if e.Loopback {
+			notes = "loopback"
+		}
+		if e.Sidecar {
+			if notes != "" {
+				notes += ", "
+			}
+			notes += "sidecar"
+		}
+		yes := "no"
+		if e.Counted {
+			yes = "yes"
+		}
+		local := fmt.Sprintf("%s:%d", anon.addr(s.Local.Addr()), s.Local.Port())
+		remote := fmt.Sprintf("%s:%d", anon.addr(s.Remote.Addr()), s.Remote.Port())
+		fmt.Fprintf(w, "  %d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, local, remote, s.State, e.Direction, yes, e.Rule, notes)
+	}
+	w.Flush()
+
+	fmt.Println("Count derivation:")
+	fmt.Printf("  %d sockets read\n", len(sockets))
+	fmt.Printf("  - %d with neither end on port %s\n", portExcluded, *targetPort)
+	fmt.Printf("  = %d on port %s: %s\n", len(sockets)-portExcluded, *targetPort, formatStates(states))
+	fmt.Printf("  - %d not ESTABLISHED\n", stateExcluded)
+	fmt.Printf("  = %d counted toward client_tcp_new\n", counted)
+	fmt.Printf("  Of the counted: %d inbound, %d outbound, %d loopback, %d through the sidecar.\n", inbound, counted-inbound, loopback, sidecar)
+	fmt.Println("  Direction never excludes a socket, and no CIDR, loopback or sidecar filters apply: such connections count like any other.")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	fn()
+	os.Stdout = saved
+	w.Close()
+	return string(<-done)
+}
+
+func TestExplainSocket(t *testing.T) {
+	tests := []struct {
+		name, local, remote, state string
+		counted                    bool
+		rule, direction            string
+		loopback, sidecar          bool
+	}{
+		{"inbound", "10.0.0.1:" + *targetPort, "10.1.0.5:51234", "ESTABLISHED", true, "port " + *targetPort, "inbound", false, false},
+		{"outbound", "10.0.0.1:40000", "10.1.0.9:" + *targetPort, "ESTABLISHED", true, "port " + *targetPort, "outbound", false, false},
+		{"other port", "10.0.0.1:8080", "10.1.0.5:51234", "ESTABLISHED", false, "port:", "", false, false},
+		{"time wait", "10.0.0.1:" + *targetPort, "10.1.0.5:51234", "TIME_WAIT", false, "state: TIME_WAIT", "inbound", false, false},
+		{"close wait", "10.0.0.1:40000", "10.1.0.9:" + *targetPort, "CLOSE_WAIT", false, "state: CLOSE_WAIT", "outbound", false, false},
+		{"listener", "0.0.0.0:" + *targetPort, "0.0.0.0:0", "LISTEN", false, "state: LISTEN", "inbound", false, false},
+		{"loopback", "127.0.0.1:" + *targetPort, "127.0.0.1:51234", "ESTABLISHED", true, "port " + *targetPort, "inbound", true, false},
+		{"sidecar inbound", "10.0.0.1:" + *targetPort, "127.0.0.6:51234", "ESTABLISHED", true, "port " + *targetPort, "inbound", true, true},
+		{"sidecar outbound capture", "10.0.0.1:15001", "10.1.0.5:" + *targetPort, "ESTABLISHED", true, "port " + *targetPort, "outbound", false, true},
+		{"sidecar telemetry", "10.0.0.1:15090", "10.1.0.7:48000", "ESTABLISHED", false, "port:", "", false, true},
+	}
+	for _, tt := range tests {
+		s := Socket{Local: netip.MustParseAddrPort(tt.local), Remote: netip.MustParseAddrPort(tt.remote), State: tt.state}
+		e := explainSocket(s)
+		if e.Counted != tt.counted || !strings.HasPrefix(e.Rule, tt.rule) || e.Direction != tt.direction || e.Loopback != tt.loopback || e.Sidecar != tt.sidecar {
+			t.Errorf("%s: got %+v", tt.name, e)
+		}
+		// The explanation and the count decide alike
+		count, _ := countSockets([]Socket{s})
+		if (count == 1) != e.Counted {
+			t.Errorf("%s: countSockets counts %d, explanation says counted %v", tt.name, count, e.Counted)
+		}
+	}
+}
+
+func TestPrintExplanationPrivacy(t *testing.T) {
+	resetPrivacy(t)
+	setFlag(t, privacyMode, "truncate")
+	sockets := []Socket{
+		{Local: netip.MustParseAddrPort("10.0.7.21:" + *targetPort), Remote: netip.MustParseAddrPort("10.1.2.3:51234"), State: "ESTABLISHED"},
+		{Local: netip.MustParseAddrPort("10.0.7.21:40000"), Remote: netip.MustParseAddrPort("10.1.9.8:" + *targetPort), State: "ESTABLISHED"},
+	}
+	out := captureStdout(t, func() { printExplanation(Target{Namespace: "fpms", Pod: "client-a-1"}, sockets) })
+
+	for _, addr := range []string{"10.0.7.21", "10.1.2.3", "10.1.9.8"} {
+		if strings.Contains(out, addr) {
+			t.Errorf("%s appears under -privacy truncate:\n%s", addr, out)
+		}
+	}
+	if !strings.Contains(out, "10.0.7.0/24:"+*targetPort) || !strings.Contains(out, "10.1.2.0/24:51234") {
+		t.Errorf("truncated addresses missing:\n%s", out)
+	}
+	if !strings.Contains(out, "1 inbound, 1 outbound") || !strings.Contains(out, "Direction never excludes a socket") {
+		t.Errorf("count derivation does not say both directions count:\n%s", out)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileSD is the file_sd discovery source, set when -file-sd is given.
+var fileSD *fileSDSource
+
+// fileSDGroup is one entry of a Prometheus file_sd target file.
+type fileSDGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// fileSDSource reads targets from Prometheus file_sd files and reloads them whenever the files change.
+type fileSDSource struct {
+	pattern string
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	targets  []Target
+}
+
+func newFileSDSource(pattern string) *fileSDSource {
+	return &fileSDSource{pattern: pattern}
+}
+
+// Targets returns the current targets, re-reading the files if any of them were added, removed or modified.
+// Once targets have loaded, a failed reload is logged and the previously loaded targets are kept.
+func (s *fileSDSource) Targets() ([]Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		if s.modTimes == nil {
+			return nil, err
+		}
+		fmt.Printf("Error reloading file_sd files %s, keeping previous targets: %v\n", s.pattern, err)
+	}
+	return s.targets, nil
+}
+
+// reload re-reads the files if they changed since the last load. On error the targets are left as they were.
+func (s *fileSDSource) reload() error {
+	files, err := filepath.Glob(s.pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no file_sd files match %s", s.pattern)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	if s.modTimes != nil && sameModTimes(s.modTimes, modTimes) {
+		return nil
+	}
+
+	var targets []Target
+	seen := make(map[string]bool)
+	for _, file := range files {
+		groups, err := readFileSD(file)
+		if err != nil {
+			return err
+		}
+		for _, t := range targetsFromGroups(groups) {
+			key := t.Namespace + "/" + t.Pod
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			targets = append(targets, t)
+		}
+	}
+
+	fmt.Printf("Loaded %d targets from file_sd files %v\n", len(targets), files)
+	s.modTimes = modTimes
+	s.targets = targets
+	return nil
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, t := range a {
+		if !b[file].Equal(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// readFileSD parses a file_sd file, as YAML if it has a .yml/.yaml extension and as JSON otherwise.
+func readFileSD(path string) ([]fileSDGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []fileSDGroup
+	if isYAMLPath(path) {
+		err = yaml.Unmarshal(data, &groups)
+	} else {
+		err = json.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file_sd file %s: %v", path, err)
+	}
+	return groups, nil
+}
+
+// targetsFromGroups maps file_sd groups to pods. The pod comes from the "pod" label and the namespace from
+// the "namespace" label. A group's labels apply to all its targets, so targets without a pod label of their
+// own, or of a group with several targets, are skipped: kubectl cannot exec into an address.
+func targetsFromGroups(groups []fileSDGroup) []Target {
+	var targets []Target
+	for _, g := range groups {
+		if g.Labels["pod"] == "" || len(g.Targets) != 1 {
+			if len(g.Targets) > 0 {
+				fmt.Printf("Skipping file_sd targets %v: each target needs its own group with a pod label\n", g.Targets)
+			}
+			continue
+		}
+		for _, addr := range g.Targets {
+			labels := make(map[string]string, len(g.Labels)+1)
+			for k, v := range g.Labels {
+				labels[k] = v
+			}
+
+			host := addr
+			if h, _, err := net.SplitHostPort(addr); err == nil {
+				host = h
+			}
+			ns := labels["namespace"]
+			if ns == "" {
+				ns = namespace
+			}
+
+			labels["namespace"] = ns
+			labels["instance"] = addr
+			targets = append(targets, Target{Namespace: ns, Pod: labels["pod"], IP: host, Labels: labels})
+		}
+	}
+	return targets
+}
+
+// writeFileSD writes the pods as a file_sd file, one group per pod addressed by its IP and the target port.
+// The file is written to a temporary file and renamed so Prometheus never reads a partial file.
+func writeFileSD(path string, pods []Target) error {
+	groups := make([]fileSDGroup, 0, len(pods))
+	for _, p := range pods {
+		if p.IP == "" {
+			continue
+		}
+		groups = append(groups, fileSDGroup{
+			Targets: []string{net.JoinHostPort(p.IP, *targetPort)},
+			Labels:  fileSDLabels(p),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Targets[0] < groups[j].Targets[0] })
+
+	var data []byte
+	var err error
+	if isYAMLPath(path) {
+		data, err = yaml.Marshal(groups)
+	} else {
+		data, err = json.MarshalIndent(groups, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file 0600, which Prometheus running as another user cannot read
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %d file_sd targets to %s\n", len(groups), path)
+	return nil
+}
+
+// fileSDLabels drops the labels Prometheus derives itself from the target.
+func fileSDLabels(p Target) map[string]string {
+	labels := make(map[string]string, len(p.Labels))
+	for k, v := range p.Labels {
+		if k == "instance" || strings.HasPrefix(k, "__") {
+			continue
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+func isYAMLPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTargetsFromGroups(t *testing.T) {
+	groups := []fileSDGroup{
+		{Targets: []string{"10.0.0.1:9280"}, Labels: map[string]string{"pod": "client-a-1", "namespace": "fpms"}},
+		{Targets: []string{"10.0.0.2:9280"}, Labels: map[string]string{"pod": "client-b-1"}},
+		{Targets: []string{"10.0.0.3:9280", "10.0.0.4:9280"}, Labels: map[string]string{"pod": "client-c-1"}},
+		{Targets: []string{"10.0.0.5:9280"}, Labels: map[string]string{"namespace": "fpms"}},
+	}
+	targets := targetsFromGroups(groups)
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, want 2: %+v", len(targets), targets)
+	}
+	want := []Target{
+		{Namespace: "fpms", Pod: "client-a-1", IP: "10.0.0.1"},
+		{Namespace: namespace, Pod: "client-b-1", IP: "10.0.0.2"},
+	}
+	for i, w := range want {
+		got := targets[i]
+		if got.Namespace != w.Namespace || got.Pod != w.Pod || got.IP != w.IP {
+			t.Errorf("target %d = %s/%s at %s, want %s/%s at %s", i, got.Namespace, got.Pod, got.IP, w.Namespace, w.Pod, w.IP)
+		}
+		if got.Labels["pod"] != w.Pod || got.Labels["namespace"] != w.Namespace || got.Labels["instance"] != w.IP+":9280" {
+			t.Errorf("target %d labels = %v", i, got.Labels)
+		}
+	}
+}
+
+func TestWriteFileSD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	pods := []Target{
+		{Namespace: "fpms", Pod: "client-a-1", IP: "10.0.0.1", Labels: map[string]string{"namespace": "fpms", "pod": "client-a-1"}},
+		{Namespace: "fpms", Pod: "client-a-2", Labels: map[string]string{"namespace": "fpms", "pod": "client-a-2"}},
+	}
+	if err := writeFileSD(path, pods); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("file mode = %v, want 0644", info.Mode().Perm())
+	}
+
+	// The written file reads back as the pods that have an IP
+	groups, err := readFileSD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := targetsFromGroups(groups)
+	if len(targets) != 1 || targets[0].Pod != "client-a-1" || targets[0].IP != "10.0.0.1" {
+		t.Errorf("read back %+v, want client-a-1 at 10.0.0.1", targets)
+	}
+}
+
+func TestFileSDKeepsTargetsOnReloadErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.json")
+	write := func(data string, age time.Duration) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Each write gets its own modification time, however fast the test runs
+		at := time.Now().Add(-age)
+		os.Chtimes(path, at, at)
+	}
+	src := newFileSDSource(filepath.Join(dir, "*.json"))
+	if _, err := src.Targets(); err == nil {
+		t.Errorf("no error without any file_sd file")
+	}
+
+	write(`[{"targets": ["10.0.0.1:9280"], "labels": {"pod": "client-a-1"}}]`, 3*time.Hour)
+	targets, err := src.Targets()
+	if err != nil || len(targets) != 1 {
+		t.Fatalf("got %d targets, error %v", len(targets), err)
+	}
+
+	// A file caught mid-write, and no file at all, keep the last good targets
+	write(`[{"targets": ["10.0.0.1:9280"], "labels": {"po`, 2*time.Hour)
+	if targets, err := src.Targets(); err != nil || len(targets) != 1 || targets[0].Pod != "client-a-1" {
+		t.Errorf("after a bad write: %+v, error %v", targets, err)
+	}
+	os.Remove(path)
+	if targets, err := src.Targets(); err != nil || len(targets) != 1 || targets[0].Pod != "client-a-1" {
+		t.Errorf("without files: %+v, error %v", targets, err)
+	}
+
+	write(`[{"targets": ["10.0.0.2:9280"], "labels": {"pod": "client-b-1"}}]`, time.Hour)
+	if targets, err := src.Targets(); err != nil || len(targets) != 1 || targets[0].Pod != "client-b-1" {
+		t.Errorf("after the file was fixed: %+v, error %v", targets, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var alertmanagerURL = flag.String("alertmanager-url", "", "Send findings as alerts to this Alertmanager (e.g. http://alertmanager:9093)")
+
+// Finding is a problem detected while analyzing a run, such as a suspected connection leak.
+type Finding struct {
+	Kind      string            `json:"kind"`
+	Severity  string            `json:"severity"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	Message   string            `json:"message"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// printFindings lists the findings of a run.
+func printFindings(findings []Finding) {
+	if len(findings) == 0 {
+		return
+	}
+	fmt.Printf("Findings (%d):\n", len(findings))
+	for _, f := range findings {
+		fmt.Printf("  [%s] %s: %s\n", f.Severity, f.Kind, f.Message)
+	}
+}
+
+// alertmanagerAlert is an alert in the Alertmanager v2 API.
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// sendAlerts posts the findings to Alertmanager. Findings are re-sent on every run while they last,
+// and each alert expires on its own a few intervals after it is last seen.
+func sendAlerts(findings []Finding) error {
+	if len(findings) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	expiry := 3 * *interval
+	if expiry <= 0 {
+		expiry = time.Hour
+	}
+	alerts := make([]alertmanagerAlert, 0, len(findings))
+	for _, f := range findings {
+		labels := map[string]string{
+			"alertname": alertName(f.Kind),
+			"severity":  f.Severity,
+		}
+		if f.Namespace != "" {
+			labels["namespace"] = f.Namespace
+		}
+		if f.Pod != "" {
+			labels["pod"] = f.Pod
+		}
+		for k, v := range f.Labels {
+			labels[k] = v
+		}
+		alerts = append(alerts, alertmanagerAlert{
+			Labels:      labels,
+			Annotations: map[string]string{"summary": f.Message},
+			StartsAt:    now,
+			EndsAt:      now.Add(expiry),
+		})
+	}
+
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := sinkClient.Post(strings.TrimSuffix(*alertmanagerURL, "/")+"/api/v2/alerts", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Alertmanager error: %s", string(msg))
+	}
+	fmt.Printf("Sent %d alerts to Alertmanager.\n", len(alerts))
+	return nil
+}
+
+// alertName turns a finding kind such as "connection_leak" into an alert name such as "ConnectionLeak".
+func alertName(kind string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(kind, "_") {
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]))
+		b.WriteString(part[1:])
+	}
+	return b.String()
+}
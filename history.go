@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+var retention = flag.Duration("retention", 6*time.Hour, "How long daemon mode keeps the per-pod history")
+
+// Series recorded in the history on every run
+const (
+	metricTotal      = "client_tcp_new"
+	metricPodConns   = "client_tcp_pod_connections"
+	metricPodSockets = "client_tcp_pod_sockets"
+)
+
+type sample struct {
+	T time.Time
+	V float64
+}
+
+// series is the retained history of one metric and label set.
+type series struct {
+	Name    string
+	Labels  map[string]string
+	Samples []sample
+}
+
+// historyStore keeps the results of recent runs in memory, in daemon mode.
+type historyStore struct {
+	mu     sync.Mutex
+	series map[string]*series
+	// States seen so far on each pod, so a state that disappears is recorded as zero rather than a gap
+	podStates map[string]map[string]bool
+}
+
+var history = &historyStore{
+	series:    make(map[string]*series),
+	podStates: make(map[string]map[string]bool),
+}
+
+// record appends the total, per-pod and per-pod-state counts of a run and drops samples past retention.
+// Pods whose collection failed get no sample for the run.
+func (h *historyStore) record(r *Report) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := r.Start
+	h.add(metricTotal, nil, t, float64(r.Total))
+	for _, p := range r.Pods {
+		if p.Err != nil {
+			continue
+		}
+		pod := map[string]string{"namespace": p.Target.Namespace, "pod": p.Target.Pod}
+		h.add(metricPodConns, pod, t, float64(p.Count))
+
+		key := p.Target.Namespace + "/" + p.Target.Pod
+		known := h.podStates[key]
+		if known == nil {
+			known = make(map[string]bool)
+			h.podStates[key] = known
+		}
+		for state := range p.States {
+			known[state] = true
+		}
+		for state := range known {
+			h.add(metricPodSockets, withLabel(pod, "state", state), t, float64(p.States[state]))
+		}
+	}
+
+	h.prune(time.Now().Add(-*retention))
+}
+
+func (h *historyStore) add(name string, labels map[string]string, t time.Time, v float64) {
+	key := seriesKey(name, labels)
+	s := h.series[key]
+	if s == nil {
+		s = &series{Name: name, Labels: labels}
+		h.series[key] = s
+	}
+	s.Samples = append(s.Samples, sample{T: t, V: v})
+}
+
+func (h *historyStore) prune(cutoff time.Time) {
+	for key, s := range h.series {
+		i := sort.Search(len(s.Samples), func(i int) bool { return !s.Samples[i].T.Before(cutoff) })
+		s.Samples = s.Samples[i:]
+		if len(s.Samples) == 0 {
+			delete(h.series, key)
+			if s.Name == metricPodConns {
+				delete(h.podStates, s.Labels["namespace"]+"/"+s.Labels["pod"])
+			}
+		}
+	}
+}
+
+// query returns copies of the series of a metric that match, restricted to samples at or after since.
+func (h *historyStore) query(name string, match func(labels map[string]string) bool, since time.Time) []series {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var result []series
+	for _, s := range h.series {
+		if s.Name != name || (match != nil && !match(s.Labels)) {
+			continue
+		}
+		i := sort.Search(len(s.Samples), func(i int) bool { return !s.Samples[i].T.Before(since) })
+		if i == len(s.Samples) {
+			continue
+		}
+		result = append(result, series{
+			Name:    s.Name,
+			Labels:  s.Labels,
+			Samples: append([]sample(nil), s.Samples[i:]...),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return seriesKey(result[i].Name, result[i].Labels) < seriesKey(result[j].Name, result[j].Labels)
+	})
+	return result
+}
+
+// snapshot returns copies of all series, restricted to samples at or after since.
+func (h *historyStore) snapshot(since time.Time) []series {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make([]series, 0, len(h.series))
+	for _, s := range h.series {
+		i := sort.Search(len(s.Samples), func(i int) bool { return !s.Samples[i].T.Before(since) })
+		if i == len(s.Samples) {
+			continue
+		}
+		result = append(result, series{Name: s.Name, Labels: s.Labels, Samples: append([]sample(nil), s.Samples[i:]...)})
+	}
+	return result
+}
+
+// seriesKey is a canonical name for a metric and label set, e.g. `client_tcp_pod_connections{namespace="fpms",pod="a"}`.
+func seriesKey(name string, labels map[string]string) string {
+	return formatSeries(name, labels)
+}
+
+// withLabel returns a copy of labels with one more label set.
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+var (
+	distinctBy   = flag.String("distinct-by", "ip", "What counts as a distinct client: ip (remote address) or ip-port (remote address and port)")
+	hllPrecision = flag.Int("hll-precision", 12, "HyperLogLog precision for distinct client estimates, 4-16 (2^p registers, standard error 1.04/sqrt(2^p))")
+)
+
+const (
+	hllDense  = 0
+	hllSparse = 1
+)
+
+// hll is a HyperLogLog sketch of distinct clients. Sketches of the same precision merge losslessly, so
+// per-pod sketches add up to namespace, cluster and fleet estimates without double-counting clients that
+// hold connections to several pods. The hash is fixed so sketches from different collectors are comparable.
+type hll struct {
+	p   uint8
+	reg []uint8
+}
+
+func newHLL(p int) *hll {
+	p = max(4, min(16, p))
+	return &hll{p: uint8(p), reg: make([]uint8, 1<<p)}
+}
+
+func (h *hll) add(data []byte) {
+	f := fnv.New64a()
+	f.Write(data)
+	x := mix64(f.Sum64())
+	idx := x >> (64 - h.p)
+	rank := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1)) + 1)
+	if rank > h.reg[idx] {
+		h.reg[idx] = rank
+	}
+}
+
+// mix64 is the splitmix64 finalizer; FNV alone spreads short keys such as IPv4 addresses poorly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// merge folds another sketch into h.
+func (h *hll) merge(o *hll) error {
+	if o.p != h.p {
+		return fmt.Errorf("cannot merge HyperLogLog sketches of precision %d and %d", h.p, o.p)
+	}
+	for i, r := range o.reg {
+		if r > h.reg[i] {
+			h.reg[i] = r
+		}
+	}
+	return nil
+}
+
+// estimate returns the estimated number of distinct clients, using linear counting for small cardinalities.
+func (h *hll) estimate() float64 {
+	m := float64(len(h.reg))
+	var sum float64
+	zeros := 0
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// relativeError is the standard error of the estimate as a fraction of it.
+func (h *hll) relativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.reg)))
+}
+
+// MarshalText encodes the sketch as base64 of the precision, a format byte and the registers, either
+// all of them or, when shorter, the non-zero ones as index/value pairs. Most pods see few clients, so
+// their sketches stay small in uploads.
+func (h *hll) MarshalText() ([]byte, error) {
+	var nonZero int
+	for _, r := range h.reg {
+		if r != 0 {
+			nonZero++
+		}
+	}
+	var b []byte
+	if 3*nonZero < len(h.reg) {
+		b = append(b, h.p, hllSparse)
+		for i, r := range h.reg {
+			if r != 0 {
+				b = binary.BigEndian.AppendUint16(b, uint16(i))
+				b = append(b, r)
+			}
+		}
+	} else {
+		b = append(b, h.p, hllDense)
+		b = append(b, h.reg...)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (h *hll) UnmarshalText(text []byte) error {
+	b, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid HyperLogLog sketch: %v", err)
+	}
+	if len(b) < 2 || b[0] < 4 || b[0] > 16 {
+		return fmt.Errorf("invalid HyperLogLog sketch")
+	}
+	*h = *newHLL(int(b[0]))
+	switch data := b[2:]; b[1] {
+	case hllDense:
+		if len(data) != len(h.reg) {
+			return fmt.Errorf("invalid HyperLogLog sketch: %d registers for precision %d", len(data), h.p)
+		}
+		copy(h.reg, data)
+	case hllSparse:
+		if len(data)%3 != 0 {
+			return fmt.Errorf("invalid HyperLogLog sketch")
+		}
+		for ; len(data) > 0; data = data[3:] {
+			i := int(binary.BigEndian.Uint16(data))
+			if i >= len(h.reg) {
+				return fmt.Errorf("invalid HyperLogLog sketch: register %d out of range", i)
+			}
+			h.reg[i] = data[2]
+		}
+	default:
+		return fmt.Errorf("invalid HyperLogLog sketch format %d", b[1])
+	}
+	return nil
+}
+
+// clientSketch sketches the remote ends of a pod's established target port connections.
+func clientSketch(sockets []Socket) *hll {
+	h := newHLL(*hllPrecision)
+	for _, s := range sockets {
+		if s.State != "ESTABLISHED" || !matchesTargetPort(s) {
+			continue
+		}
+		key := s.Remote.Addr().AsSlice()
+		if *distinctBy == "ip-port" {
+			key = binary.BigEndian.AppendUint16(key, s.Remote.Port())
+		}
+		h.add(key)
+	}
+	return h
+}
+
+// mergeSketches merges sketches, skipping missing ones and those of another precision. It returns nil
+// when there is nothing to merge.
+func mergeSketches(sketches ...*hll) *hll {
+	var merged *hll
+	for _, s := range sketches {
+		if s == nil {
+			continue
+		}
+		if merged == nil {
+			merged = newHLL(int(s.p))
+		}
+		if err := merged.merge(s); err != nil {
+			fmt.Printf("Skipping sketch: %v\n", err)
+		}
+	}
+	return merged
+}
+
+// formatEstimate renders an estimate with its 95% bounds, e.g. "1204 (1166-1242, ±3.2%)".
+func formatEstimate(h *hll) string {
+	e := h.estimate()
+	bound := 2 * h.relativeError()
+	return fmt.Sprintf("%.0f (%.0f-%.0f, ±%.1f%%)", e, e*(1-bound), e*(1+bound), 100*bound)
+}
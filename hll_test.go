@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"testing"
+)
+
+// sketchOf sketches the IPv4 addresses numbered from to to-1.
+func sketchOf(p, from, to int) *hll {
+	h := newHLL(p)
+	for i := from; i < to; i++ {
+		h.add(binary.BigEndian.AppendUint32(nil, uint32(0x0a000000+i)))
+	}
+	return h
+}
+
+func TestHLLErrorBounds(t *testing.T) {
+	for _, p := range []int{10, 12, 14} {
+		for _, n := range []int{1, 10, 100, 1000, 10000, 100000} {
+			h := sketchOf(p, 0, n)
+			// Three standard errors; the hash is fixed, so the outcome is too
+			if e := h.estimate(); math.Abs(e-float64(n)) > 3*h.relativeError()*float64(n)+0.5 {
+				t.Errorf("precision %d: estimate %.1f for %d clients, more than 3 standard errors (%.1f%%) off", p, e, n, 300*h.relativeError())
+			}
+		}
+	}
+	if e := newHLL(12).estimate(); e != 0 {
+		t.Errorf("empty sketch estimates %v", e)
+	}
+	if got := formatEstimate(sketchOf(12, 0, 1000)); !bytes.Contains([]byte(got), []byte("±3.2%")) {
+		t.Errorf("formatEstimate = %q, want 95%% bounds of ±3.2%%", got)
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	// Two pods share 20000 of their clients
+	a, b := sketchOf(12, 0, 60000), sketchOf(12, 40000, 100000)
+	merged := mergeSketches(a, nil, b)
+	if !bytes.Equal(merged.reg, sketchOf(12, 0, 100000).reg) {
+		t.Errorf("merged sketch differs from the sketch of the union")
+	}
+	if e := merged.estimate(); math.Abs(e-100000) > 3*merged.relativeError()*100000 {
+		t.Errorf("merged estimate %.0f, want about 100000 distinct clients", e)
+	}
+	// Merging leaves its inputs alone and does not depend on order
+	if !bytes.Equal(mergeSketches(b, a).reg, merged.reg) || !bytes.Equal(a.reg, sketchOf(12, 0, 60000).reg) {
+		t.Errorf("merge depends on order or changed its inputs")
+	}
+	if again := mergeSketches(merged, merged); !bytes.Equal(again.reg, merged.reg) {
+		t.Errorf("merging a sketch with itself changed it")
+	}
+
+	if err := newHLL(12).merge(newHLL(14)); err == nil {
+		t.Errorf("merged sketches of precision 12 and 14")
+	}
+	if m := mergeSketches(a, sketchOf(14, 0, 1000000)); !bytes.Equal(m.reg, a.reg) {
+		t.Errorf("a sketch of another precision was merged")
+	}
+	if m := mergeSketches(nil, nil); m != nil {
+		t.Errorf("mergeSketches of nothing = %v, want nil", m)
+	}
+}
+
+func TestHLLText(t *testing.T) {
+	for _, h := range []*hll{newHLL(12), sketchOf(12, 0, 50), sketchOf(12, 0, 100000), sketchOf(4, 0, 3)} {
+		text, err := h.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back hll
+		if err := back.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if back.p != h.p || !bytes.Equal(back.reg, h.reg) {
+			t.Errorf("precision %d sketch of %.0f clients does not round-trip", h.p, h.estimate())
+		}
+	}
+	// Few clients encode sparsely
+	if text, _ := sketchOf(12, 0, 50).MarshalText(); len(text) > 4*(2+3*50)/3+4 {
+		t.Errorf("sketch of 50 clients encodes to %d bytes", len(text))
+	}
+
+	for _, text := range []string{"not base64!", "", "AwA=", "EQA=", "DAAB", "DAEAAA==", "DAEQAAE=", "DAI="} {
+		var h hll
+		if err := h.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("UnmarshalText(%q) accepted", text)
+		}
+	}
+}
+
+func TestClientSketch(t *testing.T) {
+	var sockets []Socket
+	for i := 0; i < 300; i++ {
+		// 100 clients with three connections each, plus sockets that are not client connections
+		remote := netip.AddrPortFrom(netip.MustParseAddr(fmt.Sprintf("10.1.%d.%d", i%100/50, i%100)), uint16(40000+i))
+		sockets = append(sockets,
+			Socket{Local: netip.MustParseAddrPort("10.0.0.1:" + *targetPort), Remote: remote, State: "ESTABLISHED"},
+			Socket{Local: netip.MustParseAddrPort("10.0.0.1:" + *targetPort), Remote: remote, State: "TIME_WAIT"},
+			Socket{Local: netip.MustParseAddrPort("10.0.0.1:8080"), Remote: remote, State: "ESTABLISHED"},
+		)
+	}
+	h := clientSketch(sockets)
+	if e := h.estimate(); math.Abs(e-100) > 3*h.relativeError()*100 {
+		t.Errorf("distinct clients by ip = %.1f, want 100", e)
+	}
+	setFlag(t, distinctBy, "ip-port")
+	if e := clientSketch(sockets).estimate(); math.Abs(e-300) > 3*h.relativeError()*300 {
+		t.Errorf("distinct clients by ip-port = %.1f, want about 300", e)
+	}
+}
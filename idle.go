@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// idlePeerStat is the activity of one peer's established target port connections across all pods.
+type idlePeerStat struct {
+	Addr            string  `json:"addr"`
+	Active          int     `json:"active"`
+	Idle            int     `json:"idle"`
+	IdleNoKeepalive int     `json:"idleNoKeepalive"`
+	IdleP50         float64 `json:"idleP50Seconds"`
+	IdleMax         float64 `json:"idleMaxSeconds"`
+}
+
+// idleByPeer classifies the connections with TCP_INFO per peer, peers with the most idle connections
+// first. Peers without idle connections are left out.
+func idleByPeer(pods []PodResult, anon anonymizer) []idlePeerStat {
+	stats := make(map[string]*idlePeerStat)
+	durations := make(map[string][]time.Duration)
+	for _, p := range pods {
+		for _, s := range p.Sockets {
+			if s.Info == nil || s.State != "ESTABLISHED" || !matchesTargetPort(s) {
+				continue
+			}
+			addr := anon.addr(s.Remote.Addr())
+			st := stats[addr]
+			if st == nil {
+				st = &idlePeerStat{Addr: addr}
+				stats[addr] = st
+			}
+			switch activity(s) {
+			case activityActive:
+				st.Active++
+				continue
+			case activityIdleNoKeepalive:
+				st.IdleNoKeepalive++
+			}
+			st.Idle++
+			durations[addr] = append(durations[addr], idleFor(s.Info))
+		}
+	}
+
+	var peers []idlePeerStat
+	for addr, st := range stats {
+		d := durations[addr]
+		if len(d) == 0 {
+			continue
+		}
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		st.IdleP50 = quantile(d, 0.5).Seconds()
+		st.IdleMax = d[len(d)-1].Seconds()
+		peers = append(peers, *st)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Idle != peers[j].Idle {
+			return peers[i].Idle > peers[j].Idle
+		}
+		return peers[i].Addr < peers[j].Addr
+	})
+	return peers
+}
+
+// printIdle prints how many connections are active, idle and idle without keepalive, with the idle
+// durations, per pod and for the peers holding the most idle connections.
+func printIdle(r *Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := false
+	for _, p := range r.Pods {
+		t := p.TCPInfo
+		if t == nil || t.Idle == 0 {
+			continue
+		}
+		if !header {
+			fmt.Printf("Idle connections (no data for %v):\n", *idleAfter)
+			fmt.Fprintln(w, "  POD\tACTIVE\tIDLE\tNO KEEPALIVE\tIDLE P50\tIDLE P90\tIDLE MAX")
+			header = true
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%s\t%s\t%s\n", p.Target.Pod, t.Connections-t.Idle, t.Idle, t.IdleNoKeepalive,
+			formatIdle(t.IdleP50), formatIdle(t.IdleP90), formatIdle(t.IdleMax))
+	}
+	w.Flush()
+
+	peers := idleByPeer(r.Pods, anonymizerFor(sinkReport))
+	if len(peers) == 0 || *topPeers <= 0 {
+		return
+	}
+	fmt.Printf("Peers with the most idle connections (%d of %d):\n", min(*topPeers, len(peers)), len(peers))
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  PEER\tACTIVE\tIDLE\tNO KEEPALIVE\tIDLE P50\tIDLE MAX")
+	for i, p := range peers {
+		if i == *topPeers {
+			break
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%s\t%s\n", p.Addr, p.Active, p.Idle, p.IdleNoKeepalive, formatIdle(p.IdleP50), formatIdle(p.IdleMax))
+	}
+	w.Flush()
+}
+
+// formatIdle renders idle seconds to a tenth of a second, so sub-second idle times don't show as 0s.
+func formatIdle(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(100 * time.Millisecond).String()
+}
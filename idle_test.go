@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdleByPeer(t *testing.T) {
+	setFlag(t, idleAfter, time.Minute)
+	local := netip.MustParseAddrPort("10.0.0.1:" + *targetPort)
+	conn := func(remote string, idle time.Duration, timer string) Socket {
+		return Socket{Local: local, Remote: netip.MustParseAddrPort(remote), State: "ESTABLISHED", Timer: timer,
+			Info: &TCPInfo{LastSend: idle, LastRecv: idle}}
+	}
+	pods := []PodResult{
+		{Sockets: []Socket{
+			conn("10.1.0.1:40000", 2*time.Minute, "keepalive"),
+			conn("10.1.0.1:40001", 10*time.Minute, ""),
+			conn("10.1.0.2:40002", time.Second, ""),
+			// No TCP_INFO, so it cannot be classified
+			{Local: local, Remote: netip.MustParseAddrPort("10.1.0.3:40003"), State: "ESTABLISHED"},
+		}},
+		{Sockets: []Socket{
+			conn("10.1.0.1:40004", 4*time.Minute, "keepalive"),
+			conn("10.1.0.2:40005", 3*time.Minute, ""),
+			conn("10.1.0.2:40006", 30*time.Second, ""),
+		}},
+	}
+
+	want := []idlePeerStat{
+		{Addr: "10.1.0.1", Idle: 3, IdleNoKeepalive: 1, IdleP50: 240, IdleMax: 600},
+		{Addr: "10.1.0.2", Active: 2, Idle: 1, IdleNoKeepalive: 1, IdleP50: 180, IdleMax: 180},
+	}
+	if got := idleByPeer(pods, "none"); !reflect.DeepEqual(got, want) {
+		t.Errorf("idleByPeer = %+v, want %+v", got, want)
+	}
+
+	// Peers that anonymize the same are classified together
+	got := idleByPeer(pods, "truncate")
+	if len(got) != 1 || got[0].Addr != "10.1.0.0/24" || got[0].Active != 2 || got[0].Idle != 4 || got[0].IdleNoKeepalive != 2 {
+		t.Errorf("truncated idleByPeer = %+v", got)
+	}
+}
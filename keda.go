@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	kedaListenAddr = flag.String("keda-listen", "", "Serve the KEDA external scaler gRPC interface on this address (e.g. :9090)")
+	kedaMaxAge     = flag.Duration("keda-max-age", time.Minute, "Collect again for the KEDA external scaler when the latest report is older than this (with -interval, twice the interval at the least)")
+)
+
+const (
+	kedaDefaultMetricName  = "client_tcp_new"
+	kedaDefaultTargetValue = 100
+	// How often StreamIsActive re-evaluates when no collection interval is set
+	kedaStreamInterval = 30 * time.Second
+)
+
+// The messages of KEDA's externalscaler.proto. They are encoded by hand with protowire so the service
+// needs no generated code; field numbers must stay in line with the upstream proto.
+
+type scaledObjectRef struct {
+	Name           string
+	Namespace      string
+	ScalerMetadata map[string]string
+}
+
+type isActiveResponse struct {
+	Result bool
+}
+
+type metricSpec struct {
+	MetricName string
+	TargetSize int64
+}
+
+type getMetricSpecResponse struct {
+	MetricSpecs []metricSpec
+}
+
+type getMetricsRequest struct {
+	ScaledObjectRef scaledObjectRef
+	MetricName      string
+}
+
+type metricValue struct {
+	MetricName  string
+	MetricValue int64
+}
+
+type getMetricsResponse struct {
+	MetricValues []metricValue
+}
+
+// wireMessage is implemented by every message the external scaler sends or receives.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+func (m *scaledObjectRef) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.Name)
+	b = appendString(b, 2, m.Namespace)
+	for k, v := range m.ScalerMetadata {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, v)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func (m *scaledObjectRef) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.Name = string(v)
+		case 2:
+			m.Namespace = string(v)
+		case 3:
+			var key, value string
+			err := consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					key = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if m.ScalerMetadata == nil {
+				m.ScalerMetadata = make(map[string]string)
+			}
+			m.ScalerMetadata[key] = value
+		}
+		return nil
+	})
+}
+
+func (m *isActiveResponse) marshal() []byte {
+	var b []byte
+	if m.Result {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b
+}
+
+func (m *isActiveResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+		if num == 1 {
+			m.Result = n != 0
+		}
+		return nil
+	})
+}
+
+func (m *getMetricSpecResponse) marshal() []byte {
+	var b []byte
+	for _, spec := range m.MetricSpecs {
+		var s []byte
+		s = appendString(s, 1, spec.MetricName)
+		s = appendInt64(s, 2, spec.TargetSize)
+		s = appendDouble(s, 3, float64(spec.TargetSize))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return b
+}
+
+func (m *getMetricSpecResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var spec metricSpec
+		err := consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+			switch num {
+			case 1:
+				spec.MetricName = string(v)
+			case 2:
+				spec.TargetSize = int64(n)
+			}
+			return nil
+		})
+		m.MetricSpecs = append(m.MetricSpecs, spec)
+		return err
+	})
+}
+
+func (m *getMetricsRequest) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.ScaledObjectRef.marshal())
+	b = appendString(b, 2, m.MetricName)
+	return b
+}
+
+func (m *getMetricsRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			return m.ScaledObjectRef.unmarshal(v)
+		case 2:
+			m.MetricName = string(v)
+		}
+		return nil
+	})
+}
+
+func (m *getMetricsResponse) marshal() []byte {
+	var b []byte
+	for _, value := range m.MetricValues {
+		var v []byte
+		v = appendString(v, 1, value.MetricName)
+		v = appendInt64(v, 2, value.MetricValue)
+		v = appendDouble(v, 3, float64(value.MetricValue))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	return b
+}
+
+func (m *getMetricsResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		var value metricValue
+		err := consumeFields(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+			switch num {
+			case 1:
+				value.MetricName = string(v)
+			case 2:
+				value.MetricValue = int64(n)
+			}
+			return nil
+		})
+		m.MetricValues = append(m.MetricValues, value)
+		return err
+	})
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// consumeFields walks the fields of an encoded message, passing length-delimited values as bytes and
+// varints as numbers. Other wire types are skipped.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var err error
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			err = fn(num, typ, v, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			err = fn(num, typ, nil, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kedaCodec lets gRPC carry the hand-encoded messages.
+type kedaCodec struct{}
+
+func (kedaCodec) Name() string { return "proto" }
+
+func (kedaCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (kedaCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+// externalScalerServer is the externalscaler.ExternalScaler service.
+type externalScalerServer interface {
+	IsActive(context.Context, *scaledObjectRef) (*isActiveResponse, error)
+	StreamIsActive(*scaledObjectRef, grpc.ServerStream) error
+	GetMetricSpec(context.Context, *scaledObjectRef) (*getMetricSpecResponse, error)
+	GetMetrics(context.Context, *getMetricsRequest) (*getMetricsResponse, error)
+}
+
+var kedaServiceDesc = grpc.ServiceDesc{
+	ServiceName: "externalscaler.ExternalScaler",
+	HandlerType: (*externalScalerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "IsActive",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(scaledObjectRef)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(externalScalerServer).IsActive(ctx, in)
+			},
+		},
+		{
+			MethodName: "GetMetricSpec",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(scaledObjectRef)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(externalScalerServer).GetMetricSpec(ctx, in)
+			},
+		},
+		{
+			MethodName: "GetMetrics",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(getMetricsRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(externalScalerServer).GetMetrics(ctx, in)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamIsActive",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := new(scaledObjectRef)
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(externalScalerServer).StreamIsActive(in, stream)
+			},
+		},
+	},
+	Metadata: "externalscaler.proto",
+}
+
+// newKEDAServer returns a gRPC server with the external scaler registered. The scaler answers from the
+// latest collection, or from a fresh one when nothing has been collected yet or the latest is too old.
+func newKEDAServer() *grpc.Server {
+	s := grpc.NewServer(grpc.ForceServerCodec(kedaCodec{}))
+	s.RegisterService(&kedaServiceDesc, &kedaScaler{collect: collect})
+	return s
+}
+
+// serveKEDA runs the external scaler until the process exits.
+func serveKEDA(addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("KEDA external scaler failed to listen: %v\n", err)
+		return
+	}
+	fmt.Printf("Serving KEDA external scaler on %s\n", addr)
+	if err := newKEDAServer().Serve(lis); err != nil {
+		fmt.Printf("KEDA external scaler failed: %v\n", err)
+	}
+}
+
+// kedaScaler implements externalScalerServer on top of the collected connection counts.
+type kedaScaler struct {
+	collect func() (*Report, error)
+	// Held while collecting, so concurrent calls wait for one collection instead of each starting their own
+	collectMu sync.Mutex
+}
+
+// kedaScalerConfig is read from the scalerMetadata of a ScaledObject trigger.
+type kedaScalerConfig struct {
+	// Pods to count, as a label selector
+	Selector string
+	// Namespace of the pods, the ScaledObject's namespace by default
+	Namespace       string
+	MetricName      string
+	TargetValue     int64
+	ActivationValue int64
+}
+
+func parseKEDAConfig(ref *scaledObjectRef) (kedaScalerConfig, error) {
+	cfg := kedaScalerConfig{
+		Selector:    ref.ScalerMetadata["selector"],
+		Namespace:   ref.ScalerMetadata["namespace"],
+		MetricName:  ref.ScalerMetadata["metricName"],
+		TargetValue: kedaDefaultTargetValue,
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = ref.Namespace
+	}
+	if cfg.MetricName == "" {
+		cfg.MetricName = kedaDefaultMetricName
+	}
+	if v := ref.ScalerMetadata["targetValue"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid targetValue %q", v)
+		}
+		cfg.TargetValue = n
+	}
+	if v := ref.ScalerMetadata["activationValue"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid activationValue %q", v)
+		}
+		cfg.ActivationValue = n
+	}
+	return cfg, nil
+}
+
+// report returns the latest report, collecting a new one when there is none or it is older than
+// -keda-max-age. With -interval the collection loop keeps it fresh, so this only collects when the loop
+// has fallen behind.
+func (k *kedaScaler) report() (*Report, error) {
+	maxAge := *kedaMaxAge
+	if *interval > 0 {
+		maxAge = max(maxAge, 2**interval)
+	}
+	fresh := func(r *Report) bool { return r != nil && time.Since(r.Start) < maxAge }
+	if r := latestReport(); fresh(r) {
+		return r, nil
+	}
+
+	k.collectMu.Lock()
+	defer k.collectMu.Unlock()
+	// Another call may have collected while this one waited
+	if r := latestReport(); fresh(r) {
+		return r, nil
+	}
+	r, err := k.collect()
+	if err != nil {
+		return nil, err
+	}
+	setLatestReport(r)
+	return r, nil
+}
+
+// connections sums the connections of the pods the ScaledObject selects.
+func (k *kedaScaler) connections(cfg kedaScalerConfig) (int64, error) {
+	report, err := k.report()
+	if err != nil {
+		return 0, err
+	}
+
+	reqs, err := parseSelector(cfg.Selector)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range report.Pods {
+		if cfg.Namespace != "" && p.Target.Namespace != cfg.Namespace {
+			continue
+		}
+		if matchesSelector(p.Target, reqs) {
+			total += int64(p.Count)
+		}
+	}
+	return total, nil
+}
+
+func (k *kedaScaler) isActive(ref *scaledObjectRef) (bool, error) {
+	cfg, err := parseKEDAConfig(ref)
+	if err != nil {
+		return false, err
+	}
+	total, err := k.connections(cfg)
+	if err != nil {
+		return false, err
+	}
+	return total > cfg.ActivationValue, nil
+}
+
+func (k *kedaScaler) IsActive(_ context.Context, ref *scaledObjectRef) (*isActiveResponse, error) {
+	active, err := k.isActive(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &isActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive sends the activity state whenever it changes, until KEDA closes the stream.
+func (k *kedaScaler) StreamIsActive(ref *scaledObjectRef, stream grpc.ServerStream) error {
+	every := *interval
+	if every <= 0 {
+		every = kedaStreamInterval
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	var sent, last bool
+	for {
+		active, err := k.isActive(ref)
+		if err != nil {
+			fmt.Printf("KEDA stream for %s/%s: %v\n", ref.Namespace, ref.Name, err)
+		} else if !sent || active != last {
+			if err := stream.SendMsg(&isActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			sent, last = true, active
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *kedaScaler) GetMetricSpec(_ context.Context, ref *scaledObjectRef) (*getMetricSpecResponse, error) {
+	cfg, err := parseKEDAConfig(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &getMetricSpecResponse{MetricSpecs: []metricSpec{{MetricName: cfg.MetricName, TargetSize: cfg.TargetValue}}}, nil
+}
+
+// GetMetrics returns the total connections; KEDA divides it by the target size to get the replica count.
+func (k *kedaScaler) GetMetrics(_ context.Context, req *getMetricsRequest) (*getMetricsResponse, error) {
+	cfg, err := parseKEDAConfig(&req.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+	total, err := k.connections(cfg)
+	if err != nil {
+		return nil, err
+	}
+	name := req.MetricName
+	if name == "" {
+		name = cfg.MetricName
+	}
+	return &getMetricsResponse{MetricValues: []metricValue{{MetricName: name, MetricValue: total}}}, nil
+}
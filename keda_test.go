@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func kedaTestReport(start time.Time, counts map[string]int) *Report {
+	r := &Report{RunID: newRunID(), Start: start}
+	for pod, n := range counts {
+		t := Target{Namespace: "fpms", Pod: pod, Labels: map[string]string{"label_app": "client"}}
+		r.Pods = append(r.Pods, PodResult{Target: t, Count: n})
+		r.Total += n
+	}
+	return r
+}
+
+// startKEDA serves the external scaler over an in-memory listener and returns a client connection.
+func startKEDA(t *testing.T, scaler *kedaScaler) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.ForceServerCodec(kedaCodec{}))
+	s.RegisterService(&kedaServiceDesc, scaler)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(kedaCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKEDAScaler(t *testing.T) {
+	setLatestReport(kedaTestReport(time.Now(), map[string]int{"client-a-1": 30, "client-a-2": 50}))
+	t.Cleanup(func() { setLatestReport(nil) })
+	scaler := &kedaScaler{collect: func() (*Report, error) {
+		t.Error("collected although the latest report is fresh")
+		return nil, nil
+	}}
+	conn := startKEDA(t, scaler)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ref := scaledObjectRef{
+		Name:           "client",
+		Namespace:      "fpms",
+		ScalerMetadata: map[string]string{"selector": "app=client", "targetValue": "40", "activationValue": "10"},
+	}
+
+	var active isActiveResponse
+	if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/IsActive", &ref, &active); err != nil {
+		t.Fatal(err)
+	}
+	if !active.Result {
+		t.Errorf("IsActive = false, want true with 80 connections over an activation value of 10")
+	}
+
+	var spec getMetricSpecResponse
+	if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/GetMetricSpec", &ref, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.MetricSpecs) != 1 || spec.MetricSpecs[0] != (metricSpec{MetricName: "client_tcp_new", TargetSize: 40}) {
+		t.Errorf("GetMetricSpec = %+v", spec.MetricSpecs)
+	}
+
+	var metrics getMetricsResponse
+	req := getMetricsRequest{ScaledObjectRef: ref, MetricName: "client_tcp_new"}
+	if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/GetMetrics", &req, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics.MetricValues) != 1 || metrics.MetricValues[0] != (metricValue{MetricName: "client_tcp_new", MetricValue: 80}) {
+		t.Errorf("GetMetrics = %+v", metrics.MetricValues)
+	}
+
+	ref.ScalerMetadata["selector"] = "app=server"
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/externalscaler.ExternalScaler/StreamIsActive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var streamed isActiveResponse
+	if err := stream.RecvMsg(&streamed); err != nil {
+		t.Fatal(err)
+	}
+	if streamed.Result {
+		t.Errorf("StreamIsActive = true, want false when the selector matches no pods")
+	}
+}
+
+func TestKEDAScalerRefreshesStaleReport(t *testing.T) {
+	setLatestReport(kedaTestReport(time.Now().Add(-2**kedaMaxAge), map[string]int{"client-a-1": 1}))
+	t.Cleanup(func() { setLatestReport(nil) })
+
+	var collections atomic.Int32
+	scaler := &kedaScaler{collect: func() (*Report, error) {
+		collections.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return kedaTestReport(time.Now(), map[string]int{"client-a-1": 7}), nil
+	}}
+	cfg := kedaScalerConfig{Namespace: "fpms"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			total, err := scaler.connections(cfg)
+			if err != nil {
+				t.Error(err)
+			} else if total != 7 {
+				t.Errorf("connections = %d, want 7 from the new collection", total)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := collections.Load(); n != 1 {
+		t.Errorf("collected %d times, want once for concurrent calls", n)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	leakWindow    = flag.Duration("leak-window", 2*time.Hour, "Span of history the leak detector fits a trend over")
+	leakMinGrowth = flag.Float64("leak-min-growth", 0.5, "Growth over the window, relative to the pod's average, at which a pod is suspected of leaking")
+)
+
+const (
+	// Fewest samples in the window before a trend is trusted
+	leakMinSamples = 10
+	// Fewest sockets a series must have grown by, so tiny counts going from 1 to 3 are not reported
+	leakMinIncrease = 10
+	// Share of steps that must not decrease for growth to count as monotonic
+	leakMonotonicShare = 0.9
+	// A pod only leaks if it grows at least this many times faster than the rest of the fleet
+	leakFleetFactor = 2
+)
+
+// trend is a least-squares fit of a series over the leak window.
+type trend struct {
+	// Growth in sockets per hour
+	Slope float64
+	Mean  float64
+	// Growth over the window relative to the mean
+	Growth    float64
+	Monotonic bool
+	Increase  float64
+}
+
+// fitTrend fits a line through the samples and measures how steadily they grow.
+func fitTrend(samples []sample, window time.Duration) trend {
+	n := float64(len(samples))
+	t0 := samples[0].T
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.T.Sub(t0).Hours()
+		sumX += x
+		sumY += s.V
+		sumXY += x * s.V
+		sumXX += x * x
+	}
+
+	var tr trend
+	tr.Mean = sumY / n
+	if d := n*sumXX - sumX*sumX; d != 0 {
+		tr.Slope = (n*sumXY - sumX*sumY) / d
+	}
+	if tr.Mean > 0 {
+		tr.Growth = tr.Slope * window.Hours() / tr.Mean
+	}
+
+	var rising int
+	for i := 1; i < len(samples); i++ {
+		if samples[i].V >= samples[i-1].V {
+			rising++
+		}
+	}
+	tr.Increase = samples[len(samples)-1].V - samples[0].V
+	tr.Monotonic = tr.Increase > 0 && float64(rising) >= leakMonotonicShare*float64(len(samples)-1)
+	return tr
+}
+
+// detectLeaks looks for pods whose socket count in some state grows steadily over the leak window while
+// the rest of the fleet does not grow along with it, which points at a leak rather than more traffic.
+func detectLeaks() []Finding {
+	since := time.Now().Add(-*leakWindow)
+	all := history.query(metricPodSockets, nil, since)
+
+	// Fleet-wide totals per state and sample time, so each pod can be compared with everyone else
+	fleet := make(map[string]map[time.Time]float64)
+	for _, s := range all {
+		state := s.Labels["state"]
+		if fleet[state] == nil {
+			fleet[state] = make(map[time.Time]float64)
+		}
+		for _, smp := range s.Samples {
+			fleet[state][smp.T] += smp.V
+		}
+	}
+
+	var findings []Finding
+	for _, s := range all {
+		if len(s.Samples) < leakMinSamples {
+			continue
+		}
+		tr := fitTrend(s.Samples, *leakWindow)
+		if !tr.Monotonic || tr.Increase < leakMinIncrease || tr.Growth < *leakMinGrowth {
+			continue
+		}
+
+		state := s.Labels["state"]
+		rest := make([]sample, 0, len(s.Samples))
+		for _, smp := range s.Samples {
+			rest = append(rest, sample{T: smp.T, V: fleet[state][smp.T] - smp.V})
+		}
+		fleetTrend := fitTrend(rest, *leakWindow)
+		if fleetTrend.Growth*leakFleetFactor > tr.Growth {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Kind:      "connection_leak",
+			Severity:  "warning",
+			Namespace: s.Labels["namespace"],
+			Pod:       s.Labels["pod"],
+			Message: fmt.Sprintf("pod %s/%s: %s sockets grew from %.0f to %.0f (%.1f/h, %+.0f%% over %v) while the rest of the fleet changed %+.0f%%",
+				s.Labels["namespace"], s.Labels["pod"], state, s.Samples[0].V, s.Samples[len(s.Samples)-1].V,
+				tr.Slope, 100*tr.Growth, *leakWindow, 100*fleetTrend.Growth),
+			Labels: map[string]string{
+				"state":       state,
+				"growth_rate": fmt.Sprintf("%.2f", tr.Slope),
+			},
+		})
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Message < findings[j].Message })
+	return findings
+}
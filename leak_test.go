@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// seedHistory replaces the daemon history with one built from the runs, which start every step and end now.
+// states returns the sockets of a pod in each state at run i.
+func seedHistory(t *testing.T, runs int, step time.Duration, pods []string, states func(pod string, i int) map[string]int) {
+	t.Helper()
+	saved := history
+	history = &historyStore{series: make(map[string]*series), podStates: make(map[string]map[string]bool)}
+	t.Cleanup(func() { history = saved })
+
+	start := time.Now().Add(-time.Duration(runs-1) * step)
+	for i := 0; i < runs; i++ {
+		r := &Report{Start: start.Add(time.Duration(i) * step)}
+		for _, pod := range pods {
+			p := PodResult{Target: Target{Namespace: "fpms", Pod: pod}, States: states(pod, i)}
+			p.Count = p.States["ESTABLISHED"]
+			r.Pods = append(r.Pods, p)
+			r.Total += p.Count
+		}
+		history.record(r)
+	}
+}
+
+func TestDetectLeaks(t *testing.T) {
+	pods := []string{"client-a-1", "client-a-2", "client-a-3"}
+	seedHistory(t, 20, 6*time.Minute, pods, func(pod string, i int) map[string]int {
+		// Traffic grows on every pod alike, which is not a leak
+		states := map[string]int{"ESTABLISHED": 20 + 2*i, "CLOSE_WAIT": 5}
+		switch pod {
+		case "client-a-1":
+			states["CLOSE_WAIT"] = 5 + 3*i
+		case "client-a-2":
+			// Steady, but too few sockets to matter
+			states["TIME_WAIT"] = 1 + i/8
+		case "client-a-3":
+			// Large swings without a steady rise
+			states["FIN_WAIT2"] = 10 + 40*(i%2) + i
+		}
+		return states
+	})
+
+	findings := detectLeaks()
+	if len(findings) != 1 {
+		t.Fatalf("got %d findings, want the CLOSE_WAIT leak on client-a-1: %+v", len(findings), findings)
+	}
+	f := findings[0]
+	if f.Kind != "connection_leak" || f.Pod != "client-a-1" || f.Labels["state"] != "CLOSE_WAIT" || f.Labels["growth_rate"] != "30.00" {
+		t.Errorf("finding = %+v", f)
+	}
+}
+
+func TestDetectLeaksNeedsSamples(t *testing.T) {
+	seedHistory(t, leakMinSamples-1, 6*time.Minute, []string{"client-a-1"}, func(pod string, i int) map[string]int {
+		return map[string]int{"CLOSE_WAIT": 5 + 10*i}
+	})
+	if findings := detectLeaks(); len(findings) != 0 {
+		t.Errorf("reported a leak from %d samples: %+v", leakMinSamples-1, findings)
+	}
+}
+
+func TestFitTrend(t *testing.T) {
+	start := time.Now()
+	var rising, falling []sample
+	for i := 0; i < 11; i++ {
+		at := start.Add(time.Duration(i) * 12 * time.Minute)
+		rising = append(rising, sample{T: at, V: float64(10 + 5*i)})
+		falling = append(falling, sample{T: at, V: float64(60 - 5*i)})
+	}
+
+	tr := fitTrend(rising, 2*time.Hour)
+	// 5 sockets every 12 minutes, around a mean of 35
+	if tr.Slope < 24.99 || tr.Slope > 25.01 || tr.Mean != 35 || tr.Increase != 50 || !tr.Monotonic {
+		t.Errorf("rising trend = %+v", tr)
+	}
+	if g := 50.0 / 35; tr.Growth < g-0.001 || tr.Growth > g+0.001 {
+		t.Errorf("rising growth = %v, want %v", tr.Growth, g)
+	}
+	if tr := fitTrend(falling, 2*time.Hour); tr.Slope >= 0 || tr.Monotonic {
+		t.Errorf("falling trend = %+v", tr)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	localBackend = flag.String("local-backend", "auto", "How local collection reads sockets: sockdiag (netlink), proc (/proc/net/tcp*) or auto (sockdiag, falling back to proc)")
+	procNetDir   = flag.String("proc-net", "/proc/net", "Directory holding the tcp and tcp6 tables for the proc backend")
+)
+
+// connectionStates are the states local collection asks for: everything but listeners, like `netstat -tn`.
+var connectionStates = []string{
+	"ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "CLOSING",
+}
+
+// localSockets reads the target port sockets of the network namespace this process runs in. In a pod
+// that is the pod's own namespace; a node agent with hostNetwork sees the node's.
+func localSockets() ([]Socket, error) {
+	port, err := strconv.ParseUint(*targetPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target port %q: %v", *targetPort, err)
+	}
+
+	switch *localBackend {
+	case "sockdiag":
+		return sockDiagSockets(uint16(port), connectionStates)
+	case "proc":
+		return procNetSockets(*procNetDir)
+	case "auto":
+		sockets, err := sockDiagSockets(uint16(port), connectionStates)
+		if err == nil {
+			return sockets, nil
+		}
+		fmt.Printf("sock_diag unavailable (%v), reading %s\n", err, *procNetDir)
+		return procNetSockets(*procNetDir)
+	default:
+		return nil, fmt.Errorf("unknown local backend %q", *localBackend)
+	}
+}
+
+// procNetSockets parses the tcp and tcp6 tables in dir, keeping the same sockets sock_diag would return.
+func procNetSockets(dir string) ([]Socket, error) {
+	var sockets []Socket
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) && name == "tcp6" {
+			// IPv6 disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		all, err := parseProcNetTCP(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		for _, s := range all {
+			if s.State != "LISTEN" && matchesTargetPort(s) {
+				sockets = append(sockets, s)
+			}
+		}
+	}
+	return sockets, nil
+}
+
+// localTarget describes the pod (or node) local collection runs in, from the downward API when available.
+func localTarget() Target {
+	t := Target{Namespace: os.Getenv("POD_NAMESPACE"), Pod: os.Getenv("POD_NAME"), IP: os.Getenv("POD_IP")}
+	if t.Namespace == "" {
+		t.Namespace = namespace
+	}
+	if t.Pod == "" {
+		t.Pod, _ = os.Hostname()
+	}
+	t.Labels = map[string]string{"namespace": t.Namespace, "pod": t.Pod}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		t.Labels["node"] = node
+	}
+	return t
+}
+
+// collectLocal runs one collection of the local network namespace.
+func collectLocal() (*Report, error) {
+	startTime := time.Now()
+	sockets, err := localSockets()
+	if err != nil {
+		return nil, err
+	}
+	result := newPodResult(localTarget(), sockets)
+	fmt.Printf("TCP connection count for pod %s: %d\n", result.Target.Pod, result.Count)
+	return &Report{
+		RunID:    newRunID(),
+		Start:    startTime,
+		Duration: time.Since(startTime),
+		Pods:     []PodResult{result},
+		Total:    result.Count,
+	}, nil
+}
+
+// runLocal is the local command, a run over the sockets of the local network namespace instead of exec'ing
+// into pods:
+//
+//	check-conn-script [-local-backend sockdiag] local
+func runLocal(args []string) error {
+	fs := flag.NewFlagSet("local", flag.ExitOnError)
+	fs.Parse(args)
+
+	report, err := collectLocal()
+	if err != nil {
+		return err
+	}
+	return process(report)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// openConnections opens n loopback connections to a listener on the target port and returns the
+// listener's port. It skips the test when the port is taken.
+func openConnections(tb testing.TB, n int) uint16 {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:"+*targetPort)
+	if err != nil {
+		tb.Skipf("cannot listen on the target port: %v", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tb.Cleanup(func() { c.Close() })
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { c.Close() })
+	}
+	port, _ := strconv.Atoi(*targetPort)
+	return uint16(port)
+}
+
+// established returns the established sockets without TCP_INFO, which only sock_diag gathers, in a
+// stable order.
+func established(sockets []Socket) []Socket {
+	var out []Socket
+	for _, s := range sockets {
+		if s.State == "ESTABLISHED" {
+			s.Info = nil
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Local != out[j].Local {
+			return out[i].Local.String() < out[j].Local.String()
+		}
+		return out[i].Remote.String() < out[j].Remote.String()
+	})
+	return out
+}
+
+func TestBackendsAgree(t *testing.T) {
+	port := openConnections(t, 5)
+
+	fromDiag, err := sockDiagSockets(port, connectionStates)
+	if err != nil {
+		t.Skipf("sock_diag unavailable: %v", err)
+	}
+	fromProc, err := procNetSockets("/proc/net")
+	if err != nil {
+		t.Skipf("/proc/net unavailable: %v", err)
+	}
+
+	diag, proc := established(fromDiag), established(fromProc)
+	// Each connection shows up from both ends
+	if len(diag) != 10 {
+		t.Fatalf("sock_diag returned %d established sockets, want 10: %v", len(diag), diag)
+	}
+	if len(proc) != len(diag) {
+		t.Fatalf("proc returned %d established sockets, sock_diag %d", len(proc), len(diag))
+	}
+	for i := range diag {
+		if diag[i] != proc[i] {
+			t.Errorf("socket %d: sock_diag %+v, proc %+v", i, diag[i], proc[i])
+		}
+	}
+}
+
+func BenchmarkSockDiag(b *testing.B) {
+	port := openConnections(b, 100)
+	if _, err := sockDiagSockets(port, connectionStates); err != nil {
+		b.Skipf("sock_diag unavailable: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sockDiagSockets(port, connectionStates); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseProcNetTCP(b *testing.B) {
+	openConnections(b, 100)
+	if _, err := procNetSockets("/proc/net"); err != nil {
+		b.Skipf("/proc/net unavailable: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := procNetSockets("/proc/net"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	lockFile  = flag.String("lock-file", "", "Hold this lock file during a one-shot run so overlapping runs (e.g. from cron) don't both push totals")
+	lockLease = flag.String("lock-lease", "", "Hold this Kubernetes Lease ([namespace/]name) during a one-shot run, e.g. when run as a CronJob")
+	lockWait  = flag.Duration("lock-wait", 0, "How long to wait for a held run lock before skipping the run (0 skips right away)")
+	lockStale = flag.Duration("lock-stale", 30*time.Minute, "Take over a run Lease its holder has not renewed for this long (its duration as set by the holder); lock files are released when their holder exits")
+
+	lockSkipExitCode = flag.Int("lock-skip-exit-code", 0, "Exit a one-shot run skipped for a held run lock with this code, e.g. 3 for cron or CronJob monitoring to tell skips apart (0 exits as a normal run)")
+)
+
+// errRunSkipped is returned by withRunLock for a skipped run when -lock-skip-exit-code is set
+var errRunSkipped = errors.New("run skipped")
+
+// lockPollInterval is how often a waiting run retries the lock
+const lockPollInterval = 2 * time.Second
+
+// runLock is the lock one-shot runs hold while they run.
+type runLock interface {
+	// tryAcquire takes the lock, or returns who holds it
+	tryAcquire() (holder string, ok bool, err error)
+	// refresh keeps the held lock from going stale
+	refresh() error
+	release() error
+	String() string
+}
+
+// lockHolder identifies this process: the hostname, which is the pod name in a CronJob, and the PID.
+func lockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// withRunLock runs fn holding the configured run lock. When the lock stays held past -lock-wait, fn does
+// not run and a skipped report goes through process instead, which only -routes and -cloudwatch-namespace
+// ship; -lock-skip-exit-code surfaces the skip to whatever runs the process.
+func withRunLock(fn func() error) error {
+	var lock runLock
+	switch {
+	case *lockFile != "" && *lockLease != "":
+		return fmt.Errorf("use only one of -lock-file and -lock-lease")
+	case *lockFile != "":
+		lock = &fileLock{path: *lockFile, holder: lockHolder()}
+	case *lockLease != "":
+		ns, name := namespace, *lockLease
+		if i := strings.Index(name, "/"); i >= 0 {
+			ns, name = name[:i], name[i+1:]
+		}
+		lock = &leaseLock{namespace: ns, name: name, holder: lockHolder()}
+	default:
+		return fn()
+	}
+	// The lock is refreshed every third of -lock-stale, and leases count in whole seconds
+	if *lockStale < time.Second {
+		return fmt.Errorf("-lock-stale must be at least 1s, got %v", *lockStale)
+	}
+
+	start := time.Now()
+	for {
+		holder, ok, err := lock.tryAcquire()
+		if err != nil {
+			return fmt.Errorf("failed to acquire run lock %s: %v", lock, err)
+		}
+		if ok {
+			break
+		}
+		if time.Since(start) >= *lockWait {
+			err := process(&Report{
+				RunID:   newRunID(),
+				Start:   start,
+				Skipped: fmt.Sprintf("run lock %s is held by %s", lock, holder),
+			})
+			if err == nil && *lockSkipExitCode != 0 {
+				err = errRunSkipped
+			}
+			return err
+		}
+		fmt.Printf("Run lock %s is held by %s, waiting\n", lock, holder)
+		time.Sleep(min(lockPollInterval, *lockWait-time.Since(start)))
+	}
+	fmt.Printf("Acquired run lock %s\n", lock)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*lockStale / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := lock.refresh(); err != nil {
+					fmt.Printf("Error refreshing run lock %s: %v\n", lock, err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		if err := lock.release(); err != nil {
+			fmt.Printf("Error releasing run lock %s: %v\n", lock, err)
+		}
+	}()
+	return fn()
+}
+
+// fileLock is a lock file held with flock(2), holding the holder's identity for runs that find it taken.
+// The kernel drops the lock when the holder exits, so a crashed run never leaves it stale.
+type fileLock struct {
+	path, holder string
+	f            *os.File
+}
+
+type fileLockContent struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+}
+
+func (l *fileLock) String() string { return l.path }
+
+func (l *fileLock) tryAcquire() (string, bool, error) {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return "", false, err
+	}
+	ok, err := flockFile(f)
+	if err != nil || !ok {
+		var content fileLockContent
+		if data, rerr := io.ReadAll(f); rerr == nil {
+			json.Unmarshal(data, &content)
+		}
+		f.Close()
+		holder := content.Holder
+		if holder == "" {
+			holder = "unknown"
+		}
+		if !content.Acquired.IsZero() {
+			holder += " since " + content.Acquired.Format(time.RFC3339)
+		}
+		return holder, false, err
+	}
+
+	data, err := json.Marshal(fileLockContent{Holder: l.holder, Acquired: time.Now()})
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err != nil {
+		f.Close()
+		return "", false, err
+	}
+	l.f = f
+	return l.holder, true, nil
+}
+
+// refresh touches the lock file, so its modification time shows the holder is alive.
+func (l *fileLock) refresh() error {
+	now := time.Now()
+	return os.Chtimes(l.path, now, now)
+}
+
+// release empties the lock file and unlocks it. The file stays: removing it would let a run lock the
+// unlinked file while another creates a new one.
+func (l *fileLock) release() error {
+	err := l.f.Truncate(0)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// leaseLock is a coordination.k8s.io Lease. Updates carry the resourceVersion they read, so of two runs
+// racing for the lease only one wins.
+type leaseLock struct {
+	namespace, name, holder string
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       *string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *string `json:"acquireTime,omitempty"`
+		RenewTime            *string `json:"renewTime,omitempty"`
+		LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// Kubernetes MicroTime
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *leaseLock) String() string { return "lease " + l.namespace + "/" + l.name }
+
+// get returns the lease, or nil if it does not exist.
+func (l *leaseLock) get() (*lease, error) {
+	out, err := runCommand("discovery", kubectl("get", "lease", "-n", l.namespace, l.name, "-o", "json"))
+	if err != nil {
+		if strings.Contains(commandStderr(err), "NotFound") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v: %s", err, commandStderr(err))
+	}
+	var le lease
+	if err := json.Unmarshal(out, &le); err != nil {
+		return nil, fmt.Errorf("failed to parse lease: %v", err)
+	}
+	return &le, nil
+}
+
+// write creates or replaces the lease. It returns false when another writer got there first.
+func (l *leaseLock) write(verb string, le *lease) (bool, error) {
+	data, err := json.Marshal(le)
+	if err != nil {
+		return false, err
+	}
+	cmd := kubectl(verb, "-f", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	if _, err := runCommand("sink", cmd); err != nil {
+		msg := commandStderr(err)
+		if strings.Contains(msg, "AlreadyExists") || strings.Contains(msg, "Conflict") || strings.Contains(msg, "has been modified") {
+			return false, nil
+		}
+		return false, fmt.Errorf("%v: %s", err, msg)
+	}
+	return true, nil
+}
+
+func (l *leaseLock) tryAcquire() (string, bool, error) {
+	le, err := l.get()
+	if err != nil {
+		return "", false, err
+	}
+	now := time.Now().UTC().Format(microTime)
+	duration := int(lockStale.Seconds())
+	if le == nil {
+		le = &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		le.Metadata.Name, le.Metadata.Namespace = l.name, l.namespace
+		le.Spec.HolderIdentity, le.Spec.LeaseDurationSeconds = &l.holder, &duration
+		le.Spec.AcquireTime, le.Spec.RenewTime = &now, &now
+		ok, err := l.write("create", le)
+		return "a run that just created it", ok, err
+	}
+
+	holder := ""
+	if le.Spec.HolderIdentity != nil {
+		holder = *le.Spec.HolderIdentity
+	}
+	if holder != "" && holder != l.holder {
+		var renewed time.Time
+		if le.Spec.RenewTime != nil {
+			renewed, _ = time.Parse(time.RFC3339Nano, *le.Spec.RenewTime)
+		}
+		expiry := *lockStale
+		if le.Spec.LeaseDurationSeconds != nil {
+			expiry = time.Duration(*le.Spec.LeaseDurationSeconds) * time.Second
+		}
+		if age := time.Since(renewed); age < expiry {
+			return fmt.Sprintf("%s, renewed %v ago", holder, age.Round(time.Second)), false, nil
+		}
+		fmt.Printf("Taking over run lock %s from %s, not renewed for %v\n", l, holder, time.Since(renewed).Round(time.Second))
+	}
+
+	transitions := 0
+	if le.Spec.LeaseTransitions != nil {
+		transitions = *le.Spec.LeaseTransitions
+	}
+	if holder != l.holder {
+		transitions++
+	}
+	le.Spec.HolderIdentity, le.Spec.LeaseDurationSeconds, le.Spec.LeaseTransitions = &l.holder, &duration, &transitions
+	le.Spec.AcquireTime, le.Spec.RenewTime = &now, &now
+	ok, err := l.write("replace", le)
+	return "a run that took it first", ok, err
+}
+
+func (l *leaseLock) refresh() error {
+	le, err := l.get()
+	if err != nil {
+		return err
+	}
+	if le == nil || le.Spec.HolderIdentity == nil || *le.Spec.HolderIdentity != l.holder {
+		return fmt.Errorf("lease was taken over")
+	}
+	now := time.Now().UTC().Format(microTime)
+	le.Spec.RenewTime = &now
+	if ok, err := l.write("replace", le); err != nil || !ok {
+		return fmt.Errorf("failed to renew lease: %v", err)
+	}
+	return nil
+}
+
+// release clears the holder, so the next run need not wait for the lease to expire.
+func (l *leaseLock) release() error {
+	le, err := l.get()
+	if err != nil || le == nil || le.Spec.HolderIdentity == nil || *le.Spec.HolderIdentity != l.holder {
+		return err
+	}
+	le.Spec.HolderIdentity = nil
+	le.Spec.AcquireTime, le.Spec.RenewTime = nil, nil
+	_, err = l.write("replace", le)
+	return err
+}
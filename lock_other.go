@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// flockFile needs flock(2), which only Unix systems have.
+func flockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("-lock-file is only supported on Unix systems, use -lock-lease")
+}
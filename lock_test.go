@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	a := &fileLock{path: path, holder: "cron-a/1"}
+	b := &fileLock{path: path, holder: "cron-b/2"}
+
+	if _, ok, err := a.tryAcquire(); err != nil || !ok {
+		t.Fatalf("first run did not get the lock: %v", err)
+	}
+	holder, ok, err := b.tryAcquire()
+	if err != nil || ok {
+		t.Fatalf("second run got the held lock: %v", err)
+	}
+	if !strings.HasPrefix(holder, "cron-a/1 since ") {
+		t.Errorf("holder = %q, want cron-a/1", holder)
+	}
+	if err := a.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.tryAcquire(); err != nil || !ok {
+		t.Fatalf("lock not free after release: %v", err)
+	}
+	b.release()
+}
+
+func TestFileLockRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var holders []*fileLock
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(l *fileLock) {
+			defer wg.Done()
+			if _, ok, err := l.tryAcquire(); err != nil {
+				t.Error(err)
+			} else if ok {
+				mu.Lock()
+				holders = append(holders, l)
+				mu.Unlock()
+			}
+		}(&fileLock{path: path, holder: "run"})
+	}
+	wg.Wait()
+	if len(holders) != 1 {
+		t.Errorf("%d runs hold the lock, want 1", len(holders))
+	}
+	for _, l := range holders {
+		l.release()
+	}
+}
+
+func TestRunLockSkipExitCode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	held := &fileLock{path: path, holder: "cron-a/1"}
+	if _, ok, err := held.tryAcquire(); err != nil || !ok {
+		t.Fatalf("could not take the lock: %v", err)
+	}
+	defer held.release()
+	setFlag(t, lockFile, path)
+
+	ran := false
+	fn := func() error { ran = true; return nil }
+	if err := withRunLock(fn); err != nil {
+		t.Errorf("skipped run without -lock-skip-exit-code returned %v", err)
+	}
+	*lockSkipExitCode = 3
+	t.Cleanup(func() { *lockSkipExitCode = 0 })
+	if err := withRunLock(fn); err != errRunSkipped {
+		t.Errorf("skipped run with -lock-skip-exit-code returned %v, want errRunSkipped", err)
+	}
+	if ran {
+		t.Errorf("run went ahead while the lock was held")
+	}
+}
+
+// standInLease puts a kubectl on PATH that serves the lease in dir/lease, if any, and records what is
+// created or replaced in dir/written. While dir/race exists, writes fail as if another run got there first.
+func standInLease(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	standInKubectl(t, `dir=`+dir+`
+case "$1" in
+get)
+	[ -f "$dir/lease" ] || { echo 'Error from server (NotFound): leases.coordination.k8s.io "run" not found' >&2; exit 1; }
+	cat "$dir/lease" ;;
+create)
+	[ -f "$dir/race" ] && { echo 'Error from server (AlreadyExists): leases.coordination.k8s.io "run" already exists' >&2; exit 1; }
+	cat > "$dir/written" ;;
+replace)
+	[ -f "$dir/race" ] && { echo 'Error from server (Conflict): Operation cannot be fulfilled on leases.coordination.k8s.io "run": the object has been modified; please apply your changes to the latest version and try again' >&2; exit 1; }
+	cat > "$dir/written" ;;
+esac
+`)
+	return dir
+}
+
+// writeLease stores a lease held by holder, last renewed at renewed.
+func writeLease(t *testing.T, dir, holder string, renewed time.Time, seconds int) {
+	t.Helper()
+	le := lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	le.Metadata.Name, le.Metadata.Namespace, le.Metadata.ResourceVersion = "run", "fpms", "41"
+	renew := renewed.UTC().Format(microTime)
+	transitions := 2
+	le.Spec.HolderIdentity, le.Spec.RenewTime, le.Spec.AcquireTime = &holder, &renew, &renew
+	le.Spec.LeaseDurationSeconds, le.Spec.LeaseTransitions = &seconds, &transitions
+	data, _ := json.Marshal(le)
+	if err := os.WriteFile(filepath.Join(dir, "lease"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaseLockTakeover(t *testing.T) {
+	dir := standInLease(t)
+	setFlag(t, lockStale, 10*time.Minute)
+	l := &leaseLock{namespace: "fpms", name: "run", holder: "cronjob-b/1"}
+
+	// A lease renewed within its duration stays with its holder
+	writeLease(t, dir, "cronjob-a/1", time.Now().Add(-30*time.Second), 60)
+	holder, ok, err := l.tryAcquire()
+	if err != nil || ok || !strings.HasPrefix(holder, "cronjob-a/1, renewed ") {
+		t.Fatalf("fresh lease: holder %q, ok %v, error %v", holder, ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "written")); err == nil {
+		t.Errorf("fresh lease was written")
+	}
+
+	// Past the duration its holder set, the lease is taken over
+	writeLease(t, dir, "cronjob-a/1", time.Now().Add(-2*time.Minute), 60)
+	if _, ok, err := l.tryAcquire(); err != nil || !ok {
+		t.Fatalf("stale lease not taken over: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "written"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var le lease
+	if err := json.Unmarshal(data, &le); err != nil {
+		t.Fatal(err)
+	}
+	// The replace carries the resourceVersion it read, which is what makes racing takeovers safe
+	if le.Metadata.ResourceVersion != "41" || *le.Spec.HolderIdentity != "cronjob-b/1" || *le.Spec.LeaseTransitions != 3 || *le.Spec.LeaseDurationSeconds != 600 {
+		t.Errorf("written lease = %s", data)
+	}
+}
+
+func TestLeaseLockLostRace(t *testing.T) {
+	dir := standInLease(t)
+	os.WriteFile(filepath.Join(dir, "race"), nil, 0o644)
+	l := &leaseLock{namespace: "fpms", name: "run", holder: "cronjob-b/1"}
+
+	// Both runs found no lease and the other created it first
+	if holder, ok, err := l.tryAcquire(); err != nil || ok || holder != "a run that just created it" {
+		t.Errorf("lost create: holder %q, ok %v, error %v", holder, ok, err)
+	}
+	// Both runs found a stale lease and the other replaced it first
+	writeLease(t, dir, "cronjob-a/1", time.Now().Add(-time.Hour), 60)
+	if holder, ok, err := l.tryAcquire(); err != nil || ok || holder != "a run that took it first" {
+		t.Errorf("lost takeover: holder %q, ok %v, error %v", holder, ok, err)
+	}
+}
+
+func TestRunLockStaleValidated(t *testing.T) {
+	setFlag(t, lockLease, "fpms/run")
+	for _, stale := range []time.Duration{0, 2 * time.Nanosecond, -time.Minute, 999 * time.Millisecond} {
+		setFlag(t, lockStale, stale)
+		if err := withRunLock(func() error { return nil }); err == nil || !strings.Contains(err.Error(), "-lock-stale") {
+			t.Errorf("-lock-stale %v: got error %v", stale, err)
+		}
+	}
+}
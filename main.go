@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	mrand "math/rand/v2"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +23,6 @@ import (
 const (
 	namespace               = "fpms"
 	containerName           = "client-apiserver-canary"
-	targetPort              = "9280"
 	pushGateway             = "http://k8s-monitori-pushgate-fcae943c1e-e1a58b32cb8c6cce.elb.ap-southeast-1.amazonaws.com/metrics/job/client_tcp_new"
 	maxConcurrentConnections = 100 // Set your desired concurrency level
 	clusterName             = "fpms-prod" // Your EKS cluster name
@@ -30,8 +33,28 @@ var (
 	podRegex   = regexp.MustCompile(`\bclient\b`)
 	tokenCache *TokenResponse
 	cacheMutex sync.Mutex
+
+	fileSDPath = flag.String("file-sd", "", "Prometheus file_sd JSON/YAML file (or glob) to use as the discovery source instead of kubectl")
+	fileSDOut  = flag.String("file-sd-out", "", "Write the discovered pods to this path as a Prometheus file_sd JSON/YAML file")
+	interval   = flag.Duration("interval", 0, "Repeat the collection at this interval instead of running once")
+	listenAddr = flag.String("listen", "", "Serve the HTTP API on this address (e.g. :8080)")
+	targetPort = flag.String("target-port", "9280", "Count connections with this port on either end")
+
+	commandTimeout = flag.Duration("command-timeout", 2*time.Minute, "Kill kubectl, aws and ssh commands that take longer than this")
+	retries        = flag.Int("retries", 0, "Retry a failed discovery, token fetch or pod collection this many times (default: no retries)")
+	retryBackoff   = flag.Duration("retry-backoff", time.Second, "Wait about this long before the first retry, twice as long before each further one")
 )
 
+// Target is a single pod to count connections in, along with the labels it was discovered with.
+type Target struct {
+	Namespace string
+	Pod       string
+	IP        string
+	Labels    map[string]string
+	// How sockets are collected: empty for kubectl exec, or ssh or agent for EC2 instances
+	Backend string
+}
+
 // TokenResponse represents the structure of the response from the AWS EKS get-token command.
 type TokenResponse struct {
 	Token  string `json:"token"`
@@ -51,8 +74,8 @@ func getToken() (string, error) {
 
 	fmt.Println("Fetching new token.")
 	// If not cached or expired, get a new token
-	cmd := exec.Command("aws", "eks", "get-token", "--cluster-name", clusterName, "--output", "json")
-	output, err := cmd.Output()
+	cmd := awsCommand("eks", "get-token", "--cluster-name", clusterName, "--output", "json")
+	output, err := runCommand("token", cmd)
 	if err != nil {
 		return "", err
 	}
@@ -73,54 +96,176 @@ func getToken() (string, error) {
 }
 
 // Executes a kubectl command to get all client pods in Running state
-func getPods() ([]string, error) {
+func getPods() ([]Target, error) {
 	fmt.Println("Fetching running pods...")
-	cmd := exec.Command("kubectl", "get", "pods", "-n", namespace, "--field-selector=status.phase=Running")
-	out, err := cmd.Output()
+	cmd := kubectl("get", "pods", "-n", namespace, "--field-selector=status.phase=Running", "-o", "json")
+	out, err := runCommand("discovery", cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	var pods []string
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) > 0 && podRegex.MatchString(fields[0]) {
-			pods = append(pods, fields[0])
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string            `json:"name"`
+				Namespace string            `json:"namespace"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				NodeName string `json:"nodeName"`
+			} `json:"spec"`
+			Status struct {
+				PodIP string `json:"podIP"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse pod list: %v", err)
+	}
+
+	var pods []Target
+	var names []string
+	for _, item := range list.Items {
+		if !podRegex.MatchString(item.Metadata.Name) {
+			continue
+		}
+		labels := map[string]string{
+			"namespace": item.Metadata.Namespace,
+			"pod":       item.Metadata.Name,
+			"node":      item.Spec.NodeName,
+			"container": containerName,
 		}
+		for k, v := range item.Metadata.Labels {
+			labels["label_"+sanitizeLabelName(k)] = v
+		}
+		pods = append(pods, Target{
+			Namespace: item.Metadata.Namespace,
+			Pod:       item.Metadata.Name,
+			IP:        item.Status.PodIP,
+			Labels:    labels,
+		})
+		names = append(names, item.Metadata.Name)
 	}
 
-	fmt.Printf("Running pods found: %v\n", pods)
-	return pods, scanner.Err()
+	fmt.Printf("Running pods found: %v\n", names)
+	return pods, nil
 }
 
-// Counts TCP connections to the specified port in the specified pod's container
-func countTCPConnections(pod string, token string) (int, error) {
+// sanitizeLabelName turns an arbitrary Kubernetes label key into a valid Prometheus label name.
+func sanitizeLabelName(name string) string {
+	return invalidLabelChars.ReplaceAllString(name, "_")
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// discoverTargets returns the pods to collect from, from kubectl or the file_sd source when configured,
+// along with the EC2 instances when EC2 discovery is on.
+func discoverTargets() ([]Target, error) {
+	var targets []Target
+	var err error
+	if *fileSDPath != "" {
+		targets, err = fileSD.Targets()
+	} else {
+		targets, err = getPods()
+	}
+	if !ec2Enabled() {
+		return targets, err
+	}
+	instances, ec2Err := ec2Instances()
+	return append(targets, instances...), errors.Join(err, ec2Err)
+}
+
+// Lists the TCP sockets in the specified pod's container
+func getSockets(t Target, token string) ([]Socket, error) {
+	switch t.Backend {
+	case backendSSH:
+		return sshSockets(t)
+	case backendAgent:
+		return agentSockets(t)
+	}
+
+	pod := t.Pod
 	// Prepare kubectl command with the required token
-	cmd := exec.Command("kubectl", "exec", "-n", namespace, pod, "--", "sh", "-c", fmt.Sprintf(`
+	script := `
 		if ! which netstat > /dev/null; then
 			apt-get update > /dev/null && apt-get install -y net-tools > /dev/null
 		fi
-		netstat -tn | grep ESTABLISHED | grep ":%s " | wc -l`, targetPort))
+		netstat -tn`
+	parse, header := parseNetstat, "Proto"
+	if *collectTCPInfo {
+		// netstat has no TCP_INFO, ss does
+		script = `
+		if ! which ss > /dev/null; then
+			apt-get update > /dev/null && apt-get install -y iproute2 > /dev/null
+		fi
+		ss -tino`
+		parse, header = parseSS, "State"
+	}
+	cmd := kubectl("exec", "-n", t.Namespace, pod, "--", "sh", "-c", script)
 
 	// Set KUBECONFIG to use the token for authentication
-	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", token))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("KUBECONFIG=%s", token))
 
 	fmt.Printf("Counting TCP connections in pod: %s\n", pod)
-	out, err := cmd.Output()
+	out, err := runCommand("exec", cmd)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if err := checkSocketOutput(out, header); err != nil {
+		return nil, fmt.Errorf("invalid socket table from pod %s: %v", pod, err)
 	}
 
-	countStr := strings.TrimSpace(string(out))
-	count, err := strconv.Atoi(countStr)
+	sockets, err := parse(out)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse TCP connection count for pod %s: %v", pod, err)
+		return nil, fmt.Errorf("failed to parse sockets for pod %s: %v", pod, err)
 	}
+	return sockets, nil
+}
+
+// runCommand runs a command of a collector layer with the layer's -chaos faults, killing it after
+// -command-timeout. Like Output, it returns stdout and keeps stderr in the *exec.ExitError.
+func runCommand(layer string, cmd *exec.Cmd) ([]byte, error) {
+	name := filepath.Base(cmd.Path)
+	return chaosCommand(layer, cmd, func(cmd *exec.Cmd) ([]byte, error) {
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		timer := time.AfterFunc(*commandTimeout, func() { cmd.Process.Kill() })
+		err := cmd.Wait()
+		if !timer.Stop() {
+			return stdout.Bytes(), fmt.Errorf("%s timed out after %v", name, *commandTimeout)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitErr.Stderr = stderr.Bytes()
+		}
+		return stdout.Bytes(), err
+	})
+}
 
-	fmt.Printf("TCP connection count for pod %s: %d\n", pod, count)
-	return count, nil
+// withRetries runs fn, retrying it up to -retries times while it fails. The wait before each retry doubles,
+// with up to half again as much jitter so pods that failed together don't retry in lockstep.
+func withRetries(what string, fn func() error) error {
+	err := fn()
+	backoff := *retryBackoff
+	for attempt := 1; err != nil && attempt <= *retries; attempt++ {
+		wait := backoff + time.Duration(mrand.Int64N(int64(backoff)/2+1))
+		fmt.Printf("Retrying %s (attempt %d of %d) in %v after: %v\n", what, attempt, *retries, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// commandStderr is the stderr of a failed command, for error messages.
+func commandStderr(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
 }
 
 // Sends the total TCP connection count to the Push Gateway
@@ -128,7 +273,7 @@ func sendToPushGateway(totalTCPConnections int) error {
 	data := fmt.Sprintf("client_tcp_new %d\n", totalTCPConnections)
 	fmt.Printf("Sending total TCP connections to Push Gateway: %d\n", totalTCPConnections)
 
-	resp, err := http.Post(pushGateway, "text/plain", strings.NewReader(data))
+	resp, err := sinkClient.Post(pushGateway, "text/plain", strings.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -143,60 +288,373 @@ func sendToPushGateway(totalTCPConnections int) error {
 	return nil
 }
 
-// Main execution with controlled concurrency using a worker pool
+// Main execution: a single run, or one run per interval in daemon mode, optionally serving the HTTP API
 func main() {
-	startTime := time.Now()
+	flag.Parse()
+
+	if *fileSDPath != "" {
+		fileSD = newFileSDSource(*fileSDPath)
+	}
+	if _, err := parsePort(*targetPort); err != nil {
+		fmt.Printf("Error: invalid -target-port: %v\n", err)
+		os.Exit(2)
+	}
+	if *distinctBy != "ip" && *distinctBy != "ip-port" {
+		fmt.Printf("Error: -distinct-by must be ip or ip-port\n")
+		os.Exit(2)
+	}
+	if *routesPath != "" {
+		var err error
+		if routing, err = loadRoutes(*routesPath); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(2)
+		}
+		// Route sinks can have their own privacy mode
+		for name := range routing.Sinks {
+			privacyOutputs[name] = true
+		}
+	}
+	if err := setupPrivacy(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	if !offline(flag.Args()) {
+		if err := setupProxy(clusterName); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		defer closeProxy()
+	}
+	// After the proxy, so faults wrap the proxied sink transport
+	if err := setupChaos(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		exit(2)
+	}
+
+	// Commands follow the global flags, e.g. "-top-peers 20 analyze dump.txt"
+	switch flag.Arg(0) {
+	case "":
+	case "analyze":
+		if err := runAnalyze(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "local":
+		if err := runLocal(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "sidecar":
+		if err := runSidecar(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "webhook":
+		if err := runWebhook(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "routes":
+		if err := runRoutes(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "capture":
+		if err := runCapture(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	case "explain":
+		if err := runExplain(flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	default:
+		fmt.Printf("Unknown command %q\n", flag.Arg(0))
+		exit(2)
+	}
+
+	if *aggregatorMode {
+		if err := runAggregator(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if *listenAddr != "" {
+		go serve(*listenAddr)
+	}
+	if *kedaListenAddr != "" {
+		go serveKEDA(*kedaListenAddr)
+	}
+	if (*listenAddr != "" || *kedaListenAddr != "") && *interval <= 0 {
+		// Serve only, collecting on demand
+		select {}
+	}
+
+	if *interval <= 0 {
+		if err := withRunLock(run); err == errRunSkipped {
+			exit(*lockSkipExitCode)
+		} else if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("Running every %v\n", *interval)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := run(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+// offline reports whether a command only reads local files, so it needs no proxy or tunnel to the cluster:
+// analyze, routes and explain -file.
+func offline(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "analyze", "routes":
+		return true
+	case "explain":
+		for _, arg := range args[1:] {
+			name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			if strings.HasPrefix(arg, "-") && name == "file" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exit closes the proxy tunnel, which the deferred close would miss, and exits.
+func exit(code int) {
+	closeProxy()
+	os.Exit(code)
+}
+
+// PodResult is the outcome of counting connections in a single pod.
+type PodResult struct {
+	Target Target
+	// Established connections on the target port
+	Count int
+	// Target port sockets in each state
+	States  map[string]int
+	Sockets []Socket
+	// Distribution of TCP_INFO over the established connections, when collected
+	TCPInfo *tcpInfoStats
+	// Sketch of the distinct clients connected to the pod
+	Clients *hll
+	// Condition of the pod in the -service EndpointSlices, when checked
+	Endpoint string
+	Err      error
+}
+
+// Report is the outcome of a single collection run.
+type Report struct {
+	// Random ID that identifies the run across uploads and sinks
+	RunID    string
+	Start    time.Time
+	Duration time.Duration
+	Pods     []PodResult
+	Total    int
+	Findings []Finding
+	// Why the run was skipped without collecting, e.g. another run holding the run lock
+	Skipped string
+}
+
+// newRunID returns a random 128-bit run ID in hex.
+func newRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// A single collection run. Collection errors are logged; the returned error is for failed checks only.
+func run() error {
+	report, err := collect()
+	if err != nil {
+		fmt.Printf("Collection failed: %v\n", err)
+		return nil
+	}
+	return process(report)
+}
+
+// Analyzes, reports and ships a collected report. Live runs and offline analysis both end here.
+func process(report *Report) error {
+	// A skipped run only reports that it was skipped, rather than totals competing with the running one
+	if report.Skipped != "" {
+		fmt.Printf("Run skipped: %s\n", report.Skipped)
+		if routing != nil {
+			routeReport(report)
+		}
+		if *cloudWatchNamespace != "" {
+			if err := sendToCloudWatch(report); err != nil {
+				fmt.Printf("Error sending to CloudWatch: %v\n", err)
+			}
+		}
+		return nil
+	}
+
+	// Daemon mode keeps history and looks for trends in it
+	if *interval > 0 {
+		history.record(report)
+		report.Findings = append(report.Findings, detectLeaks()...)
+	}
+	if *serviceName != "" {
+		findings, err := checkEndpoints(report, *serviceName)
+		if err != nil {
+			fmt.Printf("Error checking endpoints: %v\n", err)
+		}
+		report.Findings = append(report.Findings, findings...)
+	}
+	setLatestReport(report)
+
+	printReport(report)
+	fmt.Printf("Total TCP connections counted: %d\n", report.Total)
+	fmt.Printf("Completed in: %v\n", report.Duration)
+
+	//if err := sendToPushGateway(report.Total); err != nil {
+	//	fmt.Printf("Error sending to Push Gateway: %v\n", err)
+	//} else {
+	//	fmt.Println("Successfully sent to Push Gateway.")
+	//}
+
+	if routing != nil {
+		routeReport(report)
+	}
+
+	if *aggregatorURL != "" {
+		if err := uploadReport(summarize(report, sinkAggregator)); err != nil {
+			fmt.Printf("Error uploading to aggregator: %v\n", err)
+		}
+	}
+
+	if *cloudWatchNamespace != "" {
+		if err := sendToCloudWatch(report); err != nil {
+			fmt.Printf("Error sending to CloudWatch: %v\n", err)
+		}
+	}
+
+	if *configMapName != "" {
+		if err := writeConfigMap(report); err != nil {
+			fmt.Printf("Error writing ConfigMap: %v\n", err)
+		}
+	}
+
+	printFindings(report.Findings)
+	if *chaosSpec != "" {
+		printChaos()
+	}
+	if *alertmanagerURL != "" {
+		if err := sendAlerts(report.Findings); err != nil {
+			fmt.Printf("Error sending alerts: %v\n", err)
+		}
+	}
+
+	if canaryEnabled() {
+		return checkCanarySplit(report)
+	}
+	return nil
+}
+
+// Collects TCP connection counts from all discovered pods
+func collect() (*Report, error) {
 	fmt.Println("Starting TCP connection counting...")
 
-	pods, err := getPods()
+	var pods []Target
+	err := withRetries("discovery", func() (err error) {
+		pods, err = discoverTargets()
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Error fetching pods: %v\n", err)
-		return
+		return nil, err
 	}
 
-	var totalTCPConnections int
-	var mu sync.Mutex
+	if *fileSDOut != "" {
+		if err := writeFileSD(*fileSDOut, pods); err != nil {
+			fmt.Printf("Error writing file_sd targets: %v\n", err)
+		}
+	}
+
+	return collectTargets(pods)
+}
+
+// Collects TCP connection counts from the given pods with controlled concurrency using a worker pool
+func collectTargets(pods []Target) (*Report, error) {
+	startTime := time.Now()
+
 	var wg sync.WaitGroup
 	workers := make(chan struct{}, maxConcurrentConnections) // Create a worker pool
+	results := make([]PodResult, len(pods))
 
-	// Fetch the token once and reuse it
-	token, err := getToken()
-	if err != nil {
-		fmt.Printf("Error fetching token: %v\n", err)
-		return
+	// Fetch the token once and reuse it, if any target is a pod
+	var token string
+	for _, p := range pods {
+		if p.Backend != "" {
+			continue
+		}
+		err := withRetries("token fetch", func() (err error) {
+			token, err = getToken()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching token: %v", err)
+		}
+		break
 	}
 
-	for _, pod := range pods {
+	for i, pod := range pods {
 		wg.Add(1)
 
 		// Acquire a worker slot by sending an empty struct to the channel
 		workers <- struct{}{}
 
-		go func(p string) {
+		go func(i int, p Target) {
 			defer wg.Done()
 			defer func() { <-workers }() // Release the worker slot
 
-			tcpCount, err := countTCPConnections(p, token) // Pass the token here
+			var sockets []Socket
+			err := withRetries("pod "+p.Pod, func() (err error) {
+				sockets, err = getSockets(p, token) // Pass the token here
+				return err
+			})
 			if err != nil {
-				fmt.Printf("Failed to get TCP count for pod %s: %v\n", p, err)
+				fmt.Printf("Failed to get TCP count for pod %s: %v\n", p.Pod, err)
+				results[i] = PodResult{Target: p, Err: err}
 				return
 			}
 
-			mu.Lock()
-			totalTCPConnections += tcpCount
-			mu.Unlock()
-		}(pod)
+			// Each goroutine owns its own slot, so no locking is needed
+			results[i] = newPodResult(p, sockets)
+			fmt.Printf("TCP connection count for pod %s: %d\n", p.Pod, results[i].Count)
+		}(i, pod)
 	}
 
 	// Wait for all goroutines to complete
 	wg.Wait()
 
-	fmt.Printf("Total TCP connections counted: %d\n", totalTCPConnections)
-	fmt.Printf("Completed in: %v\n", time.Since(startTime))
-
-	//if err := sendToPushGateway(totalTCPConnections); err != nil {
-	//	fmt.Printf("Error sending to Push Gateway: %v\n", err)
-	//} else {
-	//	fmt.Println("Successfully sent to Push Gateway.")
-	//}
+	report := &Report{RunID: newRunID(), Start: startTime, Pods: results}
+	for _, r := range results {
+		report.Total += r.Count
+	}
+	report.Duration = time.Since(startTime)
+	return report, nil
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportSummary is the compact, serializable form of a report: counts without the individual sockets.
+// It is what collectors upload to the aggregator and what /metrics is rendered from.
+type reportSummary struct {
+	RunID     string       `json:"runId"`
+	Collector string       `json:"collector,omitempty"`
+	Cluster   string       `json:"cluster,omitempty"`
+	Start     time.Time    `json:"start"`
+	Duration  float64      `json:"durationSeconds"`
+	Total     int          `json:"total"`
+	Pods      []podSummary `json:"pods"`
+	// Busiest peers, anonymized for the output the summary is made for
+	Peers    []peerStat `json:"peers,omitempty"`
+	Findings []Finding  `json:"findings,omitempty"`
+}
+
+type podSummary struct {
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Count     int               `json:"count"`
+	States    map[string]int    `json:"states,omitempty"`
+	TCPInfo   *tcpInfoStats     `json:"tcpInfo,omitempty"`
+	Clients   *hll              `json:"clients,omitempty"`
+	Endpoint  string            `json:"endpoint,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// summarize turns a report into its summary for an output, which decides how peers are anonymized.
+func summarize(r *Report, sink string) reportSummary {
+	s := reportSummary{
+		RunID:    r.RunID,
+		Cluster:  clusterName,
+		Start:    r.Start,
+		Duration: r.Duration.Seconds(),
+		Total:    r.Total,
+		Findings: r.Findings,
+	}
+	for _, p := range r.Pods {
+		ps := podSummary{
+			Namespace: p.Target.Namespace,
+			Pod:       p.Target.Pod,
+			Labels:    p.Target.Labels,
+			Count:     p.Count,
+			States:    p.States,
+			TCPInfo:   p.TCPInfo,
+			Clients:   p.Clients,
+			Endpoint:  p.Endpoint,
+		}
+		if p.Err != nil {
+			ps.Error = p.Err.Error()
+		}
+		s.Pods = append(s.Pods, ps)
+	}
+	if peers := aggregatePeers(r.Pods, anonymizerFor(sink)); len(peers) > 0 {
+		s.Peers = peers[:max(0, min(*topPeers, len(peers)))]
+	}
+	return s
+}
+
+// metricSample is one series and its value.
+type metricSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// metricWriter collects samples grouped by metric and writes them in the Prometheus text format.
+type metricWriter struct {
+	order    []string
+	help     map[string]string
+	families map[string][]metricSample
+}
+
+func newMetricWriter() *metricWriter {
+	return &metricWriter{help: make(map[string]string), families: make(map[string][]metricSample)}
+}
+
+func (m *metricWriter) add(name, help string, labels map[string]string, v float64) {
+	if _, ok := m.help[name]; !ok {
+		m.order = append(m.order, name)
+		m.help[name] = help
+	}
+	m.families[name] = append(m.families[name], metricSample{Name: name, Labels: labels, Value: v})
+}
+
+func (m *metricWriter) writeTo(w io.Writer) {
+	for _, name := range m.order {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help[name])
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, s := range m.families[name] {
+			fmt.Fprintln(w, formatSeries(name, s.Labels)+" "+strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+	}
+}
+
+// samples returns every sample in the order they were added, metric by metric.
+func (m *metricWriter) samples() []metricSample {
+	var all []metricSample
+	for _, name := range m.order {
+		all = append(all, m.families[name]...)
+	}
+	return all
+}
+
+// addSummary adds the metrics of one report, with extra labels (e.g. the collector) on every series.
+func (m *metricWriter) addSummary(s reportSummary, extra map[string]string) {
+	m.add(metricTotal, "Established TCP connections to the target port across all pods.", extra, float64(s.Total))
+	for _, p := range s.Pods {
+		labels := withLabel(withLabel(extra, "namespace", p.Namespace), "pod", p.Pod)
+		up := 1.0
+		if p.Error != "" {
+			up = 0
+		}
+		m.add("client_tcp_pod_up", "Whether the last collection from the pod succeeded.", labels, up)
+		if p.Error != "" {
+			continue
+		}
+		m.add(metricPodConns, "Established TCP connections to the target port in the pod.", labels, float64(p.Count))
+		if p.Endpoint != "" {
+			ready := 0.0
+			if p.Endpoint == endpointReady {
+				ready = 1
+			}
+			m.add("client_tcp_pod_endpoint_ready", "Whether the pod is a ready endpoint of the -service Service.", withLabel(labels, "endpoint", p.Endpoint), ready)
+		}
+
+		states := make([]string, 0, len(p.States))
+		for state := range p.States {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			m.add(metricPodSockets, "TCP sockets on the target port in the pod, by state.", withLabel(labels, "state", state), float64(p.States[state]))
+		}
+		if p.TCPInfo != nil {
+			m.addTCPInfo(p.TCPInfo, labels)
+		}
+		if p.Clients != nil {
+			m.add("client_tcp_pod_distinct_clients", "Estimated distinct clients connected to the pod.", labels, p.Clients.estimate())
+		}
+	}
+	m.addDistinct(s.Pods, extra)
+
+	findings := make(map[string]int)
+	for _, f := range s.Findings {
+		findings[f.Kind+"/"+f.Severity]++
+	}
+	keys := make([]string, 0, len(findings))
+	for k := range findings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kind, severity, _ := strings.Cut(k, "/")
+		m.add("client_tcp_findings", "Findings of the last run, by kind and severity.", withLabel(withLabel(extra, "kind", kind), "severity", severity), float64(findings[k]))
+	}
+}
+
+// addTCPInfo adds a pod's RTT and retransmit distributions and idle connection count.
+func (m *metricWriter) addTCPInfo(t *tcpInfoStats, labels map[string]string) {
+	for _, q := range []struct {
+		quantile string
+		v        float64
+	}{{"0.5", t.RTTP50}, {"0.9", t.RTTP90}, {"0.99", t.RTTP99}, {"1", t.RTTMax}} {
+		m.add("client_tcp_pod_rtt_seconds", "Smoothed RTT of established target port connections in the pod, by quantile.", withLabel(labels, "quantile", q.quantile), q.v)
+	}
+	m.add("client_tcp_pod_retrans_connections", "Established target port connections in the pod that have retransmitted.", labels, float64(t.RetransConnections))
+	m.add("client_tcp_pod_retrans", "Retransmitted segments summed over the pod's established target port connections.", labels, float64(t.TotalRetrans))
+	m.add("client_tcp_pod_retrans_per_connection", "Retransmitted segments per established target port connection in the pod, by quantile.", withLabel(labels, "quantile", "0.99"), float64(t.RetransP99))
+	m.add("client_tcp_pod_cwnd_mean", "Mean congestion window of the pod's established target port connections, in segments.", labels, t.MeanCwnd)
+	m.add("client_tcp_pod_idle_connections", "Established target port connections in the pod with no traffic for -idle-after.", labels, float64(t.Idle))
+	for _, a := range []struct {
+		activity string
+		n        int
+	}{{activityActive, t.Connections - t.Idle}, {activityIdle, t.Idle - t.IdleNoKeepalive}, {activityIdleNoKeepalive, t.IdleNoKeepalive}} {
+		m.add("client_tcp_pod_connections_by_activity", "Established target port connections in the pod: active, idle with a keepalive timer, or idle without one.", withLabel(labels, "activity", a.activity), float64(a.n))
+	}
+	if t.Idle > 0 {
+		for _, q := range []struct {
+			quantile string
+			v        float64
+		}{{"0.5", t.IdleP50}, {"0.9", t.IdleP90}, {"1", t.IdleMax}} {
+			m.add("client_tcp_pod_idle_seconds", "How long the pod's idle target port connections have had no traffic, by quantile.", withLabel(labels, "quantile", q.quantile), q.v)
+		}
+	}
+}
+
+// addDistinct adds the distinct client estimates of the whole report and of each namespace, merged from
+// the pod sketches.
+func (m *metricWriter) addDistinct(pods []podSummary, extra map[string]string) {
+	var all []*hll
+	byNamespace := make(map[string][]*hll)
+	for _, p := range pods {
+		all = append(all, p.Clients)
+		byNamespace[p.Namespace] = append(byNamespace[p.Namespace], p.Clients)
+	}
+	merged := mergeSketches(all...)
+	if merged == nil {
+		return
+	}
+	m.add("client_tcp_distinct_clients", "Estimated distinct clients across all pods.", extra, merged.estimate())
+	m.add("client_tcp_distinct_clients_error_ratio", "Standard error of the distinct client estimates, relative to the estimate.", extra, merged.relativeError())
+
+	namespaces := make([]string, 0, len(byNamespace))
+	for ns := range byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		if h := mergeSketches(byNamespace[ns]...); h != nil {
+			m.add("client_tcp_namespace_distinct_clients", "Estimated distinct clients across the pods of a namespace.", withLabel(extra, "namespace", ns), h.estimate())
+		}
+	}
+}
+
+// handleMetrics exposes the latest report, or the merged fleet in aggregator mode.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := newMetricWriter()
+	if *aggregatorMode {
+		fleet.addMetrics(m)
+	} else if report := latestReport(); report != nil {
+		m.addSummary(summarize(report, sinkAPI), nil)
+	}
+	if *chaosSpec != "" {
+		m.addChaos()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatSeries renders a metric and label set in the text format, e.g. `client_tcp_new{cluster="fpms-prod"}`.
+func formatSeries(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[k]))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
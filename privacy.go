@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var (
+	privacyMode       = flag.String("privacy", "none", "How peer IPs appear in reports, APIs and sinks: none, truncate (to -privacy-ipv4-prefix/-privacy-ipv6-prefix), hmac (keyed pseudonym, stable across runs) or redact")
+	privacySinks      = flag.String("privacy-sinks", "", `Per-output overrides of -privacy, e.g. "aggregator=redact,report=truncate"; outputs are report, api, aggregator and the sinks of -routes`)
+	privacyIPv4Prefix = flag.Int("privacy-ipv4-prefix", 24, "Prefix length IPv4 peers are truncated to in truncate mode")
+	privacyIPv6Prefix = flag.Int("privacy-ipv6-prefix", 48, "Prefix length IPv6 peers are truncated to in truncate mode")
+	privacyKeyFile    = flag.String("privacy-key-file", "", "File holding the secret key for hmac mode; keep it the same to keep pseudonyms stable")
+)
+
+// Outputs that carry peer IPs, for -privacy-sinks
+const (
+	sinkReport     = "report"
+	sinkAPI        = "api"
+	sinkAggregator = "aggregator"
+)
+
+var (
+	privacyModes   = map[string]bool{"none": true, "truncate": true, "hmac": true, "redact": true}
+	privacyOutputs = map[string]bool{sinkReport: true, sinkAPI: true, sinkAggregator: true}
+)
+
+var (
+	// sinkPrivacy is the mode of each output with an override
+	sinkPrivacy = make(map[string]string)
+	privacyKey  []byte
+)
+
+// setupPrivacy validates the privacy flags and loads the HMAC key if any output needs it.
+func setupPrivacy() error {
+	if !privacyModes[*privacyMode] {
+		return fmt.Errorf("unknown privacy mode %q", *privacyMode)
+	}
+	needKey := *privacyMode == "hmac"
+	for _, entry := range strings.Split(*privacySinks, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		sink, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !privacyModes[mode] {
+			return fmt.Errorf("invalid -privacy-sinks entry %q", entry)
+		}
+		if !privacyOutputs[sink] {
+			return fmt.Errorf("unknown output %q in -privacy-sinks", sink)
+		}
+		sinkPrivacy[sink] = mode
+		needKey = needKey || mode == "hmac"
+	}
+	if *privacyIPv4Prefix < 0 || *privacyIPv4Prefix > 32 || *privacyIPv6Prefix < 0 || *privacyIPv6Prefix > 128 {
+		return fmt.Errorf("invalid privacy prefix length")
+	}
+
+	if !needKey {
+		return nil
+	}
+	if *privacyKeyFile == "" {
+		return fmt.Errorf("hmac privacy mode needs -privacy-key-file")
+	}
+	data, err := os.ReadFile(*privacyKeyFile)
+	if err != nil {
+		return err
+	}
+	if privacyKey = bytes.TrimSpace(data); len(privacyKey) == 0 {
+		return fmt.Errorf("privacy key file %s is empty", *privacyKeyFile)
+	}
+	return nil
+}
+
+// privacyEnabled reports whether any output anonymizes peers.
+func privacyEnabled() bool {
+	if *privacyMode != "none" {
+		return true
+	}
+	for _, mode := range sinkPrivacy {
+		if mode != "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// anonymizer renders peer addresses for one output.
+type anonymizer string
+
+// anonymizerFor returns the anonymizer of an output: its override, or else the -privacy mode.
+func anonymizerFor(sink string) anonymizer {
+	if mode, ok := sinkPrivacy[sink]; ok {
+		return anonymizer(mode)
+	}
+	return anonymizer(*privacyMode)
+}
+
+// addr renders a peer address. Addresses that anonymize the same, such as peers in one truncated
+// prefix, are meant to be aggregated together.
+func (a anonymizer) addr(addr netip.Addr) string {
+	switch a {
+	case "truncate":
+		bits := *privacyIPv4Prefix
+		if addr.Is6() {
+			bits = *privacyIPv6Prefix
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return "redacted"
+		}
+		return prefix.String()
+	case "hmac":
+		mac := hmac.New(sha256.New, privacyKey)
+		mac.Write(addr.AsSlice())
+		return "peer-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	case "redact":
+		return "redacted"
+	default:
+		return addr.String()
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// resetPrivacy restores the -privacy-sinks overrides and the HMAC key when the test ends.
+func resetPrivacy(t *testing.T) {
+	t.Helper()
+	savedSinks, savedKey := sinkPrivacy, privacyKey
+	sinkPrivacy = make(map[string]string)
+	t.Cleanup(func() { sinkPrivacy, privacyKey = savedSinks, savedKey })
+}
+
+func TestAnonymizerModes(t *testing.T) {
+	resetPrivacy(t)
+	privacyKey = []byte("test-key")
+	v4, v6 := netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8:1:2::3")
+
+	tests := []struct {
+		mode   anonymizer
+		v4, v6 string
+	}{
+		{"none", "10.1.2.3", "2001:db8:1:2::3"},
+		{"truncate", "10.1.2.0/24", "2001:db8:1::/48"},
+		{"redact", "redacted", "redacted"},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.addr(v4); got != tt.v4 {
+			t.Errorf("%s: %s renders as %q, want %q", tt.mode, v4, got, tt.v4)
+		}
+		if got := tt.mode.addr(v6); got != tt.v6 {
+			t.Errorf("%s: %s renders as %q, want %q", tt.mode, v6, got, tt.v6)
+		}
+	}
+
+	setFlag(t, privacyIPv4Prefix, 16)
+	if got := anonymizer("truncate").addr(v4); got != "10.1.0.0/16" {
+		t.Errorf("truncate to /16: %q", got)
+	}
+
+	// Pseudonyms are stable for an address and key, and differ between addresses and keys
+	hmacMode := anonymizer("hmac")
+	pseudonym := hmacMode.addr(v4)
+	if !regexp.MustCompile(`^peer-[0-9a-f]{16}$`).MatchString(pseudonym) || hmacMode.addr(v4) != pseudonym {
+		t.Errorf("hmac pseudonym %q is malformed or unstable", pseudonym)
+	}
+	if hmacMode.addr(netip.MustParseAddr("10.1.2.4")) == pseudonym {
+		t.Errorf("two addresses share the pseudonym %q", pseudonym)
+	}
+	privacyKey = []byte("other-key")
+	if hmacMode.addr(v4) == pseudonym {
+		t.Errorf("pseudonym %q does not depend on the key", pseudonym)
+	}
+}
+
+func TestSummaryPeersPerOutput(t *testing.T) {
+	resetPrivacy(t)
+	setFlag(t, privacyMode, "truncate")
+	sinkPrivacy[sinkAggregator] = "redact"
+	sinkPrivacy[sinkAPI] = "none"
+
+	local := netip.MustParseAddrPort("10.0.0.1:" + *targetPort)
+	r := &Report{Pods: []PodResult{
+		{Target: Target{Pod: "client-a-1"}, Sockets: []Socket{
+			{Local: local, Remote: netip.MustParseAddrPort("10.1.2.3:40000"), State: "ESTABLISHED"},
+			{Local: local, Remote: netip.MustParseAddrPort("10.1.2.4:40001"), State: "ESTABLISHED"},
+			{Local: local, Remote: netip.MustParseAddrPort("10.9.0.1:40002"), State: "ESTABLISHED"},
+		}},
+		{Target: Target{Pod: "client-a-2"}, Sockets: []Socket{
+			{Local: local, Remote: netip.MustParseAddrPort("10.1.2.3:40003"), State: "ESTABLISHED"},
+		}},
+	}}
+
+	tests := []struct {
+		sink  string
+		peers []peerStat
+	}{
+		{sinkReport, []peerStat{{"10.1.2.0/24", 3, 2}, {"10.9.0.0/24", 1, 1}}},
+		{sinkAPI, []peerStat{{"10.1.2.3", 2, 2}, {"10.1.2.4", 1, 1}, {"10.9.0.1", 1, 1}}},
+		{sinkAggregator, []peerStat{{"redacted", 4, 2}}},
+	}
+	for _, tt := range tests {
+		if got := summarize(r, tt.sink).Peers; !reflect.DeepEqual(got, tt.peers) {
+			t.Errorf("%s peers = %+v, want %+v", tt.sink, got, tt.peers)
+		}
+	}
+}
+
+func TestSetupPrivacy(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, emptyFile := filepath.Join(dir, "key"), filepath.Join(dir, "empty")
+	os.WriteFile(keyFile, []byte("secret\n"), 0o600)
+	os.WriteFile(emptyFile, []byte("\n"), 0o600)
+
+	tests := []struct {
+		mode, sinks, keyFile string
+		ok                   bool
+	}{
+		{"none", "", "", true},
+		{"truncate", "aggregator=redact, report=none", "", true},
+		{"none", "api=hmac", keyFile, true},
+		{"blur", "", "", false},
+		{"none", "api", "", false},
+		{"none", "api=blur", "", false},
+		{"none", "grafana=redact", "", false},
+		{"hmac", "", "", false},
+		{"none", "report=hmac", "", false},
+		{"hmac", "", emptyFile, false},
+		{"hmac", "", filepath.Join(dir, "missing"), false},
+	}
+	for _, tt := range tests {
+		resetPrivacy(t)
+		setFlag(t, privacyMode, tt.mode)
+		setFlag(t, privacySinks, tt.sinks)
+		setFlag(t, privacyKeyFile, tt.keyFile)
+		if err := setupPrivacy(); (err == nil) != tt.ok {
+			t.Errorf("-privacy %s -privacy-sinks %q: got error %v, want ok %v", tt.mode, tt.sinks, err, tt.ok)
+		}
+	}
+	resetPrivacy(t)
+	setFlag(t, privacyMode, "none")
+	setFlag(t, privacySinks, "api=hmac")
+	setFlag(t, privacyKeyFile, keyFile)
+	if err := setupPrivacy(); err != nil {
+		t.Fatal(err)
+	}
+	if string(privacyKey) != "secret" || anonymizerFor(sinkAPI) != "hmac" || anonymizerFor(sinkReport) != "none" {
+		t.Errorf("key %q, api %s, report %s after -privacy-sinks api=hmac", privacyKey, anonymizerFor(sinkAPI), anonymizerFor(sinkReport))
+	}
+
+	setFlag(t, privacyIPv4Prefix, 33)
+	setFlag(t, privacySinks, "")
+	setFlag(t, privacyMode, "truncate")
+	if err := setupPrivacy(); err == nil {
+		t.Errorf("accepted -privacy-ipv4-prefix 33")
+	}
+}
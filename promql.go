@@ -0,0 +1,864 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The query API implements the part of the Prometheus HTTP API Grafana uses, over the daemon mode history:
+// /api/v1/query, /api/v1/query_range, /api/v1/labels, /api/v1/label/<name>/values and /api/v1/series.
+// Queries are a PromQL subset:
+//
+//	client_tcp_pod_connections{namespace="fpms",pod=~"client-.*"}     selectors with =, !=, =~ and !~
+//	sum by (namespace) (client_tcp_pod_connections)                   sum, min, max, avg and count, by or without
+//	rate(client_tcp_new[5m]), max_over_time(client_tcp_new[1h])      rate, increase and min/max/avg_over_time
+//	sum(client_tcp_pod_connections) / 2                                arithmetic with scalars
+const (
+	// How far back an instant selector looks for a sample, as in Prometheus
+	promLookback = 5 * time.Minute
+	// Most points a range query may return per series
+	promMaxPoints = 11000
+)
+
+var promAggregations = map[string]bool{"sum": true, "min": true, "max": true, "avg": true, "count": true}
+var promRangeFunctions = map[string]bool{"rate": true, "increase": true, "max_over_time": true, "min_over_time": true, "avg_over_time": true}
+
+// promExpr is a parsed query.
+type promExpr interface {
+	eval(ev *promEvaluator, t time.Time) (promValue, error)
+}
+
+// promValue is a scalar, or an instant vector when scalar is nil.
+type promValue struct {
+	scalar *float64
+	vector []promSample
+}
+
+type promSample struct {
+	Labels map[string]string
+	V      float64
+}
+
+type promMatcher struct {
+	name, op, value string
+	re              *regexp.Regexp
+}
+
+func (m promMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+type promSelector struct {
+	matchers []promMatcher
+	// Range of a range selector, zero for an instant selector
+	rng time.Duration
+}
+
+type promNumber float64
+
+type promAggregation struct {
+	op      string
+	by      []string
+	without bool
+	expr    promExpr
+}
+
+type promCall struct {
+	fn  string
+	sel *promSelector
+}
+
+type promBinary struct {
+	op       byte
+	lhs, rhs promExpr
+}
+
+// promEvaluator evaluates queries over a snapshot of the history.
+type promEvaluator struct {
+	series []series
+}
+
+func newPromEvaluator(since time.Time) *promEvaluator {
+	return &promEvaluator{series: history.snapshot(since)}
+}
+
+// labelsOf is the labels of a series with its name as __name__.
+func labelsOf(s series) map[string]string {
+	return withLabel(s.Labels, "__name__", s.Name)
+}
+
+// withoutName returns a copy of labels without __name__.
+func withoutName(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != "__name__" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (sel *promSelector) selectSeries(ev *promEvaluator) []series {
+	var out []series
+	for _, s := range ev.series {
+		labels := labelsOf(s)
+		ok := true
+		for _, m := range sel.matchers {
+			if !m.matches(labels) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// samplesIn returns the samples in (from, to].
+func samplesIn(s series, from, to time.Time) []sample {
+	i := sort.Search(len(s.Samples), func(i int) bool { return s.Samples[i].T.After(from) })
+	j := sort.Search(len(s.Samples), func(i int) bool { return s.Samples[i].T.After(to) })
+	return s.Samples[i:j]
+}
+
+func (sel *promSelector) eval(ev *promEvaluator, t time.Time) (promValue, error) {
+	if sel.rng != 0 {
+		return promValue{}, fmt.Errorf("range selector must be the argument of a function")
+	}
+	var v promValue
+	for _, s := range sel.selectSeries(ev) {
+		samples := samplesIn(s, t.Add(-promLookback), t)
+		if len(samples) == 0 {
+			continue
+		}
+		v.vector = append(v.vector, promSample{Labels: labelsOf(s), V: samples[len(samples)-1].V})
+	}
+	return v, nil
+}
+
+func (n promNumber) eval(*promEvaluator, time.Time) (promValue, error) {
+	f := float64(n)
+	return promValue{scalar: &f}, nil
+}
+
+func (c *promCall) eval(ev *promEvaluator, t time.Time) (promValue, error) {
+	var v promValue
+	for _, s := range c.sel.selectSeries(ev) {
+		samples := samplesIn(s, t.Add(-c.sel.rng), t)
+		if len(samples) == 0 {
+			continue
+		}
+		var result float64
+		switch c.fn {
+		case "rate", "increase":
+			// Without extrapolation; a decrease is taken as a counter reset
+			if len(samples) < 2 {
+				continue
+			}
+			for i := 1; i < len(samples); i++ {
+				if d := samples[i].V - samples[i-1].V; d >= 0 {
+					result += d
+				} else {
+					result += samples[i].V
+				}
+			}
+			if c.fn == "rate" {
+				result /= samples[len(samples)-1].T.Sub(samples[0].T).Seconds()
+			}
+		case "max_over_time":
+			result = math.Inf(-1)
+			for _, smp := range samples {
+				result = math.Max(result, smp.V)
+			}
+		case "min_over_time":
+			result = math.Inf(1)
+			for _, smp := range samples {
+				result = math.Min(result, smp.V)
+			}
+		case "avg_over_time":
+			for _, smp := range samples {
+				result += smp.V
+			}
+			result /= float64(len(samples))
+		}
+		// Functions drop the metric name
+		v.vector = append(v.vector, promSample{Labels: withoutName(s.Labels), V: result})
+	}
+	return v, nil
+}
+
+func (a *promAggregation) eval(ev *promEvaluator, t time.Time) (promValue, error) {
+	in, err := a.expr.eval(ev, t)
+	if err != nil {
+		return promValue{}, err
+	}
+	if in.scalar != nil {
+		return promValue{}, fmt.Errorf("%s expects an instant vector", a.op)
+	}
+
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range in.vector {
+		labels := make(map[string]string)
+		if a.without {
+			labels = withoutName(s.Labels)
+			for _, l := range a.by {
+				delete(labels, l)
+			}
+		} else {
+			for _, l := range a.by {
+				if v, ok := s.Labels[l]; ok {
+					labels[l] = v
+				}
+			}
+		}
+		key := formatSeries("", labels)
+		g := groups[key]
+		if g == nil {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.V)
+	}
+
+	var out promValue
+	for _, key := range order {
+		g := groups[key]
+		var result float64
+		switch a.op {
+		case "sum", "avg":
+			for _, v := range g.values {
+				result += v
+			}
+			if a.op == "avg" {
+				result /= float64(len(g.values))
+			}
+		case "min":
+			result = math.Inf(1)
+			for _, v := range g.values {
+				result = math.Min(result, v)
+			}
+		case "max":
+			result = math.Inf(-1)
+			for _, v := range g.values {
+				result = math.Max(result, v)
+			}
+		case "count":
+			result = float64(len(g.values))
+		}
+		out.vector = append(out.vector, promSample{Labels: g.labels, V: result})
+	}
+	return out, nil
+}
+
+func (b *promBinary) eval(ev *promEvaluator, t time.Time) (promValue, error) {
+	lhs, err := b.lhs.eval(ev, t)
+	if err != nil {
+		return promValue{}, err
+	}
+	rhs, err := b.rhs.eval(ev, t)
+	if err != nil {
+		return promValue{}, err
+	}
+	apply := func(x, y float64) float64 {
+		switch b.op {
+		case '+':
+			return x + y
+		case '-':
+			return x - y
+		case '*':
+			return x * y
+		default:
+			return x / y
+		}
+	}
+
+	switch {
+	case lhs.scalar != nil && rhs.scalar != nil:
+		v := apply(*lhs.scalar, *rhs.scalar)
+		return promValue{scalar: &v}, nil
+	case lhs.scalar == nil && rhs.scalar == nil:
+		return promValue{}, fmt.Errorf("operations between two vectors are not supported")
+	}
+	var out promValue
+	vector, scalar := lhs.vector, rhs.scalar
+	if lhs.scalar != nil {
+		vector, scalar = rhs.vector, lhs.scalar
+	}
+	for _, s := range vector {
+		v := apply(s.V, *scalar)
+		if lhs.scalar != nil {
+			v = apply(*scalar, s.V)
+		}
+		out.vector = append(out.vector, promSample{Labels: withoutName(s.Labels), V: v})
+	}
+	return out, nil
+}
+
+// maxRange is the longest range a query looks back over, for snapshotting just enough history.
+func maxRange(e promExpr) time.Duration {
+	switch e := e.(type) {
+	case *promSelector:
+		return max(e.rng, promLookback)
+	case *promCall:
+		return max(e.sel.rng, promLookback)
+	case *promAggregation:
+		return maxRange(e.expr)
+	case *promBinary:
+		return max(maxRange(e.lhs), maxRange(e.rhs))
+	}
+	return promLookback
+}
+
+// promParser is a recursive descent parser for the PromQL subset.
+type promParser struct {
+	input string
+	pos   int
+}
+
+func parsePromQL(input string) (promExpr, error) {
+	p := &promParser{input: input}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+func (p *promParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *promParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *promParser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected %q at position %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func (p *promParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && isIdentChar(p.input[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// parseSum parses additions and subtractions of products.
+func (p *promParser) parseSum() (promExpr, error) {
+	lhs, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peek(); c == '+' || c == '-'; c = p.peek() {
+		p.pos++
+		rhs, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &promBinary{op: c, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *promParser) parseProduct() (promExpr, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peek(); c == '*' || c == '/'; c = p.peek() {
+		p.pos++
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &promBinary{op: c, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *promParser) parseTerm() (promExpr, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(')')
+	case c == '{':
+		return p.parseSelector("")
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return promNumber(f), nil
+	case isIdentChar(c, true):
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+
+	name := p.ident()
+	switch {
+	case promAggregations[name]:
+		return p.parseAggregation(name)
+	case promRangeFunctions[name]:
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		arg, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := arg.(*promSelector)
+		if !ok || sel.rng == 0 {
+			return nil, fmt.Errorf("%s expects a range selector such as metric[5m]", name)
+		}
+		return &promCall{fn: name, sel: sel}, p.expect(')')
+	}
+	return p.parseSelector(name)
+}
+
+func (p *promParser) parseAggregation(op string) (promExpr, error) {
+	a := &promAggregation{op: op}
+	grouping := func() error {
+		switch kw := p.peekIdent(); kw {
+		case "by", "without":
+			p.ident()
+			a.without = kw == "without"
+			labels, err := p.parseLabelList()
+			if err != nil {
+				return err
+			}
+			a.by = labels
+		}
+		return nil
+	}
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	a.expr = e
+	if a.by == nil && !a.without {
+		if err := grouping(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (p *promParser) peekIdent() string {
+	pos := p.pos
+	id := p.ident()
+	p.pos = pos
+	return id
+}
+
+func (p *promParser) parseLabelList() ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek() != ')' {
+		l := p.ident()
+		if l == "" {
+			return nil, fmt.Errorf("expected label name at position %d", p.pos)
+		}
+		labels = append(labels, l)
+		if p.peek() == ',' {
+			p.pos++
+		}
+	}
+	p.pos++
+	return labels, nil
+}
+
+func (p *promParser) parseSelector(name string) (promExpr, error) {
+	sel := &promSelector{}
+	if name != "" {
+		sel.matchers = append(sel.matchers, promMatcher{name: "__name__", op: "=", value: name})
+	}
+	if p.peek() == '{' {
+		p.pos++
+		for p.peek() != '}' {
+			label := p.ident()
+			if label == "" {
+				return nil, fmt.Errorf("expected label name at position %d", p.pos)
+			}
+			p.skipSpace()
+			var op string
+			for _, candidate := range []string{"=~", "!~", "!=", "="} {
+				if strings.HasPrefix(p.input[p.pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("expected matcher operator at position %d", p.pos)
+			}
+			p.pos += len(op)
+			p.skipSpace()
+			value, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			m := promMatcher{name: label, op: op, value: value}
+			if op == "=~" || op == "!~" {
+				if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("invalid regexp %q: %v", value, err)
+				}
+			}
+			sel.matchers = append(sel.matchers, m)
+			if p.peek() == ',' {
+				p.pos++
+			}
+		}
+		p.pos++
+	}
+	if len(sel.matchers) == 0 {
+		return nil, fmt.Errorf("selector must have a metric name or matchers")
+	}
+	if p.peek() == '[' {
+		p.pos++
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated range at position %d", p.pos)
+		}
+		d, err := parsePromDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+		if err != nil {
+			return nil, err
+		}
+		sel.rng = d
+		p.pos += end + 1
+	}
+	return sel, nil
+}
+
+func (p *promParser) parseString() (string, error) {
+	if p.pos >= len(p.input) || (p.input[p.pos] != '"' && p.input[p.pos] != '\'') {
+		return "", fmt.Errorf("expected string at position %d", p.pos)
+	}
+	quote := p.input[p.pos]
+	for i := p.pos + 1; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '\\':
+			i++
+		case quote:
+			raw := p.input[p.pos : i+1]
+			p.pos = i + 1
+			if quote == '\'' {
+				raw = `"` + strings.ReplaceAll(raw[1:len(raw)-1], `"`, `\"`) + `"`
+			}
+			return strconv.Unquote(raw)
+		}
+	}
+	return "", fmt.Errorf("unterminated string at position %d", p.pos)
+}
+
+// parsePromDuration parses Prometheus durations such as 30s, 5m, 1h30m, 2d or 1w.
+func parsePromDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	units := map[string]time.Duration{
+		"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+		"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		n, err := strconv.Atoi(rest[:i])
+		unit, ok := units[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
+
+// parsePromTime parses an API timestamp: Unix seconds, possibly fractional, or RFC 3339.
+func parsePromTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+func promError(w http.ResponseWriter, status int, errType string, err error) {
+	writeJSON(w, status, map[string]string{"status": "error", "errorType": errType, "error": err.Error()})
+}
+
+func promSuccess(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "data": data})
+}
+
+func formatPromValue(t time.Time, v float64) []interface{} {
+	return []interface{}{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// handlePromQuery is /api/v1/query.
+func handlePromQuery(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	t, err := parsePromTime(r.Form.Get("time"), time.Now())
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	v, err := expr.eval(newPromEvaluator(t.Add(-maxRange(expr))), t)
+	if err != nil {
+		promError(w, http.StatusBadRequest, "execution", err)
+		return
+	}
+	if v.scalar != nil {
+		promSuccess(w, map[string]interface{}{"resultType": "scalar", "result": formatPromValue(t, *v.scalar)})
+		return
+	}
+	result := []interface{}{}
+	for _, s := range v.vector {
+		result = append(result, map[string]interface{}{"metric": s.Labels, "value": formatPromValue(t, s.V)})
+	}
+	promSuccess(w, map[string]interface{}{"resultType": "vector", "result": result})
+}
+
+// handlePromQueryRange is /api/v1/query_range.
+func handlePromQueryRange(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	start, err := parsePromTime(r.Form.Get("start"), time.Time{})
+	if err == nil && start.IsZero() {
+		err = fmt.Errorf("start is required")
+	}
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parsePromTime(r.Form.Get("end"), time.Now())
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parsePromStep(r.Form.Get("step"))
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if end.Before(start) || end.Sub(start)/step > promMaxPoints {
+		promError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid range or too many points; increase step"))
+		return
+	}
+
+	ev := newPromEvaluator(start.Add(-maxRange(expr)))
+	type matrixSeries struct {
+		Metric map[string]string `json:"metric"`
+		Values [][]interface{}   `json:"values"`
+	}
+	bySeries := make(map[string]*matrixSeries)
+	var order []string
+	for t := start; !t.After(end); t = t.Add(step) {
+		v, err := expr.eval(ev, t)
+		if err != nil {
+			promError(w, http.StatusBadRequest, "execution", err)
+			return
+		}
+		if v.scalar != nil {
+			v.vector = []promSample{{Labels: map[string]string{}, V: *v.scalar}}
+		}
+		for _, s := range v.vector {
+			key := formatSeries("", s.Labels)
+			ms := bySeries[key]
+			if ms == nil {
+				ms = &matrixSeries{Metric: s.Labels}
+				bySeries[key] = ms
+				order = append(order, key)
+			}
+			ms.Values = append(ms.Values, formatPromValue(t, s.V))
+		}
+	}
+	sort.Strings(order)
+	result := []interface{}{}
+	for _, key := range order {
+		result = append(result, bySeries[key])
+	}
+	promSuccess(w, map[string]interface{}{"resultType": "matrix", "result": result})
+}
+
+// parsePromStep accepts a step in seconds or as a duration.
+func parsePromStep(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f > 0 {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := parsePromDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid step %q", s)
+	}
+	return d, nil
+}
+
+// matchingSeries returns the retained series matching any of the match[] selectors, or all without any.
+func matchingSeries(r *http.Request) ([]series, error) {
+	start, err := parsePromTime(r.Form.Get("start"), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	ev := newPromEvaluator(start)
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		return ev.series, nil
+	}
+	var out []series
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		expr, err := parsePromQL(m)
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := expr.(*promSelector)
+		if !ok {
+			return nil, fmt.Errorf("match[] must be a selector: %s", m)
+		}
+		for _, s := range sel.selectSeries(ev) {
+			if key := seriesKey(s.Name, s.Labels); !seen[key] {
+				seen[key] = true
+				out = append(out, s)
+			}
+		}
+	}
+	return out, nil
+}
+
+// handlePromSeries is /api/v1/series.
+func handlePromSeries(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	matched, err := matchingSeries(r)
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	result := []map[string]string{}
+	for _, s := range matched {
+		result = append(result, labelsOf(s))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return formatSeries("", result[i]) < formatSeries("", result[j])
+	})
+	promSuccess(w, result)
+}
+
+// handlePromLabels is /api/v1/labels and /api/v1/label/<name>/values.
+func handlePromLabels(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	matched, err := matchingSeries(r)
+	if err != nil {
+		promError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	name := ""
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/api/v1/label/"); ok {
+		if name, ok = strings.CutSuffix(rest, "/values"); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	set := make(map[string]bool)
+	for _, s := range matched {
+		for k, v := range labelsOf(s) {
+			if name == "" {
+				set[k] = true
+			} else if k == name {
+				set[v] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(set))
+	for v := range set {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	promSuccess(w, result)
+}
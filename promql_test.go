@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// promResponse is a response of the query API.
+type promResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// promQuery runs an instant query at t and returns the response with the result by series.
+func promQuery(t *testing.T, query string, at time.Time) (int, promResponse, map[string]string) {
+	t.Helper()
+	form := url.Values{"query": {query}, "time": {at.Format(time.RFC3339Nano)}}
+	rec := httptest.NewRecorder()
+	handlePromQuery(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+form.Encode(), nil))
+
+	var resp promResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v: %s", query, err, rec.Body)
+	}
+	values := make(map[string]string)
+	switch resp.Data.ResultType {
+	case "vector":
+		var vector []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		}
+		json.Unmarshal(resp.Data.Result, &vector)
+		for _, s := range vector {
+			values[formatSeries("", s.Metric)] = s.Value[1].(string)
+		}
+	case "scalar":
+		var value []interface{}
+		json.Unmarshal(resp.Data.Result, &value)
+		values["scalar"] = value[1].(string)
+	}
+	return rec.Code, resp, values
+}
+
+// seedPromHistory records a run a minute for 12 minutes: client-a-1 gains a connection every run,
+// client-a-2 holds 20 and client-b-1 cycles through 0, 5 and 10. It returns the time of the last run.
+func seedPromHistory(t *testing.T) time.Time {
+	seedHistory(t, 13, time.Minute, []string{"client-a-1", "client-a-2", "client-b-1"}, func(pod string, i int) map[string]int {
+		switch pod {
+		case "client-a-1":
+			return map[string]int{"ESTABLISHED": 10 + i}
+		case "client-a-2":
+			return map[string]int{"ESTABLISHED": 20}
+		}
+		return map[string]int{"ESTABLISHED": 5 * (i % 3)}
+	})
+	total := history.query(metricTotal, nil, time.Time{})
+	return total[0].Samples[len(total[0].Samples)-1].T
+}
+
+func TestPromQuery(t *testing.T) {
+	end := seedPromHistory(t)
+	tests := []struct {
+		query string
+		want  map[string]string
+	}{
+		{`client_tcp_pod_connections{pod="client-a-1"}`, map[string]string{`{__name__="client_tcp_pod_connections",namespace="fpms",pod="client-a-1"}`: "22"}},
+		{`client_tcp_pod_connections{pod!~"client-a-.*"}`, map[string]string{`{__name__="client_tcp_pod_connections",namespace="fpms",pod="client-b-1"}`: "0"}},
+		{`sum(client_tcp_pod_connections)`, map[string]string{"": "42"}},
+		{`sum by (pod) (client_tcp_pod_connections{pod=~"client-a-.*"})`, map[string]string{`{pod="client-a-1"}`: "22", `{pod="client-a-2"}`: "20"}},
+		{`count without (pod) (client_tcp_pod_connections)`, map[string]string{`{namespace="fpms"}`: "3"}},
+		{`max by (namespace) (client_tcp_pod_connections)`, map[string]string{`{namespace="fpms"}`: "22"}},
+		// Samples in the last five minutes are 10, 0, 5, 10 and 0
+		{`max_over_time(client_tcp_pod_connections{pod="client-b-1"}[5m])`, map[string]string{`{namespace="fpms",pod="client-b-1"}`: "10"}},
+		{`min_over_time(client_tcp_pod_connections{pod="client-b-1"}[5m])`, map[string]string{`{namespace="fpms",pod="client-b-1"}`: "0"}},
+		{`increase(client_tcp_pod_connections{pod="client-b-1"}[5m])`, map[string]string{`{namespace="fpms",pod="client-b-1"}`: "10"}},
+		// Nine connections gained over the nine minutes between the first and last sample in range
+		{`rate(client_tcp_pod_connections{pod="client-a-1"}[10m]) * 60`, map[string]string{`{namespace="fpms",pod="client-a-1"}`: "1"}},
+		{`sum(rate(client_tcp_pod_connections{pod=~"client-a-.*"}[10m])) * 60`, map[string]string{"": "1"}},
+		{`sum(client_tcp_pod_connections) / 2`, map[string]string{"": "21"}},
+		{`2 * 3 - 1`, map[string]string{"scalar": "5"}},
+		{`client_tcp_pod_connections{pod="client-c-1"}`, map[string]string{}},
+	}
+	for _, tt := range tests {
+		code, resp, got := promQuery(t, tt.query, end)
+		if code != http.StatusOK || resp.Status != "success" {
+			t.Errorf("%s: status %d %s", tt.query, code, resp.Status)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Nothing is returned past the lookback
+	if _, _, got := promQuery(t, "client_tcp_new", end.Add(promLookback+time.Minute)); len(got) != 0 {
+		t.Errorf("client_tcp_new past the lookback = %v", got)
+	}
+}
+
+func TestPromQueryErrors(t *testing.T) {
+	end := seedPromHistory(t)
+	tests := []struct {
+		query, errType string
+	}{
+		{`sum by (pod client_tcp_new`, "bad_data"},
+		{`rate(client_tcp_new)`, "bad_data"},
+		{`client_tcp_new{pod=~"("}`, "bad_data"},
+		{`client_tcp_new{pod="a"`, "bad_data"},
+		{`client_tcp_new[5x]`, "bad_data"},
+		{`histogram_quantile(0.9, client_tcp_new)`, "bad_data"},
+		{`client_tcp_new[5m]`, "execution"},
+		{`client_tcp_new / client_tcp_new`, "execution"},
+		{`sum(2)`, "execution"},
+	}
+	for _, tt := range tests {
+		code, resp, _ := promQuery(t, tt.query, end)
+		if code != http.StatusBadRequest || resp.Status != "error" || resp.ErrorType != tt.errType {
+			t.Errorf("%s: status %d %s %s, want 400 error %s", tt.query, code, resp.Status, resp.ErrorType, tt.errType)
+		}
+	}
+}
+
+func TestPromQueryRange(t *testing.T) {
+	end := seedPromHistory(t)
+	form := url.Values{
+		"query": {`sum by (pod) (client_tcp_pod_connections{pod="client-b-1"})`},
+		"start": {end.Add(-2 * time.Minute).Format(time.RFC3339Nano)},
+		"end":   {end.Format(time.RFC3339Nano)},
+		"step":  {"60"},
+	}
+	rec := httptest.NewRecorder()
+	handlePromQueryRange(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+form.Encode(), nil))
+	var resp promResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	var matrix []struct {
+		Metric map[string]string `json:"metric"`
+		Values [][]interface{}   `json:"values"`
+	}
+	json.Unmarshal(resp.Data.Result, &matrix)
+	if rec.Code != http.StatusOK || resp.Data.ResultType != "matrix" || len(matrix) != 1 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var values []string
+	for _, v := range matrix[0].Values {
+		values = append(values, v[1].(string))
+	}
+	if matrix[0].Metric["pod"] != "client-b-1" || !reflect.DeepEqual(values, []string{"5", "10", "0"}) {
+		t.Errorf("range = %v %v, want client-b-1 at 5, 10 and 0", matrix[0].Metric, values)
+	}
+}
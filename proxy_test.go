@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socksServer is a minimal SOCKS5 proxy: no authentication, CONNECT only. It records where clients
+// connect to.
+type socksServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	targets []string
+	// record, if set, is also told every target
+	record func(target string)
+}
+
+func startSOCKS(t *testing.T) *socksServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) handle(c net.Conn) {
+	defer c.Close()
+	// Greeting: version, method count, methods
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, make([]byte, head[1])); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+
+	// Request: version, CONNECT, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(c, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n := make([]byte, 1)
+		io.ReadFull(c, n)
+		name := make([]byte, n[0])
+		io.ReadFull(c, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(c, ip)
+		host = net.IP(ip).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port)))
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	if s.record != nil {
+		s.record(target)
+	}
+	s.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, c)
+	io.Copy(c, upstream)
+}
+
+func (s *socksServer) connectedTo() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+// resetProxy undoes setupProxy after a test.
+func resetProxy(t *testing.T) {
+	transport := sinkClient.Transport
+	t.Cleanup(func() {
+		proxyURL = nil
+		sinkClient.Transport = transport
+	})
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	socks := startSOCKS(t)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}))
+	defer sink.Close()
+
+	resetProxy(t)
+	setFlag(t, socks5Proxy, socks.ln.Addr().String())
+	if err := setupProxy("fpms-prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := sinkClient.Get(sink.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "ok" {
+		t.Errorf("sink answered %q through the proxy", body)
+	}
+	sinkAddr := strings.TrimPrefix(sink.URL, "http://")
+	if got := socks.connectedTo(); len(got) != 1 || got[0] != sinkAddr {
+		t.Errorf("proxy connected to %v, want [%s]", got, sinkAddr)
+	}
+
+	want := "HTTPS_PROXY=socks5://" + socks.ln.Addr().String()
+	found := false
+	for _, env := range kubectl("version").Env {
+		found = found || env == want
+	}
+	if !found {
+		t.Errorf("kubectl environment lacks %s", want)
+	}
+}
+
+func TestProxyConfigPerCluster(t *testing.T) {
+	socks := startSOCKS(t)
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	config := "fpms-prod:\n  socks5: " + socks.ln.Addr().String() + "\nfpms-staging:\n  socks5: 192.0.2.1:1080\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resetProxy(t)
+	setFlag(t, proxyConfig, path)
+
+	if err := setupProxy("fpms-dev"); err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL != nil {
+		t.Errorf("cluster without proxy settings goes through %s", proxyURL)
+	}
+	if err := setupProxy("fpms-prod"); err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL == nil || proxyURL.Host != socks.ln.Addr().String() {
+		t.Errorf("fpms-prod goes through %v, want %s", proxyURL, socks.ln.Addr())
+	}
+}
+
+func TestOfflineCommands(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"analyze", "dump.txt"}, true},
+		{[]string{"routes", "test", "up"}, true},
+		{[]string{"explain", "-pod", "client-1", "-file", "tcp.txt"}, true},
+		{[]string{"explain", "--file=tcp.txt", "-pod", "client-1"}, true},
+		{[]string{"explain", "-pod", "client-1"}, false},
+		{[]string{"capture"}, false},
+	}
+	for _, tt := range tests {
+		if got := offline(tt.args); got != tt.want {
+			t.Errorf("offline(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+// TestSSHHelperProcess is not a test: it is the ssh stand-in standInSSH installs. Like `ssh -N -D addr`
+// it serves SOCKS5 on addr, which it does itself rather than through a jump host. It appends its
+// arguments and every proxied target to the file in CHECK_CONN_TEST_SSH.
+func TestSSHHelperProcess(t *testing.T) {
+	record := os.Getenv("CHECK_CONN_TEST_SSH")
+	if record == "" {
+		return
+	}
+	args := os.Args
+	for i, a := range args {
+		if a == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	f, err := os.OpenFile(record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintf(f, "args %s\n", strings.Join(args, " "))
+
+	addr := ""
+	for i, a := range args {
+		if a == "-D" && i+1 < len(args) {
+			addr = args[i+1]
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bind: %v\n", err)
+		os.Exit(255)
+	}
+	s := &socksServer{ln: ln, record: func(target string) { fmt.Fprintf(f, "connect %s\n", target) }}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			os.Exit(0)
+		}
+		go s.handle(c)
+	}
+}
+
+// standInSSH puts an ssh on PATH that runs TestSSHHelperProcess, returning the file it records to.
+func standInSSH(t *testing.T) string {
+	t.Helper()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\nexec '" + self + "' -test.run='^TestSSHHelperProcess$' -- \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	record := filepath.Join(dir, "record")
+	t.Setenv("CHECK_CONN_TEST_SSH", record)
+	return record
+}
+
+func TestSSHJumpTunnel(t *testing.T) {
+	record := standInSSH(t)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}))
+	defer sink.Close()
+
+	resetProxy(t)
+	t.Cleanup(func() {
+		closeProxy()
+		sshCmd = nil
+	})
+	setFlag(t, sshJump, "ec2-user@bastion.example.com:2222")
+	setFlag(t, sshIdentity, "/etc/check-conn/bastion.pem")
+	if err := setupProxy("fpms-prod"); err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL == nil || proxyURL.Scheme != "socks5" {
+		t.Fatalf("proxy = %v, want the tunnel's SOCKS5 address", proxyURL)
+	}
+
+	resp, err := sinkClient.Get(sink.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	wantArgs := "args -N -D " + proxyURL.Host + " -o ExitOnForwardFailure=yes -o BatchMode=yes -o ServerAliveInterval=30 -p 2222 -i /etc/check-conn/bastion.pem ec2-user@bastion.example.com"
+	if len(lines) != 2 || lines[0] != wantArgs || lines[1] != "connect "+strings.TrimPrefix(sink.URL, "http://") {
+		t.Errorf("ssh stand-in recorded %q, want %q and the sink connection", lines, wantArgs)
+	}
+
+	// Closing the proxy takes the tunnel down
+	closeProxy()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		conn, err := net.DialTimeout("tcp", proxyURL.Host, time.Second)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel still listens after closeProxy")
+		}
+	}
+}
+
+func TestOutboundCommandsUseProxy(t *testing.T) {
+	resetProxy(t)
+	setFlag(t, socks5Proxy, "127.0.0.1:1080")
+	if err := setupProxy("fpms-prod"); err != nil {
+		t.Fatal(err)
+	}
+	has := func(list []string, want string) bool {
+		for _, v := range list {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	}
+	for name, env := range map[string][]string{"kubectl": kubectl("version").Env, "aws": awsCommand("sts", "get-caller-identity").Env} {
+		if !has(env, "HTTPS_PROXY=socks5://127.0.0.1:1080") {
+			t.Errorf("%s environment lacks the proxy", name)
+		}
+	}
+	setFlag(t, ec2SSHUser, "ec2-user")
+	if args := sshCommand(Target{IP: "10.0.0.1"}, "true").Args; !has(args, "ProxyCommand=nc -X 5 -x 127.0.0.1:1080 %h %p") {
+		t.Errorf("ssh to instances does not go through the proxy: %q", args)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var topPeers = flag.Int("top-peers", 10, "Number of peers to list in the report")
+
+// peerStat is the established target port connections from one remote address, as rendered for an output.
+type peerStat struct {
+	Addr        string `json:"addr"`
+	Connections int    `json:"connections"`
+	// Number of pods the peer holds connections to
+	Pods int `json:"pods"`
+}
+
+// aggregatePeers counts established target port connections per remote address across all pods,
+// busiest peer first. Addresses are rendered by the output's anonymizer, so peers that anonymize the
+// same (e.g. one truncated prefix) count as one.
+func aggregatePeers(pods []PodResult, anon anonymizer) []peerStat {
+	conns := make(map[string]int)
+	podCount := make(map[string]int)
+	for _, p := range pods {
+		seen := make(map[string]bool)
+		for _, s := range p.Sockets {
+			if s.State != "ESTABLISHED" || !matchesTargetPort(s) {
+				continue
+			}
+			addr := anon.addr(s.Remote.Addr())
+			conns[addr]++
+			if !seen[addr] {
+				seen[addr] = true
+				podCount[addr]++
+			}
+		}
+	}
+
+	peers := make([]peerStat, 0, len(conns))
+	for addr, n := range conns {
+		peers = append(peers, peerStat{Addr: addr, Connections: n, Pods: podCount[addr]})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Connections != peers[j].Connections {
+			return peers[i].Connections > peers[j].Connections
+		}
+		return peers[i].Addr < peers[j].Addr
+	})
+	return peers
+}
+
+// printReport prints the per-pod counts and state breakdown, the fleet-wide state totals and the top peers.
+func printReport(r *Report) {
+	// The endpoint column only appears when pods were checked against a Service
+	endpoints := false
+	for _, p := range r.Pods {
+		endpoints = endpoints || p.Endpoint != ""
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if endpoints {
+		fmt.Fprintln(w, "NAMESPACE\tPOD\tCONNECTIONS\tSTATES\tENDPOINT\tERROR")
+	} else {
+		fmt.Fprintln(w, "NAMESPACE\tPOD\tCONNECTIONS\tSTATES\tERROR")
+	}
+	totals := make(map[string]int)
+	for _, p := range r.Pods {
+		errMsg := ""
+		if p.Err != nil {
+			errMsg = p.Err.Error()
+		}
+		for state, n := range p.States {
+			totals[state] += n
+		}
+		if endpoints {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", p.Target.Namespace, p.Target.Pod, p.Count, formatStates(p.States), p.Endpoint, errMsg)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", p.Target.Namespace, p.Target.Pod, p.Count, formatStates(p.States), errMsg)
+		}
+	}
+	w.Flush()
+
+	if len(totals) > 0 {
+		fmt.Printf("Sockets on port %s by state: %s\n", *targetPort, formatStates(totals))
+	}
+	printTCPInfo(r.Pods)
+	printIdle(r)
+	printDistinct(r.Pods)
+
+	peers := aggregatePeers(r.Pods, anonymizerFor(sinkReport))
+	if len(peers) == 0 || *topPeers <= 0 {
+		return
+	}
+	fmt.Printf("Top peers (%d of %d):\n", min(*topPeers, len(peers)), len(peers))
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  PEER\tCONNECTIONS\tPODS")
+	for i, p := range peers {
+		if i == *topPeers {
+			break
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%d\n", p.Addr, p.Connections, p.Pods)
+	}
+	w.Flush()
+}
+
+// printTCPInfo prints the RTT, retransmit and idle statistics of the pods that have TCP_INFO.
+func printTCPInfo(pods []PodResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := false
+	for _, p := range pods {
+		t := p.TCPInfo
+		if t == nil {
+			continue
+		}
+		if !header {
+			fmt.Println("TCP_INFO of established connections:")
+			fmt.Fprintln(w, "  POD\tRTT P50\tRTT P90\tRTT P99\tRTT MAX\tRETRANSMITTING\tRETRANS\tRETRANS P99\tCWND\tIDLE")
+			header = true
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%d/%d\t%d\t%d\t%.1f\t%d\n", p.Target.Pod,
+			formatSeconds(t.RTTP50), formatSeconds(t.RTTP90), formatSeconds(t.RTTP99), formatSeconds(t.RTTMax),
+			t.RetransConnections, t.Connections, t.TotalRetrans, t.RetransP99, t.MeanCwnd, t.Idle)
+	}
+	w.Flush()
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(10 * time.Microsecond).String()
+}
+
+// printDistinct prints the estimated distinct clients overall and, when there are several, per namespace.
+func printDistinct(pods []PodResult) {
+	var all []*hll
+	byNamespace := make(map[string][]*hll)
+	for _, p := range pods {
+		all = append(all, p.Clients)
+		byNamespace[p.Target.Namespace] = append(byNamespace[p.Target.Namespace], p.Clients)
+	}
+	merged := mergeSketches(all...)
+	if merged == nil {
+		return
+	}
+	fmt.Printf("Distinct clients (by %s): %s\n", *distinctBy, formatEstimate(merged))
+	if len(byNamespace) < 2 {
+		return
+	}
+	namespaces := make([]string, 0, len(byNamespace))
+	for ns := range byNamespace {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		if h := mergeSketches(byNamespace[ns]...); h != nil {
+			fmt.Printf("  %s: %s\n", ns, formatEstimate(h))
+		}
+	}
+}
+
+// formatStates renders a state breakdown as "CLOSE_WAIT=2 ESTABLISHED=10".
+func formatStates(states map[string]int) string {
+	names := make([]string, 0, len(states))
+	for state := range states {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, state := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", state, states[state]))
+	}
+	return strings.Join(parts, " ")
+}
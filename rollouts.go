@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Label Argo Rollouts puts on the pods of each revision
+	defaultRevisionLabel = "rollouts-pod-template-hash"
+	// Label Deployments put on the pods of each ReplicaSet, used when the default is absent
+	fallbackRevisionLabel = "pod-template-hash"
+)
+
+// rolloutRequest holds the parameters of a rollout analysis, taken from the query string
+// (Argo Rollouts web metric) or from the metadata of a Flagger webhook payload.
+type rolloutRequest struct {
+	Selector      string
+	RevisionLabel string
+	Tolerance     float64
+}
+
+// flaggerWebhook is the payload Flagger posts to webhook checks.
+type flaggerWebhook struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Phase     string            `json:"phase"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// rolloutResult is the JSON response. Argo Rollouts reads it through a jsonPath and a successCondition
+// such as "result.success == true"; Flagger only looks at the status code.
+type rolloutResult struct {
+	Selector      string        `json:"selector"`
+	RevisionLabel string        `json:"revisionLabel"`
+	Total         int           `json:"total"`
+	Pods          int           `json:"pods"`
+	FailedPods    int           `json:"failedPods"`
+	Revisions     []subsetShare `json:"revisions"`
+	Success       bool          `json:"success"`
+	Reason        string        `json:"reason,omitempty"`
+}
+
+// handleRollout runs a fresh collection for the requested selector and checks that each revision
+// holds a share of the connections in line with its share of the pods.
+//
+// GET requests are for the Argo Rollouts web metric provider and always answer 200 with the verdict in the
+// body. POST requests are Flagger webhooks and answer 412 when the check fails. Other methods are refused.
+func handleRollout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := rolloutRequest{
+		Selector:      r.URL.Query().Get("selector"),
+		RevisionLabel: r.URL.Query().Get("revisionLabel"),
+		Tolerance:     *canaryTolerance,
+	}
+
+	tolerance := r.URL.Query().Get("tolerance")
+	flagger := r.Method == http.MethodPost
+	if flagger {
+		var hook flaggerWebhook
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			http.Error(w, fmt.Sprintf("invalid webhook payload: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("Flagger %s check for %s/%s\n", hook.Phase, hook.Namespace, hook.Name)
+		if req.Selector == "" {
+			req.Selector = hook.Metadata["selector"]
+		}
+		if req.RevisionLabel == "" {
+			req.RevisionLabel = hook.Metadata["revisionLabel"]
+		}
+		if tolerance == "" {
+			tolerance = hook.Metadata["tolerance"]
+		}
+	}
+	if tolerance != "" {
+		t, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid tolerance %q", tolerance), http.StatusBadRequest)
+			return
+		}
+		req.Tolerance = t
+	}
+
+	result, err := analyzeRollout(req)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if flagger && !result.Success {
+		status = http.StatusPreconditionFailed
+	}
+	writeJSON(w, status, result)
+}
+
+// analyzeRollout collects from the pods matching the selector and compares each revision's share of
+// connections with its share of pods.
+func analyzeRollout(req rolloutRequest) (*rolloutResult, error) {
+	targets, err := discoverTargets()
+	if err != nil {
+		return nil, err
+	}
+	targets, err = filterTargets(targets, req.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no pods match selector %q", req.Selector)
+	}
+
+	report, err := collectTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &rolloutResult{
+		Selector:      req.Selector,
+		RevisionLabel: req.RevisionLabel,
+		Total:         report.Total,
+		Pods:          len(report.Pods),
+	}
+	for _, p := range report.Pods {
+		if p.Err != nil {
+			result.FailedPods++
+		}
+	}
+	if result.FailedPods == result.Pods {
+		result.Reason = "collection failed on every pod"
+		return result, nil
+	}
+
+	if result.RevisionLabel == "" {
+		result.RevisionLabel = defaultRevisionLabel
+		if len(replicaSubsets(report, defaultRevisionLabel)) == 0 {
+			result.RevisionLabel = fallbackRevisionLabel
+		}
+	}
+	revisions := replicaSubsets(report, result.RevisionLabel)
+	if len(revisions) == 0 {
+		result.Reason = fmt.Sprintf("no pod carries the %s label", result.RevisionLabel)
+		return result, nil
+	}
+
+	check, err := evaluateSplit(report, revisions, req.Tolerance)
+	if err != nil {
+		result.Reason = err.Error()
+		return result, nil
+	}
+	result.Revisions = check.Subsets
+	result.Success = len(check.Failed) == 0
+	if !result.Success {
+		result.Reason = fmt.Sprintf("revisions %v deviate from their pod share by more than %.1f percentage points", check.Failed, req.Tolerance)
+	}
+	return result, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// standInRollout puts a kubectl on PATH with two pods of revision aaa holding 10 connections each,
+// and one pod of revision bbb holding 20.
+func standInRollout(t *testing.T) {
+	t.Helper()
+	standInKubectl(t, `case "$1" in
+get) cat <<'EOF'
+{"items": [
+  {"metadata": {"name": "client-a-1", "namespace": "fpms", "labels": {"app": "client", "rollouts-pod-template-hash": "aaa"}}, "status": {"podIP": "10.0.0.1"}},
+  {"metadata": {"name": "client-a-2", "namespace": "fpms", "labels": {"app": "client", "rollouts-pod-template-hash": "aaa"}}, "status": {"podIP": "10.0.0.2"}},
+  {"metadata": {"name": "client-b-1", "namespace": "fpms", "labels": {"app": "client", "rollouts-pod-template-hash": "bbb"}}, "status": {"podIP": "10.0.0.3"}}
+]}
+EOF
+;;
+exec)
+	n=10
+	[ "$4" = client-b-1 ] && n=20
+	echo 'Active Internet connections (w/o servers)'
+	echo 'Proto Recv-Q Send-Q Local Address Foreign Address State'
+	i=0
+	while [ $i -lt $n ]; do
+		echo "tcp 0 0 10.0.0.9:$((40000 + i)) 10.1.0.5:`+*targetPort+` ESTABLISHED"
+		i=$((i + 1))
+	done
+;;
+esac
+`)
+	saved := tokenCache
+	tokenCache = &TokenResponse{Token: "test", Expiry: time.Now().Add(time.Hour).Unix()}
+	t.Cleanup(func() { tokenCache = saved })
+}
+
+// rolloutRequestTo sends a request to the rollout analysis endpoint.
+func rolloutRequestTo(method, query, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleRollout(rec, httptest.NewRequest(method, "/api/v1/rollout"+query, strings.NewReader(body)))
+	return rec
+}
+
+func TestRolloutResponse(t *testing.T) {
+	standInRollout(t)
+
+	rec := rolloutRequestTo(http.MethodGet, "?selector=app%3Dclient&tolerance=20", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	// The fields Argo Rollouts analysis templates refer to
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if want := []string{"failedPods", "pods", "revisionLabel", "revisions", "selector", "success", "total"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("response fields %v, want %v", keys, want)
+	}
+	var revisions []map[string]any
+	if err := json.Unmarshal(fields["revisions"], &revisions); err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions = %s", fields["revisions"])
+	}
+	if _, ok := revisions[0]["deviation"]; !ok || revisions[0]["name"] != "aaa" || revisions[0]["pods"] != 2.0 || revisions[0]["connections"] != 20.0 {
+		t.Errorf("revision aaa = %v", revisions[0])
+	}
+
+	var result rolloutResult
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	if !result.Success || result.Selector != "app=client" || result.RevisionLabel != defaultRevisionLabel || result.Total != 40 || result.Pods != 3 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestRolloutVerdict(t *testing.T) {
+	standInRollout(t)
+	setFlag(t, canaryTolerance, 5)
+
+	// Revision aaa has two thirds of the pods and half the connections
+	tests := []struct {
+		name, method, query, body string
+		code                      int
+		success                   bool
+	}{
+		{"argo pass", http.MethodGet, "?selector=app%3Dclient&tolerance=20", "", http.StatusOK, true},
+		{"argo fail", http.MethodGet, "?selector=app%3Dclient", "", http.StatusOK, false},
+		{"flagger pass", http.MethodPost, "", `{"name": "client", "namespace": "fpms", "phase": "Progressing", "metadata": {"selector": "app=client", "tolerance": "20"}}`, http.StatusOK, true},
+		{"flagger fail", http.MethodPost, "", `{"name": "client", "namespace": "fpms", "phase": "Progressing", "metadata": {"selector": "app=client"}}`, http.StatusPreconditionFailed, false},
+	}
+	for _, tt := range tests {
+		rec := rolloutRequestTo(tt.method, tt.query, tt.body)
+		var result rolloutResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v: %s", tt.name, err, rec.Body)
+		}
+		if rec.Code != tt.code || result.Success != tt.success {
+			t.Errorf("%s: status %d, success %v, want %d and %v", tt.name, rec.Code, result.Success, tt.code, tt.success)
+		}
+		if !tt.success && !strings.Contains(result.Reason, "[aaa bbb]") {
+			t.Errorf("%s: reason %q", tt.name, result.Reason)
+		}
+	}
+
+	for _, tt := range []struct{ query, body string }{{"?tolerance=five", ""}, {"", "{"}} {
+		if rec := rolloutRequestTo(http.MethodPost, tt.query, tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("query %q body %q: status %d, want 400", tt.query, tt.body, rec.Code)
+		}
+	}
+}
+
+func TestRolloutRoutes(t *testing.T) {
+	routed := func(path string) bool {
+		_, pattern := apiMux().Handler(httptest.NewRequest(http.MethodPost, path, nil))
+		return pattern != ""
+	}
+	if !routed("/api/v1/rollout") {
+		t.Errorf("serve mode does not serve rollout analysis")
+	}
+	setFlag(t, aggregatorMode, true)
+	if routed("/api/v1/rollout") {
+		t.Errorf("the aggregator serves rollout analysis")
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		rec := rolloutRequestTo(method, "?selector=app%3Dclient", "")
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, POST" {
+			t.Errorf("%s: status %d, Allow %q", method, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+}
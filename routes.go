@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var routesPath = flag.String("routes", "", "JSON/YAML routing config that sends each metric series to named sinks")
+
+// routeConfig is the -routes file: named sinks and the routing tree that picks sinks for each series.
+//
+//	sinks:
+//	  shared: {type: pushgateway, url: "http://pushgateway:9091/metrics/job/client_tcp_new"}
+//	  team: {type: http, url: "http://victoriametrics:8428/api/v1/import/prometheus"}
+//	  archive: {type: file, path: /var/lib/check-conn/archive.jsonl}
+//	route:
+//	  routes:
+//	    - match: {__name__: client_tcp_new}
+//	      sink: shared
+//	    - matchRE: {__name__: "client_tcp_pod_.*"}
+//	      sink: team
+//	      relabel:
+//	        - {action: labeldrop, regex: "label_.*"}
+//	    - matchRE: {__name__: "client_tcp_peer_.*"}
+//	      sink: archive
+type routeConfig struct {
+	Sinks map[string]routeSink `json:"sinks" yaml:"sinks"`
+	Route route                `json:"route" yaml:"route"`
+}
+
+// routeSink is where routed series are sent:
+//   - pushgateway and http POST the series in the Prometheus text format to url. http suits receivers
+//     that import the text format, such as VictoriaMetrics or a remote-write adapter.
+//   - file appends one JSON line per run to path, for archives.
+type routeSink struct {
+	Type    string            `json:"type" yaml:"type"`
+	URL     string            `json:"url,omitempty" yaml:"url,omitempty"`
+	Path    string            `json:"path,omitempty" yaml:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// route is a node of the routing tree. As in Alertmanager, a series descends into the first child route
+// that matches it, and into later matching siblings only while the matched ones have continue set. A
+// series no child matches goes to the node's sink, inherited from the parent when unset; one without any
+// sink is dropped. Relabeling rules of all nodes on the way apply in order. The root matches everything.
+type route struct {
+	// Label values the series must have, and regexps they must fully match; __name__ is the metric name
+	Match    map[string]string `json:"match,omitempty" yaml:"match,omitempty"`
+	MatchRE  map[string]string `json:"matchRE,omitempty" yaml:"matchRE,omitempty"`
+	Sink     string            `json:"sink,omitempty" yaml:"sink,omitempty"`
+	Continue bool              `json:"continue,omitempty" yaml:"continue,omitempty"`
+	Relabel  []relabelRule     `json:"relabel,omitempty" yaml:"relabel,omitempty"`
+	Routes   []route           `json:"routes,omitempty" yaml:"routes,omitempty"`
+
+	matchRE map[string]*regexp.Regexp
+}
+
+// relabelRule is a subset of Prometheus relabeling: replace (default), keep, drop, labeldrop and labelkeep.
+type relabelRule struct {
+	SourceLabels []string `json:"sourceLabels,omitempty" yaml:"sourceLabels,omitempty"`
+	Separator    *string  `json:"separator,omitempty" yaml:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty" yaml:"regex,omitempty"`
+	TargetLabel  string   `json:"targetLabel,omitempty" yaml:"targetLabel,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty" yaml:"action,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// routing is the loaded -routes config, or nil when series are not routed.
+var routing *routeConfig
+
+// loadRoutes reads and checks the routing config.
+func loadRoutes(path string) (*routeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg routeConfig
+	if isYAMLPath(path) {
+		err = yaml.Unmarshal(data, &cfg)
+	} else {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes %s: %v", path, err)
+	}
+
+	for name, sink := range cfg.Sinks {
+		switch sink.Type {
+		case "pushgateway", "http":
+			if sink.URL == "" {
+				return nil, fmt.Errorf("sink %s: url is required", name)
+			}
+		case "file":
+			if sink.Path == "" {
+				return nil, fmt.Errorf("sink %s: path is required", name)
+			}
+		default:
+			return nil, fmt.Errorf("sink %s: unknown type %q", name, sink.Type)
+		}
+	}
+	if err := cfg.Route.compile(cfg.Sinks, "route"); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// compile checks the route's sinks and compiles its regexps, recursively.
+func (r *route) compile(sinks map[string]routeSink, path string) error {
+	if _, ok := sinks[r.Sink]; r.Sink != "" && !ok {
+		return fmt.Errorf("%s: unknown sink %q", path, r.Sink)
+	}
+	r.matchRE = make(map[string]*regexp.Regexp)
+	for label, expr := range r.MatchRE {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("%s: invalid matchRE for %s: %v", path, label, err)
+		}
+		r.matchRE[label] = re
+	}
+	for i := range r.Relabel {
+		rule := &r.Relabel[i]
+		if rule.Action == "" {
+			rule.Action = "replace"
+		}
+		if rule.Regex == "" {
+			rule.Regex = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("%s: invalid relabel regex: %v", path, err)
+		}
+		rule.re = re
+		switch rule.Action {
+		case "replace":
+			if rule.TargetLabel == "" {
+				return fmt.Errorf("%s: replace needs targetLabel", path)
+			}
+		case "keep", "drop", "labeldrop", "labelkeep":
+		default:
+			return fmt.Errorf("%s: unknown relabel action %q", path, rule.Action)
+		}
+	}
+	for i := range r.Routes {
+		if err := r.Routes[i].compile(sinks, fmt.Sprintf("%s.routes[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *route) matches(labels map[string]string) bool {
+	for k, v := range r.Match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for k, re := range r.matchRE {
+		if !re.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// routeTarget is a sink a series is routed to, with the relabeling on its way and the route that chose it.
+type routeTarget struct {
+	Sink    string
+	Path    string
+	Relabel []relabelRule
+}
+
+// resolve returns the sinks a series with the given labels (including __name__) goes to.
+func (r *route) resolve(labels map[string]string, sink, path string, relabel []relabelRule) []routeTarget {
+	if r.Sink != "" {
+		sink = r.Sink
+	}
+	relabel = append(relabel[:len(relabel):len(relabel)], r.Relabel...)
+
+	var targets []routeTarget
+	matched := false
+	for i := range r.Routes {
+		child := &r.Routes[i]
+		if !child.matches(labels) {
+			continue
+		}
+		matched = true
+		targets = append(targets, child.resolve(labels, sink, fmt.Sprintf("%s.routes[%d]", path, i), relabel)...)
+		if !child.Continue {
+			break
+		}
+	}
+	if !matched && sink != "" {
+		targets = append(targets, routeTarget{Sink: sink, Path: path, Relabel: relabel})
+	}
+	return targets
+}
+
+// anonymizePeer renders the peer label of a single series the way the sink's privacy mode wants it, before
+// the sink's relabeling, so no rule can copy the raw address into another label. Reports are anonymized
+// per sink when their series are built, see routeReport.
+func anonymizePeer(sink string, labels map[string]string) map[string]string {
+	addr, err := netip.ParseAddr(labels["peer"])
+	if err != nil {
+		return labels
+	}
+	labels["peer"] = anonymizerFor(sink).addr(addr)
+	return labels
+}
+
+// applyRelabel runs the rules over the labels, returning nil if the series is dropped.
+func applyRelabel(rules []relabelRule, labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, rule := range rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, l := range rule.SourceLabels {
+			values[i] = out[l]
+		}
+		sep := ";"
+		if rule.Separator != nil {
+			sep = *rule.Separator
+		}
+		value := strings.Join(values, sep)
+
+		switch rule.Action {
+		case "replace":
+			m := rule.re.FindStringSubmatchIndex(value)
+			if m == nil {
+				continue
+			}
+			replacement := "$1"
+			if rule.Replacement != nil {
+				replacement = *rule.Replacement
+			}
+			result := string(rule.re.ExpandString(nil, replacement, value, m))
+			if result == "" {
+				delete(out, rule.TargetLabel)
+			} else {
+				out[rule.TargetLabel] = result
+			}
+		case "keep":
+			if !rule.re.MatchString(value) {
+				return nil
+			}
+		case "drop":
+			if rule.re.MatchString(value) {
+				return nil
+			}
+		case "labeldrop", "labelkeep":
+			for k := range out {
+				if k != "__name__" && rule.re.MatchString(k) == (rule.Action == "labeldrop") {
+					delete(out, k)
+				}
+			}
+		}
+	}
+	if out["__name__"] == "" {
+		return nil
+	}
+	return out
+}
+
+// reportSeries renders a report as the series that are routed: the /metrics series plus one series
+// per peer, with peers anonymized and merged the way one sink wants them.
+func reportSeries(r *Report, anon anonymizer) *metricWriter {
+	m := newMetricWriter()
+	skipped := 0.0
+	if r.Skipped != "" {
+		skipped = 1
+	}
+	m.add("client_tcp_run_skipped", "Whether the run was skipped because another run held the run lock.", map[string]string{"cluster": clusterName}, skipped)
+	if r.Skipped != "" {
+		return m
+	}
+	m.addSummary(summarize(r, ""), map[string]string{"cluster": clusterName})
+	for _, p := range aggregatePeers(r.Pods, anon) {
+		labels := map[string]string{"cluster": clusterName, "peer": p.Addr}
+		m.add("client_tcp_peer_connections", "Established target port connections from the peer across all pods.", labels, float64(p.Connections))
+		m.add("client_tcp_peer_pods", "Pods the peer holds established target port connections to.", labels, float64(p.Pods))
+	}
+	for _, p := range idleByPeer(r.Pods, anon) {
+		labels := map[string]string{"cluster": clusterName, "peer": p.Addr}
+		m.add("client_tcp_peer_idle_connections", "Idle established target port connections from the peer, with or without keepalive.", labels, float64(p.Idle))
+		m.add("client_tcp_peer_idle_no_keepalive_connections", "Idle established target port connections from the peer without a keepalive timer.", labels, float64(p.IdleNoKeepalive))
+		m.add("client_tcp_peer_idle_max_seconds", "Longest time one of the peer's target port connections has been idle.", labels, p.IdleMax)
+	}
+	return m
+}
+
+// routeReport sends the series of a report to the sinks the routing tree picks for them. The series are
+// built once per privacy mode, so peers that anonymize alike, such as those of one truncated prefix, are
+// merged into one series before routing rather than sent as duplicates.
+func routeReport(r *Report) {
+	sinks := make([]string, 0, len(routing.Sinks))
+	for name := range routing.Sinks {
+		sinks = append(sinks, name)
+	}
+	sort.Strings(sinks)
+
+	series := make(map[anonymizer]*metricWriter)
+	writers := make(map[string]*metricWriter)
+	for _, sink := range sinks {
+		anon := anonymizerFor(sink)
+		all := series[anon]
+		if all == nil {
+			all = reportSeries(r, anon)
+			series[anon] = all
+		}
+		for _, s := range all.samples() {
+			for _, t := range routing.Route.resolve(withLabel(s.Labels, "__name__", s.Name), "", "route", nil) {
+				if t.Sink != sink {
+					continue
+				}
+				labels := applyRelabel(t.Relabel, withLabel(s.Labels, "__name__", s.Name))
+				if labels == nil {
+					continue
+				}
+				name := labels["__name__"]
+				delete(labels, "__name__")
+				if writers[sink] == nil {
+					writers[sink] = newMetricWriter()
+				}
+				writers[sink].add(name, all.help[s.Name], labels, s.Value)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(writers))
+	for name := range writers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := sendToSink(name, routing.Sinks[name], r, writers[name]); err != nil {
+			fmt.Printf("Error sending to sink %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Sent %d series to sink %s.\n", len(writers[name].samples()), name)
+	}
+}
+
+func sendToSink(name string, sink routeSink, r *Report, m *metricWriter) error {
+	switch sink.Type {
+	case "file":
+		line, err := json.Marshal(struct {
+			Time   time.Time      `json:"time"`
+			RunID  string         `json:"runId"`
+			Series []metricSample `json:"series"`
+		}{r.Start, r.RunID, m.samples()})
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(sink.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(append(line, '\n'))
+		return err
+	default:
+		var body bytes.Buffer
+		m.writeTo(&body)
+		req, err := http.NewRequest(http.MethodPost, sink.URL, &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		for k, v := range sink.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := sinkClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%s error: %s", sink.Type, strings.TrimSpace(string(msg)))
+		}
+		return nil
+	}
+}
+
+// runRoutes is the routes command:
+//
+//	check-conn-script -routes routes.yaml routes test 'client_tcp_pod_connections{namespace="fpms",pod="client-1"}' ...
+//
+// For each series it shows the routes it takes, the sinks it goes to and how it arrives there.
+func runRoutes(args []string) error {
+	if len(args) < 2 || args[0] != "test" {
+		return fmt.Errorf("usage: routes test <series> ...")
+	}
+	if routing == nil {
+		return fmt.Errorf("no -routes config given")
+	}
+	for _, arg := range args[1:] {
+		name, labels, err := parseSeries(arg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(formatSeries(name, labels))
+		targets := routing.Route.resolve(withLabel(labels, "__name__", name), "", "route", nil)
+		if len(targets) == 0 {
+			fmt.Println("  dropped: no route with a sink matches")
+		}
+		for _, t := range targets {
+			sink := routing.Sinks[t.Sink]
+			dest := sink.URL
+			if sink.Type == "file" {
+				dest = sink.Path
+			}
+			fmt.Printf("  %s -> sink %s (%s %s)\n", t.Path, t.Sink, sink.Type, dest)
+			out := applyRelabel(t.Relabel, anonymizePeer(t.Sink, withLabel(labels, "__name__", name)))
+			if out == nil {
+				fmt.Println("    dropped by relabeling")
+				continue
+			}
+			outName := out["__name__"]
+			delete(out, "__name__")
+			fmt.Printf("    sent as %s\n", formatSeries(outName, out))
+		}
+	}
+	return nil
+}
+
+// parseSeries parses a series in the text format notation, e.g. `client_tcp_new{cluster="fpms-prod"}`.
+func parseSeries(s string) (string, map[string]string, error) {
+	s = strings.TrimSpace(s)
+	name, rest, hasLabels := strings.Cut(s, "{")
+	labels := make(map[string]string)
+	if !hasLabels {
+		return name, labels, nil
+	}
+	if !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("invalid series %q: missing }", s)
+	}
+	rest = strings.TrimSuffix(rest, "}")
+	for strings.TrimSpace(rest) != "" {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid series %q", s)
+		}
+		key = strings.TrimSpace(key)
+		after = strings.TrimSpace(after)
+		value, err := strconv.QuotedPrefix(after)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value of %s in %q", key, s)
+		}
+		labels[key], _ = strconv.Unquote(value)
+		rest = strings.TrimPrefix(strings.TrimSpace(after[len(value):]), ",")
+	}
+	return strings.TrimSpace(name), labels, nil
+}
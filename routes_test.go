@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteRelabelSeesAnonymizedPeer(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.jsonl")
+	config := `
+sinks:
+  archive: {type: file, path: ` + archive + `}
+route:
+  routes:
+    - matchRE: {__name__: "client_tcp_peer_connections"}
+      sink: archive
+      relabel:
+        - {sourceLabels: [peer], targetLabel: client}
+`
+	path := filepath.Join(dir, "routes.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routing = cfg
+	sinkPrivacy["archive"] = "truncate"
+	t.Cleanup(func() {
+		routing = nil
+		delete(sinkPrivacy, "archive")
+	})
+
+	sockets := []Socket{{
+		Local:  netip.MustParseAddrPort("10.0.0.1:" + *targetPort),
+		Remote: netip.MustParseAddrPort("10.1.2.3:51234"),
+		State:  "ESTABLISHED",
+	}}
+	pod := newPodResult(Target{Namespace: "fpms", Pod: "client-a-1"}, sockets)
+	routeReport(&Report{RunID: newRunID(), Start: time.Now(), Pods: []PodResult{pod}, Total: pod.Count})
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "10.1.2.3") {
+		t.Errorf("raw peer address reached the sink: %s", data)
+	}
+	var line struct {
+		Series []metricSample `json:"series"`
+	}
+	if err := json.Unmarshal(data, &line); err != nil {
+		t.Fatal(err)
+	}
+	if len(line.Series) != 1 {
+		t.Fatalf("got %d series, want 1: %s", len(line.Series), data)
+	}
+	labels := line.Series[0].Labels
+	if labels["peer"] != "10.1.2.0/24" || labels["client"] != "10.1.2.0/24" {
+		t.Errorf("labels = %v, want peer and client truncated to 10.1.2.0/24", labels)
+	}
+}
+
+func TestRouteMergesAnonymizedPeers(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.jsonl")
+	config := `
+sinks:
+  archive: {type: file, path: ` + archive + `}
+route:
+  routes:
+    - matchRE: {__name__: "client_tcp_peer_.*"}
+      sink: archive
+`
+	path := filepath.Join(dir, "routes.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routing = cfg
+	sinkPrivacy["archive"] = "truncate"
+	t.Cleanup(func() {
+		routing = nil
+		delete(sinkPrivacy, "archive")
+	})
+
+	// Two peers of one /24 across two pods, idle for 10m and 20m
+	socket := func(peer string, idle time.Duration) Socket {
+		return Socket{
+			Local:  netip.MustParseAddrPort("10.0.0.1:" + *targetPort),
+			Remote: netip.MustParseAddrPort(peer),
+			State:  "ESTABLISHED",
+			Info:   &TCPInfo{LastSend: idle, LastRecv: idle},
+		}
+	}
+	a := newPodResult(Target{Namespace: "fpms", Pod: "client-a-1"}, []Socket{socket("10.1.2.3:51234", 10*time.Minute), socket("10.1.2.4:51234", 20*time.Minute)})
+	b := newPodResult(Target{Namespace: "fpms", Pod: "client-a-2"}, []Socket{socket("10.1.2.3:51235", time.Second)})
+	routeReport(&Report{RunID: newRunID(), Start: time.Now(), Pods: []PodResult{a, b}, Total: a.Count + b.Count})
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Series []metricSample `json:"series"`
+	}
+	if err := json.Unmarshal(data, &line); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, s := range line.Series {
+		if s.Labels["peer"] != "10.1.2.0/24" {
+			t.Errorf("series %s has peer %q, want 10.1.2.0/24", s.Name, s.Labels["peer"])
+		}
+		if _, dup := got[s.Name]; dup {
+			t.Errorf("duplicate series %s%v", s.Name, s.Labels)
+		}
+		got[s.Name] = s.Value
+	}
+	want := map[string]float64{
+		"client_tcp_peer_connections":                   3,
+		"client_tcp_peer_pods":                          2,
+		"client_tcp_peer_idle_connections":              2,
+		"client_tcp_peer_idle_no_keepalive_connections": 2,
+		"client_tcp_peer_idle_max_seconds":              1200,
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s = %v, want %v", name, got[name], v)
+		}
+	}
+}
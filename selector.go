@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelRequirement is one term of an equality-based Kubernetes label selector.
+type labelRequirement struct {
+	Key    string
+	Value  string
+	Negate bool
+	// Exists is set for a bare key ("app") or a negated bare key ("!app")
+	Exists bool
+}
+
+// parseSelector parses an equality-based label selector such as "app=client,track!=canary".
+func parseSelector(selector string) ([]labelRequirement, error) {
+	var reqs []labelRequirement
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req labelRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			req.Key, req.Value, _ = strings.Cut(term, "!=")
+			req.Negate = true
+		case strings.Contains(term, "=="):
+			req.Key, req.Value, _ = strings.Cut(term, "==")
+		case strings.Contains(term, "="):
+			req.Key, req.Value, _ = strings.Cut(term, "=")
+		case strings.HasPrefix(term, "!"):
+			req.Key = term[1:]
+			req.Exists = true
+			req.Negate = true
+		default:
+			req.Key = term
+			req.Exists = true
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// matchesSelector reports whether the pod's labels satisfy every requirement.
+func matchesSelector(t Target, reqs []labelRequirement) bool {
+	for _, req := range reqs {
+		v := podLabel(t, req.Key)
+		var ok bool
+		if req.Exists {
+			ok = v != ""
+		} else {
+			ok = v == req.Value
+		}
+		if ok == req.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// filterTargets returns the targets matching a label selector.
+func filterTargets(targets []Target, selector string) ([]Target, error) {
+	reqs, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var matched []Target
+	for _, t := range targets {
+		if matchesSelector(t, reqs) {
+			matched = append(matched, t)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var (
+	latest      *Report
+	latestMutex sync.Mutex
+	// Whether this is a sidecar, which has no pods to capture
+	sidecarMode bool
+	// Whether to serve the raw local sockets, for agents
+	serveSockets bool
+)
+
+// setLatestReport records the report of the most recent collection run.
+func setLatestReport(r *Report) {
+	latestMutex.Lock()
+	defer latestMutex.Unlock()
+	latest = r
+}
+
+// latestReport returns the report of the most recent collection run, or nil if none has completed.
+func latestReport() *Report {
+	latestMutex.Lock()
+	defer latestMutex.Unlock()
+	return latest
+}
+
+// serve runs the HTTP API until the process exits.
+func serve(addr string) {
+	fmt.Printf("Serving HTTP API on %s\n", addr)
+	if err := http.ListenAndServe(addr, apiMux()); err != nil {
+		fmt.Printf("HTTP server failed: %v\n", err)
+	}
+}
+
+// apiMux routes the HTTP API of this process: collector, sidecar or aggregator.
+func apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/api/v1/findings", handleFindings)
+	mux.HandleFunc("/api/v1/report", handleReport)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/api/v1/query", handlePromQuery)
+	mux.HandleFunc("/api/v1/query_range", handlePromQueryRange)
+	mux.HandleFunc("/api/v1/labels", handlePromLabels)
+	mux.HandleFunc("/api/v1/label/", handlePromLabels)
+	mux.HandleFunc("/api/v1/series", handlePromSeries)
+	if serveSockets {
+		mux.HandleFunc("/api/v1/sockets", handleSockets)
+	}
+	// Sidecars and the aggregator have no pods to capture or analyze rollouts of
+	if !sidecarMode && !*aggregatorMode {
+		mux.HandleFunc("/api/v1/rollout", handleRollout)
+		mux.HandleFunc("/api/v1/capture", handleCapture)
+		mux.HandleFunc("/api/v1/capture/alertmanager", handleCaptureAlertmanager)
+	}
+	if *aggregatorMode {
+		mux.HandleFunc("/api/v1/upload", handleUpload)
+		mux.HandleFunc("/api/v1/fleet", handleFleet)
+		mux.HandleFunc("/dashboard", handleDashboard)
+	}
+	return mux
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error writing response: %v\n", err)
+	}
+}
+
+// handleReport returns the summary of the most recent run, with peers anonymized for the API.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	report := latestReport()
+	if report == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no run has completed yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, summarize(report, sinkAPI))
+}
+
+// handleFindings returns the findings of the most recent run.
+func handleFindings(w http.ResponseWriter, r *http.Request) {
+	report := latestReport()
+	if report == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no run has completed yet"})
+		return
+	}
+	findings := report.Findings
+	if findings == nil {
+		findings = []Finding{}
+	}
+	writeJSON(w, http.StatusOK, findings)
+}
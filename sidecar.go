@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+const defaultSidecarInterval = 30 * time.Second
+
+// runSidecar is the sidecar command. Run as a container of the client pod, it shares the pod's network
+// namespace and reads the pod's own sockets, so it needs no exec permissions or RBAC at all. It serves
+// /metrics for the pod and, with -aggregator-url, uploads each run to the central aggregator. On an EC2
+// instance, with -serve-sockets, it is the agent behind -ec2-collect agent. As a pod container:
+//
+//	containers:
+//	  - name: check-conn
+//	    image: check-conn-script
+//	    args: ["-interval", "30s", "-target-port", "9280", "-aggregator-url", "http://check-conn-aggregator:8080", "sidecar"]
+//	    env:
+//	      - name: POD_NAME
+//	        valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//	      - name: POD_NAMESPACE
+//	        valueFrom: {fieldRef: {fieldPath: metadata.namespace}}
+//	      - name: NODE_NAME
+//	        valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//	    ports:
+//	      - {name: metrics, containerPort: 9281}
+func runSidecar(args []string) error {
+	fs := flag.NewFlagSet("sidecar", flag.ExitOnError)
+	addr := fs.String("listen", ":9281", "Serve /metrics and the HTTP API on this address")
+	sockets := fs.Bool("serve-sockets", false, "Serve the raw target port sockets on /api/v1/sockets, for -ec2-collect agent")
+	fs.Parse(args)
+
+	if *interval <= 0 {
+		*interval = defaultSidecarInterval
+	}
+	sidecarMode = true
+	serveSockets = *sockets
+	go serve(*addr)
+
+	fmt.Printf("Sidecar collecting every %v\n", *interval)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		report, err := collectLocal()
+		if err != nil {
+			fmt.Printf("Collection failed: %v\n", err)
+		} else if err := process(report); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
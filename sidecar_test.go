@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSidecarRoutes(t *testing.T) {
+	t.Cleanup(func() { sidecarMode, serveSockets = false, false })
+	routed := func(path string) bool {
+		_, pattern := apiMux().Handler(httptest.NewRequest("GET", path, nil))
+		return pattern != ""
+	}
+
+	sidecarMode, serveSockets = true, false
+	if routed("/api/v1/sockets") {
+		t.Errorf("sidecar serves raw sockets without -serve-sockets")
+	}
+	if routed("/api/v1/capture") {
+		t.Errorf("sidecar serves captures")
+	}
+	if routed("/api/v1/rollout") {
+		t.Errorf("sidecar serves rollout analysis")
+	}
+	if !routed("/metrics") {
+		t.Errorf("sidecar does not serve /metrics")
+	}
+
+	serveSockets = true
+	if !routed("/api/v1/sockets") {
+		t.Errorf("sidecar does not serve raw sockets with -serve-sockets")
+	}
+}
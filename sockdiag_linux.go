@@ -0,0 +1,222 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+)
+
+// From linux/sock_diag.h and linux/inet_diag.h
+const (
+	sockDiagByFamily = 20
+
+	inetDiagInfo         = 2
+	inetDiagReqBytecode  = 1
+	inetDiagBCJump       = 1
+	inetDiagBCSourceGE   = 2
+	inetDiagBCSourceLE   = 3
+	inetDiagBCDestGE     = 4
+	inetDiagBCDestLE     = 5
+	inetDiagReqV2Len     = 56
+	inetDiagMsgLen       = 72
+	sockDiagReceiveBytes = 64 << 10
+)
+
+// sockDiagSockets dumps the TCP sockets of the current network namespace over NETLINK_SOCK_DIAG. The kernel
+// only returns sockets in the given states (netstat notation) with either end on port, so the cost does
+// not grow with unrelated sockets. TCP_INFO comes along with each socket.
+func sockDiagSockets(port uint16, states []string) ([]Socket, error) {
+	var mask uint32
+	for _, state := range states {
+		found := false
+		for i, s := range procStates {
+			if s == state {
+				mask |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown socket state %q", state)
+		}
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	var sockets []Socket
+	buf := make([]byte, sockDiagReceiveBytes)
+	for i, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		seq := uint32(i + 1)
+		if err := syscall.Sendto(fd, sockDiagRequest(family, mask, port, seq), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+			return nil, os.NewSyscallError("sendto", err)
+		}
+		if sockets, err = receiveSockDiag(fd, seq, buf, sockets); err != nil {
+			return nil, err
+		}
+	}
+	return sockets, nil
+}
+
+// sockDiagRequest builds a dump request for one address family: a netlink header, an inet_diag_req_v2
+// and a bytecode filter accepting sockets whose source or destination port equals port.
+func sockDiagRequest(family uint8, states uint32, port uint16, seq uint32) []byte {
+	// A port comparison is two 4 byte ops: the comparison and the operand. Every op continues with the
+	// next one on yes and jumps on no. Reaching the end of the program accepts the socket, a jump 4 bytes
+	// past the end rejects it. The kernel only allows no-jumps to ops on the chain of yes-jumps, which is
+	// why the first branch ends in an unconditional jump rather than jumping straight to the end.
+	bytecode := []byte{}
+	op := func(code uint8, yes uint8, no uint16) {
+		bytecode = append(bytecode, code, yes)
+		bytecode = binary.NativeEndian.AppendUint16(bytecode, no)
+	}
+	portOp := func(code uint8, no uint16) {
+		op(code, 8, no)
+		op(0, 0, port)
+	}
+	portOp(inetDiagBCSourceGE, 20) // no: try the destination
+	portOp(inetDiagBCSourceLE, 12) // no: try the destination
+	op(inetDiagBCJump, 4, 20)      // source matched: accept
+	portOp(inetDiagBCDestGE, 20)   // no: reject
+	portOp(inetDiagBCDestLE, 12)   // no: reject
+
+	attrLen := 4 + len(bytecode)
+	msgLen := syscall.NLMSG_HDRLEN + inetDiagReqV2Len + attrLen
+	b := make([]byte, 0, msgLen)
+	b = binary.NativeEndian.AppendUint32(b, uint32(msgLen))
+	b = binary.NativeEndian.AppendUint16(b, sockDiagByFamily)
+	b = binary.NativeEndian.AppendUint16(b, syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	b = binary.NativeEndian.AppendUint32(b, seq)
+	b = binary.NativeEndian.AppendUint32(b, 0)
+
+	b = append(b, family, syscall.IPPROTO_TCP, 1<<(inetDiagInfo-1), 0)
+	b = binary.NativeEndian.AppendUint32(b, states)
+	b = append(b, make([]byte, 48)...) // inet_diag_sockid, unused for dumps
+
+	b = binary.NativeEndian.AppendUint16(b, uint16(attrLen))
+	b = binary.NativeEndian.AppendUint16(b, inetDiagReqBytecode)
+	return append(b, bytecode...)
+}
+
+// receiveSockDiag reads the reply to a dump request until NLMSG_DONE, appending the sockets.
+func receiveSockDiag(fd int, seq uint32, buf []byte, sockets []Socket) ([]Socket, error) {
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return sockets, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return nil, fmt.Errorf("sock_diag: %v", syscall.Errno(errno))
+					}
+				}
+				return sockets, nil
+			case sockDiagByFamily:
+				s, err := parseInetDiagMsg(m.Data)
+				if err != nil {
+					return nil, err
+				}
+				sockets = append(sockets, s)
+			}
+		}
+	}
+}
+
+// parseInetDiagMsg turns an inet_diag_msg and its attributes into a Socket.
+func parseInetDiagMsg(b []byte) (Socket, error) {
+	if len(b) < inetDiagMsgLen {
+		return Socket{}, fmt.Errorf("sock_diag: short message of %d bytes", len(b))
+	}
+	family, state := b[0], b[1]
+	if int(state) >= len(procStates) {
+		return Socket{}, fmt.Errorf("sock_diag: invalid socket state %d", state)
+	}
+	s := Socket{
+		Local:  diagAddrPort(family, b[4:6], b[8:24]),
+		Remote: diagAddrPort(family, b[6:8], b[24:40]),
+		State:  procStates[state],
+	}
+	if timer := b[2]; int(timer) < len(kernelTimers) {
+		s.Timer = kernelTimers[timer]
+	}
+
+	for attrs := b[inetDiagMsgLen:]; len(attrs) >= 4; {
+		attrLen := int(binary.NativeEndian.Uint16(attrs))
+		if attrLen < 4 || attrLen > len(attrs) {
+			break
+		}
+		if binary.NativeEndian.Uint16(attrs[2:]) == inetDiagInfo {
+			s.Info = parseKernelTCPInfo(attrs[4:attrLen])
+		}
+		attrs = attrs[min((attrLen+3)&^3, len(attrs)):]
+	}
+	return s, nil
+}
+
+// diagAddrPort decodes a big-endian port and address from an inet_diag_sockid.
+func diagAddrPort(family uint8, port, addr []byte) netip.AddrPort {
+	var a netip.Addr
+	if family == syscall.AF_INET {
+		a = netip.AddrFrom4([4]byte(addr[:4]))
+	} else {
+		a = netip.AddrFrom16([16]byte(addr)).Unmap()
+	}
+	return netip.AddrPortFrom(a, binary.BigEndian.Uint16(port))
+}
+
+// parseKernelTCPInfo decodes struct tcp_info from linux/tcp.h. Older kernels send a shorter struct, so
+// fields past the end are left zero.
+func parseKernelTCPInfo(b []byte) *TCPInfo {
+	u32 := func(off int) uint32 {
+		if off+4 > len(b) {
+			return 0
+		}
+		return binary.NativeEndian.Uint32(b[off:])
+	}
+	u64 := func(off int) uint64 {
+		if off+8 > len(b) {
+			return 0
+		}
+		return binary.NativeEndian.Uint64(b[off:])
+	}
+	ms := func(off int) time.Duration { return time.Duration(u32(off)) * time.Millisecond }
+	us := func(off int) time.Duration { return time.Duration(u32(off)) * time.Microsecond }
+
+	info := &TCPInfo{
+		LastSend:      ms(44),
+		LastRecv:      ms(52),
+		LastAck:       ms(56),
+		RTT:           us(68),
+		RTTVar:        us(72),
+		Cwnd:          int(u32(80)),
+		TotalRetrans:  int(u32(100)),
+		BytesAcked:    u64(120),
+		BytesReceived: u64(128),
+	}
+	if len(b) > 2 {
+		info.Retransmits = int(b[2])
+	}
+	return info
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// sockDiagSockets needs NETLINK_SOCK_DIAG, which only Linux has.
+func sockDiagSockets(port uint16, states []string) ([]Socket, error) {
+	return nil, fmt.Errorf("sock_diag is only available on Linux")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Socket is a single TCP socket as seen from inside a pod.
+type Socket struct {
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+	// State in netstat notation, e.g. ESTABLISHED or CLOSE_WAIT
+	State string
+	// TCP_INFO, when the collector gathers it
+	Info *TCPInfo
+	// Pending socket timer in ss notation (on, keepalive, timewait or persist), empty when none or unknown
+	Timer string
+}
+
+// Socket timers by the number /proc/net/tcp and sock_diag use, in ss notation
+var kernelTimers = []string{"", "on", "keepalive", "timewait", "persist"}
+
+// parseNetstat parses the output of `netstat -tn`. Header lines and lines that are not TCP sockets are skipped.
+func parseNetstat(out []byte) ([]Socket, error) {
+	var sockets []Socket
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "tcp") {
+			continue
+		}
+
+		local, err := parseAddrPort(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		remote, err := parseAddrPort(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, Socket{Local: local, Remote: remote, State: fields[5]})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseSS parses the output of `ss -tan`, translating its state names to netstat notation.
+// The TCP_INFO lines `ss -ti` adds are parsed too.
+func parseSS(out []byte) ([]Socket, error) {
+	var sockets []Socket
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// With -i, the TCP_INFO of a socket follows on an indented line
+		if strings.HasPrefix(line, "\t") || strings.HasPrefix(line, " ") {
+			if len(sockets) > 0 && sockets[len(sockets)-1].Info == nil && strings.TrimSpace(line) != "" {
+				sockets[len(sockets)-1].Info = parseSSInfo(line)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		// Without -t, ss prints the protocol first
+		if len(fields) > 0 && fields[0] == "tcp" {
+			fields = fields[1:]
+		}
+		if len(fields) < 5 {
+			continue
+		}
+		state, ok := ssStates[fields[0]]
+		if !ok {
+			continue
+		}
+
+		local, err := parseAddrPort(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		remote, err := parseAddrPort(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		s := Socket{Local: local, Remote: remote, State: state}
+		// With -o, the pending timer follows, e.g. "timer:(keepalive,119min,0)"
+		for _, f := range fields[5:] {
+			if timer, ok := strings.CutPrefix(f, "timer:("); ok {
+				s.Timer, _, _ = strings.Cut(timer, ",")
+			}
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, scanner.Err()
+}
+
+// checkSocketOutput rejects collector output without the header line netstat and ss always print, or that
+// ends mid-line, as garbled output or output cut off before or within a line does. Output cut off exactly
+// at the end of a line passes: it is a well-formed table that lists too few sockets.
+func checkSocketOutput(out []byte, header string) error {
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		return fmt.Errorf("output ends mid-line, it was cut short")
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 && fields[0] == header {
+			return nil
+		}
+	}
+	return fmt.Errorf("output has no %s header line", header)
+}
+
+// ss state names and their netstat equivalents
+var ssStates = map[string]string{
+	"ESTAB":      "ESTABLISHED",
+	"SYN-SENT":   "SYN_SENT",
+	"SYN-RECV":   "SYN_RECV",
+	"FIN-WAIT-1": "FIN_WAIT1",
+	"FIN-WAIT-2": "FIN_WAIT2",
+	"TIME-WAIT":  "TIME_WAIT",
+	"UNCONN":     "CLOSE",
+	"CLOSE-WAIT": "CLOSE_WAIT",
+	"LAST-ACK":   "LAST_ACK",
+	"LISTEN":     "LISTEN",
+	"CLOSING":    "CLOSING",
+}
+
+// parseProcNetTCP parses /proc/net/tcp or /proc/net/tcp6, whose addresses are hex in host byte order.
+func parseProcNetTCP(out []byte) ([]Socket, error) {
+	var sockets []Socket
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "sl" {
+			continue
+		}
+
+		local, err := parseHexAddrPort(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		remote, err := parseHexAddrPort(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		st, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil || int(st) >= len(procStates) {
+			return nil, fmt.Errorf("invalid socket state %q", fields[3])
+		}
+		s := Socket{Local: local, Remote: remote, State: procStates[st]}
+		// tr:tm->when, where tr is the pending timer
+		if len(fields) > 5 {
+			if tr, err := strconv.ParseUint(strings.SplitN(fields[5], ":", 2)[0], 16, 8); err == nil && int(tr) < len(kernelTimers) {
+				s.Timer = kernelTimers[tr]
+			}
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, scanner.Err()
+}
+
+// Kernel TCP states by number, in netstat notation
+var procStates = []string{
+	"UNKNOWN", "ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING", "SYN_RECV",
+}
+
+// parseHexAddrPort parses "0100007F:1F90" (IPv4) or a 32 hex digit IPv6 address with a port. Each 32-bit
+// word of the address is in host byte order, which is little endian on every platform we run on.
+func parseHexAddrPort(s string) (netip.AddrPort, error) {
+	hexAddr, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port in %q", s)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// parseSocketDump detects whether a dump is /proc/net/tcp, `ss -tan` or `netstat -tn` output and parses it.
+func parseSocketDump(out []byte) ([]Socket, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "sl":
+			return parseProcNetTCP(out)
+		case fields[0] == "State" || fields[0] == "Netid" || ssStates[fields[0]] != "":
+			return parseSS(out)
+		case fields[0] == "Active" || fields[0] == "Proto" || strings.HasPrefix(fields[0], "tcp"):
+			return parseNetstat(out)
+		}
+		return nil, fmt.Errorf("unrecognized socket dump, expected /proc/net/tcp, ss -tan or netstat -tn output")
+	}
+	return nil, nil
+}
+
+// parseAddrPort parses "10.0.0.1:9280", "::ffff:10.0.0.1:9280", "[::1]:9280" or the "0.0.0.0:*" and "*:*"
+// that listeners show. IPv4-mapped IPv6 addresses are unmapped so the same peer looks the same over either stack.
+func parseAddrPort(s string) (netip.AddrPort, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(s[:i], "["), "]")
+	if j := strings.Index(host, "%"); j >= 0 {
+		host = host[:j]
+	}
+	addr := netip.IPv4Unspecified()
+	if host != "*" {
+		var err error
+		if addr, err = netip.ParseAddr(host); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid address %q: %v", s, err)
+		}
+	}
+	var port uint64
+	if p := s[i+1:]; p != "*" {
+		var err error
+		if port, err = strconv.ParseUint(p, 10, 16); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid port in %q: %v", s, err)
+		}
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// matchesTargetPort reports whether either end of the socket is on the target port.
+func matchesTargetPort(s Socket) bool {
+	port := strconv.Itoa(int(s.Local.Port()))
+	if port == *targetPort {
+		return true
+	}
+	return strconv.Itoa(int(s.Remote.Port())) == *targetPort
+}
+
+// newPodResult counts a pod's sockets into its result.
+func newPodResult(t Target, sockets []Socket) PodResult {
+	count, states := countSockets(sockets)
+	return PodResult{
+		Target:  t,
+		Count:   count,
+		States:  states,
+		Sockets: sockets,
+		TCPInfo: summarizeTCPInfo(sockets),
+		Clients: clientSketch(sockets),
+	}
+}
+
+// countRule is the counting rule that decided a socket.
+type countRule int
+
+const (
+	// On the target port and ESTABLISHED: counted
+	ruleCounted countRule = iota
+	// Neither end on the target port
+	rulePort
+	// On the target port but not ESTABLISHED
+	ruleState
+)
+
+// socketRule decides whether a socket counts toward client_tcp_new. countSockets and explain both go
+// through it, so an explanation always matches the count.
+func socketRule(s Socket) countRule {
+	switch {
+	case !matchesTargetPort(s):
+		return rulePort
+	case s.State != "ESTABLISHED":
+		return ruleState
+	}
+	return ruleCounted
+}
+
+// countSockets returns the number of established connections on the target port, which is what
+// client_tcp_new counts, and the number of target port sockets in each state.
+func countSockets(sockets []Socket) (int, map[string]int) {
+	var count int
+	states := make(map[string]int)
+	for _, s := range sockets {
+		rule := socketRule(s)
+		if rule == rulePort {
+			continue
+		}
+		states[s.State]++
+		if rule == ruleCounted {
+			count++
+		}
+	}
+	return count, states
+}
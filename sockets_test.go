@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCheckSocketOutput(t *testing.T) {
+	netstat := "Active Internet connections (w/o servers)\nProto Recv-Q Send-Q Local Address Foreign Address State\ntcp 0 0 10.0.0.1:9280 10.1.0.5:51234 ESTABLISHED\n"
+	tests := []struct {
+		name, out, header string
+		ok                bool
+	}{
+		{"netstat", netstat, "Proto", true},
+		// Indistinguishable from a table cut right after the header
+		{"netstat without sockets", "Active Internet connections (w/o servers)\nProto Recv-Q Send-Q Local Address Foreign Address State\n", "Proto", true},
+		{"ss", "State Recv-Q Send-Q Local Address:Port Peer Address:Port\nESTAB 0 0 10.0.0.1:9280 10.1.0.5:51234\n", "State", true},
+		{"cut mid-line", netstat[:len(netstat)-20], "Proto", false},
+		{"cut before the header", "Active Internet connections (w/o servers)\n", "Proto", false},
+		{"empty", "", "Proto", false},
+		{"garbage", "\x8f\x01\xfe\nq\x00\n", "Proto", false},
+	}
+	for _, tt := range tests {
+		if err := checkSocketOutput([]byte(tt.out), tt.header); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestChaosTruncateFailsCheck(t *testing.T) {
+	saved := chaosRand
+	chaosRand = rand.New(rand.NewSource(1))
+	t.Cleanup(func() { chaosRand = saved })
+
+	netstat := []byte("Active Internet connections (w/o servers)\nProto Recv-Q Send-Q Local Address Foreign Address State\n" +
+		"tcp 0 0 10.0.0.1:9280 10.1.0.5:51234 ESTABLISHED\ntcp 0 0 10.0.0.1:9280 10.1.0.6:51234 ESTABLISHED\n")
+	for i := 0; i < 1000; i++ {
+		out := chaosOutput("truncate", netstat)
+		if len(out) == len(netstat) {
+			t.Fatalf("truncate left the output whole")
+		}
+		if err := checkSocketOutput(out, "Proto"); err == nil {
+			t.Fatalf("output truncated to %q passes the check", out)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	collectTCPInfo = flag.Bool("tcp-info", false, "Collect TCP_INFO (RTT, retransmits, cwnd, idle time) and socket timers for each connection with `ss -tino` instead of netstat")
+	idleAfter      = flag.Duration("idle-after", 5*time.Minute, "Count a connection as idle when nothing was sent or received for this long")
+)
+
+// TCPInfo is the kernel's TCP_INFO for one connection, as reported by `ss -ti` or sock_diag.
+type TCPInfo struct {
+	RTT    time.Duration
+	RTTVar time.Duration
+	// Retransmits of the segment currently in flight, and over the connection's lifetime
+	Retransmits   int
+	TotalRetrans  int
+	Cwnd          int
+	BytesAcked    uint64
+	BytesReceived uint64
+	// Time since data was last sent, received and acknowledged
+	LastSend time.Duration
+	LastRecv time.Duration
+	LastAck  time.Duration
+}
+
+// parseSSInfo parses the indented detail line `ss -ti` prints under each socket, e.g.
+// "cubic wscale:7,7 rto:204 rtt:0.75/0.375 cwnd:10 bytes_acked:124 retrans:0/2 lastsnd:1234 ...".
+func parseSSInfo(line string) *TCPInfo {
+	info := &TCPInfo{}
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "rtt":
+			avg, variance, _ := strings.Cut(value, "/")
+			info.RTT = parseMillis(avg)
+			info.RTTVar = parseMillis(variance)
+		case "retrans":
+			cur, total, _ := strings.Cut(value, "/")
+			info.Retransmits, _ = strconv.Atoi(cur)
+			info.TotalRetrans, _ = strconv.Atoi(total)
+		case "cwnd":
+			info.Cwnd, _ = strconv.Atoi(value)
+		case "bytes_acked":
+			info.BytesAcked, _ = strconv.ParseUint(value, 10, 64)
+		case "bytes_received":
+			info.BytesReceived, _ = strconv.ParseUint(value, 10, 64)
+		case "lastsnd":
+			info.LastSend = parseMillis(value)
+		case "lastrcv":
+			info.LastRecv = parseMillis(value)
+		case "lastack":
+			info.LastAck = parseMillis(value)
+		}
+	}
+	return info
+}
+
+// parseMillis parses a possibly fractional number of milliseconds.
+func parseMillis(s string) time.Duration {
+	ms, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// tcpInfoStats summarizes the TCP_INFO of a pod's established target port connections.
+type tcpInfoStats struct {
+	Connections int     `json:"connections"`
+	RTTP50      float64 `json:"rttP50Seconds"`
+	RTTP90      float64 `json:"rttP90Seconds"`
+	RTTP99      float64 `json:"rttP99Seconds"`
+	RTTMax      float64 `json:"rttMaxSeconds"`
+	// Connections that have retransmitted at least once, retransmits summed over all connections and the
+	// 99th percentile of retransmits per connection
+	RetransConnections int     `json:"retransConnections"`
+	TotalRetrans       int     `json:"totalRetrans"`
+	RetransP99         int     `json:"retransP99"`
+	MeanCwnd           float64 `json:"meanCwnd"`
+	// Connections with nothing sent or received for -idle-after, all of them and those without a
+	// keepalive timer, and the distribution of how long they have been idle
+	Idle            int     `json:"idle"`
+	IdleNoKeepalive int     `json:"idleNoKeepalive"`
+	IdleP50         float64 `json:"idleP50Seconds,omitempty"`
+	IdleP90         float64 `json:"idleP90Seconds,omitempty"`
+	IdleMax         float64 `json:"idleMaxSeconds,omitempty"`
+}
+
+// Connection activity classes
+const (
+	activityActive          = "active"
+	activityIdle            = "idle"
+	activityIdleNoKeepalive = "idle_no_keepalive"
+)
+
+// idleFor is how long the connection has neither sent nor received data.
+func idleFor(info *TCPInfo) time.Duration {
+	return min(info.LastSend, info.LastRecv)
+}
+
+// activity classifies a connection with TCP_INFO. An idle connection without a pending keepalive timer
+// is one the kernel will never probe, so a vanished peer leaves it open until the application closes it.
+func activity(s Socket) string {
+	if idleFor(s.Info) < *idleAfter {
+		return activityActive
+	}
+	if s.Timer == "keepalive" {
+		return activityIdle
+	}
+	return activityIdleNoKeepalive
+}
+
+// summarizeTCPInfo computes the per-pod distributions, or returns nil when no socket carries TCP_INFO.
+func summarizeTCPInfo(sockets []Socket) *tcpInfoStats {
+	var rtts, idle []time.Duration
+	var retrans []int
+	stats := &tcpInfoStats{}
+	var cwnd int
+	for _, s := range sockets {
+		if s.Info == nil || s.State != "ESTABLISHED" || !matchesTargetPort(s) {
+			continue
+		}
+		stats.Connections++
+		rtts = append(rtts, s.Info.RTT)
+		retrans = append(retrans, s.Info.TotalRetrans)
+		if s.Info.TotalRetrans > 0 {
+			stats.RetransConnections++
+		}
+		stats.TotalRetrans += s.Info.TotalRetrans
+		cwnd += s.Info.Cwnd
+		if a := activity(s); a != activityActive {
+			stats.Idle++
+			if a == activityIdleNoKeepalive {
+				stats.IdleNoKeepalive++
+			}
+			idle = append(idle, idleFor(s.Info))
+		}
+	}
+	if stats.Connections == 0 {
+		return nil
+	}
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	sort.Ints(retrans)
+	stats.RTTP50 = quantile(rtts, 0.5).Seconds()
+	stats.RTTP90 = quantile(rtts, 0.9).Seconds()
+	stats.RTTP99 = quantile(rtts, 0.99).Seconds()
+	stats.RTTMax = rtts[len(rtts)-1].Seconds()
+	stats.RetransP99 = retrans[int(0.99*float64(len(retrans)-1)+0.5)]
+	stats.MeanCwnd = float64(cwnd) / float64(stats.Connections)
+	if len(idle) > 0 {
+		sort.Slice(idle, func(i, j int) bool { return idle[i] < idle[j] })
+		stats.IdleP50 = quantile(idle, 0.5).Seconds()
+		stats.IdleP90 = quantile(idle, 0.9).Seconds()
+		stats.IdleMax = idle[len(idle)-1].Seconds()
+	}
+	return stats
+}
+
+// quantile returns the q-quantile of sorted values, by the nearest-rank method.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	return sorted[int(q*float64(len(sorted)-1)+0.5)]
+}
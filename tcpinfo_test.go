@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSummarizeTCPInfoRetransP99(t *testing.T) {
+	var sockets []Socket
+	for i := 0; i < 100; i++ {
+		sockets = append(sockets, Socket{
+			Local:  netip.MustParseAddrPort("10.0.0.1:" + *targetPort),
+			Remote: netip.MustParseAddrPort(fmt.Sprintf("10.1.0.%d:51234", i+1)),
+			State:  "ESTABLISHED",
+			Info:   &TCPInfo{RTT: time.Millisecond, TotalRetrans: i, LastSend: time.Second, LastRecv: time.Second},
+		})
+	}
+	stats := summarizeTCPInfo(sockets)
+	if stats.RetransP99 != 98 {
+		t.Errorf("RetransP99 = %d, want 98", stats.RetransP99)
+	}
+
+	m := newMetricWriter()
+	m.addTCPInfo(stats, map[string]string{"pod": "client-a-1"})
+	found := false
+	for _, s := range m.samples() {
+		if s.Name == "client_tcp_pod_retrans_per_connection" {
+			found = s.Labels["quantile"] == "0.99" && s.Value == 98
+		}
+	}
+	if !found {
+		t.Errorf("no client_tcp_pod_retrans_per_connection{quantile=\"0.99\"} 98 sample")
+	}
+}
+
+func TestFormatIdle(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0s"},
+		{0.9, "900ms"},
+		{1.25, "1.3s"},
+		{312.04, "5m12s"},
+	}
+	for _, tt := range tests {
+		if got := formatIdle(tt.seconds); got != tt.want {
+			t.Errorf("formatIdle(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	setFlag(t, idleAfter, time.Minute)
+	tests := []struct {
+		name               string
+		lastSend, lastRecv time.Duration
+		timer, want        string
+	}{
+		{"busy", time.Second, time.Second, "", activityActive},
+		{"just under the threshold", time.Minute - time.Millisecond, time.Hour, "", activityActive},
+		{"at the threshold", time.Minute, time.Minute, "keepalive", activityIdle},
+		// Either direction carrying data keeps the connection active
+		{"only receiving", time.Hour, time.Second, "", activityActive},
+		{"only sending", time.Second, time.Hour, "", activityActive},
+		{"idle with keepalive", time.Hour, time.Hour, "keepalive", activityIdle},
+		{"idle without a timer", time.Hour, time.Hour, "", activityIdleNoKeepalive},
+		{"idle with a retransmit timer", time.Hour, time.Hour, "on", activityIdleNoKeepalive},
+	}
+	for _, tt := range tests {
+		s := Socket{State: "ESTABLISHED", Timer: tt.timer, Info: &TCPInfo{LastSend: tt.lastSend, LastRecv: tt.lastRecv}}
+		if got := activity(s); got != tt.want {
+			t.Errorf("%s: activity = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeTCPInfoIdle(t *testing.T) {
+	setFlag(t, idleAfter, time.Minute)
+	out := "State Recv-Q Send-Q Local Address:Port Peer Address:Port\n" +
+		"ESTAB 0 0 10.0.0.1:" + *targetPort + " 10.1.0.1:40000 timer:(keepalive,119min,0)\n" +
+		"\t cubic rtt:1/0.5 cwnd:10 lastsnd:90000 lastrcv:120000 lastack:90000\n" +
+		"ESTAB 0 0 10.0.0.1:" + *targetPort + " 10.1.0.2:40001\n" +
+		"\t cubic rtt:1/0.5 cwnd:10 lastsnd:600000 lastrcv:600000 lastack:600000\n" +
+		"ESTAB 0 0 10.0.0.1:" + *targetPort + " 10.1.0.3:40002\n" +
+		"\t cubic rtt:1/0.5 cwnd:10 lastsnd:59999 lastrcv:3600000 lastack:59999\n" +
+		"ESTAB 0 0 10.0.0.1:8080 10.1.0.4:40003\n" +
+		"\t cubic rtt:1/0.5 cwnd:10 lastsnd:600000 lastrcv:600000 lastack:600000\n"
+	sockets, err := parseSS([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := summarizeTCPInfo(sockets)
+	if stats.Connections != 3 || stats.Idle != 2 || stats.IdleNoKeepalive != 1 {
+		t.Errorf("connections %d, idle %d, idle without keepalive %d, want 3, 2 and 1", stats.Connections, stats.Idle, stats.IdleNoKeepalive)
+	}
+	if stats.IdleMax != 600 {
+		t.Errorf("idle max %vs, want 600s", stats.IdleMax)
+	}
+}
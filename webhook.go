@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pod annotations the webhook reads and sets
+const (
+	annotationInject        = "check-conn.io/inject"
+	annotationInjected      = "check-conn.io/injected"
+	annotationPort          = "check-conn.io/port"
+	annotationTargetPort    = "check-conn.io/target-port"
+	annotationInterval      = "check-conn.io/interval"
+	annotationAggregatorURL = "check-conn.io/aggregator-url"
+	annotationImage         = "check-conn.io/image"
+	annotationArgs          = "check-conn.io/args"
+
+	sidecarContainerName = "check-conn"
+	maxAdmissionSize     = 4 << 20
+	// How long a generated serving certificate is valid
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// admissionReview is the admission.k8s.io/v1 AdmissionReview, with only the fields the webhook uses.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Namespace string          `json:"namespace,omitempty"`
+	Operation string          `json:"operation,omitempty"`
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       string            `json:"uid"`
+	Allowed   bool              `json:"allowed"`
+	PatchType string            `json:"patchType,omitempty"`
+	Patch     []byte            `json:"patch,omitempty"`
+	Warnings  []string          `json:"warnings,omitempty"`
+	Result    map[string]string `json:"status,omitempty"`
+}
+
+// admissionPod is the part of a pod the webhook reads.
+type admissionPod struct {
+	Metadata struct {
+		Name         string            `json:"name,omitempty"`
+		GenerateName string            `json:"generateName,omitempty"`
+		Annotations  map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// webhookOptions are the defaults for injected sidecars; pod annotations override them.
+type webhookOptions struct {
+	Image         string
+	Port          string
+	TargetPort    string
+	Interval      string
+	AggregatorURL string
+}
+
+// mutatePod decides the patch for one pod. Pods without the opt-in annotation, and pods that already
+// have the sidecar, are left alone.
+func mutatePod(raw []byte, opts webhookOptions) ([]jsonPatchOp, error) {
+	var pod admissionPod
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		return nil, fmt.Errorf("invalid pod: %v", err)
+	}
+	annotations := pod.Metadata.Annotations
+	if annotations[annotationInject] != "true" || annotations[annotationInjected] == "true" {
+		return nil, nil
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == sidecarContainerName {
+			return nil, nil
+		}
+	}
+
+	if v := annotations[annotationImage]; v != "" {
+		opts.Image = v
+	}
+	if v := annotations[annotationPort]; v != "" {
+		opts.Port = v
+	}
+	if v := annotations[annotationTargetPort]; v != "" {
+		opts.TargetPort = v
+	}
+	if v := annotations[annotationInterval]; v != "" {
+		opts.Interval = v
+	}
+	if v := annotations[annotationAggregatorURL]; v != "" {
+		opts.AggregatorURL = v
+	}
+	port, err := parsePort(opts.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", annotationPort, err)
+	}
+	if _, err := parsePort(opts.TargetPort); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", annotationTargetPort, err)
+	}
+	if _, err := time.ParseDuration(opts.Interval); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", annotationInterval, err)
+	}
+
+	// Global flags go before the command
+	args := []string{"-interval", opts.Interval, "-target-port", opts.TargetPort}
+	if opts.AggregatorURL != "" {
+		args = append(args, "-aggregator-url", opts.AggregatorURL)
+	}
+	args = append(args, strings.Fields(annotations[annotationArgs])...)
+	args = append(args, "sidecar", "-listen", fmt.Sprintf(":%d", port))
+
+	fieldEnv := func(name, path string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":      name,
+			"valueFrom": map[string]interface{}{"fieldRef": map[string]string{"fieldPath": path}},
+		}
+	}
+	container := map[string]interface{}{
+		"name":  sidecarContainerName,
+		"image": opts.Image,
+		"args":  args,
+		"env": []interface{}{
+			fieldEnv("POD_NAME", "metadata.name"),
+			fieldEnv("POD_NAMESPACE", "metadata.namespace"),
+			fieldEnv("POD_IP", "status.podIP"),
+			fieldEnv("NODE_NAME", "spec.nodeName"),
+		},
+		"ports": []interface{}{map[string]interface{}{"name": "conn-metrics", "containerPort": port}},
+		"resources": map[string]interface{}{
+			"requests": map[string]string{"cpu": "10m", "memory": "32Mi"},
+			"limits":   map[string]string{"memory": "128Mi"},
+		},
+		"securityContext": map[string]interface{}{
+			"allowPrivilegeEscalation": false,
+			"readOnlyRootFilesystem":   true,
+			"runAsNonRoot":             true,
+			"runAsUser":                65534,
+		},
+	}
+
+	patch := []jsonPatchOp{{Op: "add", Path: "/spec/containers/-", Value: container}}
+	if annotations == nil {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: "/metadata/annotations", Value: map[string]string{annotationInjected: "true"}})
+	} else {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(annotationInjected), Value: "true"})
+	}
+	return patch, nil
+}
+
+func parsePort(s string) (int, error) {
+	var port int
+	if _, err := fmt.Sscanf(s, "%d", &port); err != nil || port <= 0 || port > 65535 || fmt.Sprint(port) != s {
+		return 0, fmt.Errorf("%q is not a port", s)
+	}
+	return port, nil
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// review answers an AdmissionReview. It fails open: a pod the webhook cannot handle is admitted
+// unchanged with a warning, so a webhook bug never blocks deployments.
+func review(body []byte, opts webhookOptions) (admissionReview, error) {
+	var in admissionReview
+	if err := json.Unmarshal(body, &in); err != nil {
+		return admissionReview{}, fmt.Errorf("invalid AdmissionReview: %v", err)
+	}
+	if in.Request == nil {
+		return admissionReview{}, fmt.Errorf("AdmissionReview has no request")
+	}
+
+	resp := &admissionResponse{UID: in.Request.UID, Allowed: true}
+	patch, err := mutatePod(in.Request.Object, opts)
+	switch {
+	case err != nil:
+		fmt.Printf("Not injecting into pod in %s: %v\n", in.Request.Namespace, err)
+		resp.Warnings = []string{"check-conn sidecar not injected: " + err.Error()}
+	case patch != nil:
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return admissionReview{}, err
+		}
+		resp.PatchType = "JSONPatch"
+		resp.Patch = data
+	}
+	return admissionReview{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview", Response: resp}, nil
+}
+
+func handleMutate(opts webhookOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAdmissionSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out, err := review(body, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// certReloader serves the certificate in the key pair files, reloading it when they change on disk,
+// as they do when cert-manager or a Secret update rotates them.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert == nil || info.ModTime() != c.modTime {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			if c.cert != nil {
+				fmt.Printf("Keeping previous certificate, reload failed: %v\n", err)
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		fmt.Printf("Loaded serving certificate %s\n", c.certFile)
+		c.cert, c.modTime = &cert, info.ModTime()
+	}
+	return c.cert, nil
+}
+
+// selfSignedCert generates a serving certificate for the webhook Service's DNS names, returning the
+// certificate and key PEM. The certificate doubles as the caBundle of the webhook configuration.
+func selfSignedCert(dnsNames []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// sharedSelfSignedCert returns the certificate in the kubernetes.io/tls Secret, creating the Secret with a
+// newly generated certificate when it does not exist yet. Replicas starting together race to create it;
+// the losers use the winner's, so all of them serve the one certificate in the caBundle.
+func sharedSelfSignedCert(secret, ns string, dnsNames []string) (certPEM, keyPEM []byte, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		out, err := runCommand("discovery", kubectl("get", "secret", "-n", ns, secret, "-o", "json"))
+		if err == nil {
+			var s struct {
+				Data map[string][]byte `json:"data"`
+			}
+			if err := json.Unmarshal(out, &s); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse Secret %s/%s: %v", ns, secret, err)
+			}
+			if len(s.Data["tls.crt"]) == 0 || len(s.Data["tls.key"]) == 0 {
+				return nil, nil, fmt.Errorf("Secret %s/%s has no tls.crt and tls.key", ns, secret)
+			}
+			return s.Data["tls.crt"], s.Data["tls.key"], nil
+		}
+		if !strings.Contains(commandStderr(err), "NotFound") {
+			return nil, nil, fmt.Errorf("failed to get Secret %s/%s: %v: %s", ns, secret, err, commandStderr(err))
+		}
+
+		if certPEM, keyPEM, err = selfSignedCert(dnsNames); err != nil {
+			return nil, nil, err
+		}
+		manifest, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"type":       "kubernetes.io/tls",
+			"metadata":   map[string]string{"name": secret, "namespace": ns},
+			"data":       map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd := kubectl("create", "-f", "-")
+		cmd.Stdin = bytes.NewReader(manifest)
+		if _, err := runCommand("sink", cmd); err != nil {
+			if strings.Contains(commandStderr(err), "AlreadyExists") {
+				// Another replica created it first
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to create Secret %s/%s: %v: %s", ns, secret, err, commandStderr(err))
+		}
+		fmt.Printf("Stored self-signed certificate in Secret %s/%s\n", ns, secret)
+		return certPEM, keyPEM, nil
+	}
+	return nil, nil, fmt.Errorf("Secret %s/%s was created but cannot be read", ns, secret)
+}
+
+// patchCABundle points every webhook of the MutatingWebhookConfiguration at the given CA. It adds caBundle,
+// which overwrites one that is set; a replace would fail on the output of `webhook manifest`, which has none.
+func patchCABundle(config string, caPEM []byte) error {
+	out, err := runCommand("discovery", kubectl("get", "mutatingwebhookconfiguration", config, "-o", "json"))
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %v: %s", config, err, commandStderr(err))
+	}
+	var cfg struct {
+		Webhooks []json.RawMessage `json:"webhooks"`
+	}
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		return err
+	}
+	var patch []jsonPatchOp
+	for i := range cfg.Webhooks {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i), Value: base64.StdEncoding.EncodeToString(caPEM)})
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	cmd := kubectl("patch", "mutatingwebhookconfiguration", config, "--type=json", "-p", string(data))
+	if _, err := runCommand("sink", cmd); err != nil {
+		return fmt.Errorf("failed to patch %s: %v: %s", config, err, commandStderr(err))
+	}
+	fmt.Printf("Updated caBundle of %s\n", config)
+	return nil
+}
+
+// webhookManifest is the MutatingWebhookConfiguration for the webhook Service. failurePolicy Ignore
+// keeps pods admitted while the webhook is down.
+func webhookManifest(name, service, serviceNamespace string, caPEM []byte) map[string]interface{} {
+	clientConfig := map[string]interface{}{
+		"service": map[string]interface{}{"name": service, "namespace": serviceNamespace, "path": "/mutate"},
+	}
+	if caPEM != nil {
+		clientConfig["caBundle"] = base64.StdEncoding.EncodeToString(caPEM)
+	}
+	return map[string]interface{}{
+		"apiVersion": "admissionregistration.k8s.io/v1",
+		"kind":       "MutatingWebhookConfiguration",
+		"metadata":   map[string]string{"name": name},
+		"webhooks": []interface{}{map[string]interface{}{
+			"name":                    "inject.check-conn.io",
+			"admissionReviewVersions": []string{"v1"},
+			"sideEffects":             "None",
+			"failurePolicy":           "Ignore",
+			"timeoutSeconds":          5,
+			"reinvocationPolicy":      "IfNeeded",
+			"clientConfig":            clientConfig,
+			"rules": []interface{}{map[string]interface{}{
+				"operations":  []string{"CREATE"},
+				"apiGroups":   []string{""},
+				"apiVersions": []string{"v1"},
+				"resources":   []string{"pods"},
+			}},
+		}},
+	}
+}
+
+// runWebhook is the webhook command, the mutating admission webhook that injects the sidecar into pods
+// annotated with check-conn.io/inject: "true":
+//
+//	check-conn-script webhook [-tls-cert tls.crt -tls-key tls.key] [-listen :8443]
+//	check-conn-script webhook manifest    print the MutatingWebhookConfiguration
+//	check-conn-script webhook review f    answer the AdmissionReview in file f, e.g. a fixture in testdata/webhook
+//
+// Without -tls-cert it generates a self-signed certificate for the Service and, with -webhook-config,
+// patches it into the configuration's caBundle. Replicas each generate their own certificate and would
+// overwrite each other's caBundle, so run more than one replica only with -tls-cert or -tls-secret, which
+// shares one generated certificate through a Secret.
+func runWebhook(args []string) error {
+	fs := flag.NewFlagSet("webhook", flag.ExitOnError)
+	addr := fs.String("listen", ":8443", "Serve the webhook over HTTPS on this address")
+	certFile := fs.String("tls-cert", "", "Serving certificate, reloaded when it changes (default: generate a self-signed one)")
+	keyFile := fs.String("tls-key", "", "Key of -tls-cert")
+	service := fs.String("service", "check-conn-webhook", "Name of the webhook's Service")
+	serviceNamespace := fs.String("service-namespace", namespace, "Namespace of the webhook's Service")
+	config := fs.String("webhook-config", "", "MutatingWebhookConfiguration whose caBundle to set to the self-signed certificate")
+	tlsSecret := fs.String("tls-secret", "", "Share the self-signed certificate between replicas through this Secret in -service-namespace, creating it if needed (without it, run a single replica)")
+	opts := webhookOptions{}
+	fs.StringVar(&opts.Image, "image", "check-conn-script:latest", "Image of the injected sidecar")
+	fs.StringVar(&opts.Port, "port", "9281", "Metrics port of the injected sidecar")
+	fs.StringVar(&opts.TargetPort, "sidecar-target-port", *targetPort, "Port whose connections the injected sidecar counts")
+	fs.StringVar(&opts.Interval, "sidecar-interval", "30s", "Collection interval of the injected sidecar")
+	fs.StringVar(&opts.AggregatorURL, "sidecar-aggregator-url", "", "Aggregator the injected sidecars upload to")
+	fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "manifest":
+		data, err := json.MarshalIndent(webhookManifest("check-conn-injector", *service, *serviceNamespace, nil), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case "review":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: webhook review <admission-review.json>")
+		}
+		body, err := os.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		out, err := review(body, opts)
+		if err != nil {
+			return err
+		}
+		if out.Response.Patch != nil {
+			// Show the patch readably rather than base64 encoded
+			var patch interface{}
+			json.Unmarshal(out.Response.Patch, &patch)
+			data, _ := json.MarshalIndent(map[string]interface{}{"uid": out.Response.UID, "allowed": out.Response.Allowed, "patch": patch}, "", "  ")
+			fmt.Println(string(data))
+			return nil
+		}
+		data, _ := json.MarshalIndent(out.Response, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("unknown webhook command %q", fs.Arg(0))
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *certFile != "" {
+		reloader := &certReloader{certFile: *certFile, keyFile: *keyFile}
+		if _, err := reloader.GetCertificate(nil); err != nil {
+			return fmt.Errorf("failed to load certificate: %v", err)
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	} else {
+		host := *service + "." + *serviceNamespace + ".svc"
+		dnsNames := []string{host, host + ".cluster.local", *service + "." + *serviceNamespace, *service}
+		var caPEM, keyPEM []byte
+		var err error
+		if *tlsSecret != "" {
+			caPEM, keyPEM, err = sharedSelfSignedCert(*tlsSecret, *serviceNamespace, dnsNames)
+		} else {
+			caPEM, keyPEM, err = selfSignedCert(dnsNames)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to generate certificate: %v", err)
+		}
+		cert, err := tls.X509KeyPair(caPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		fmt.Printf("Serving self-signed certificate for %s\n", host)
+		if *config != "" {
+			if err := patchCABundle(*config, caPEM); err != nil {
+				return err
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", handleMutate(opts))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	server := &http.Server{Addr: *addr, Handler: mux, TLSConfig: tlsConfig, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("Serving admission webhook on %s\n", *addr)
+	return server.ListenAndServeTLS("", "")
+}
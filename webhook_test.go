@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mutateFixture posts an AdmissionReview fixture from testdata/webhook to the webhook handler.
+func mutateFixture(t *testing.T, name string) *admissionResponse {
+	t.Helper()
+	body, err := os.ReadFile("testdata/webhook/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := webhookOptions{Image: "check-conn-script:test", Port: "9281", TargetPort: "9280", Interval: "30s"}
+	rec := httptest.NewRecorder()
+	handleMutate(opts)(rec, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", name, rec.Code, rec.Body)
+	}
+	var out admissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Response == nil || !out.Response.Allowed {
+		t.Fatalf("%s: pod not admitted: %+v", name, out.Response)
+	}
+	return out.Response
+}
+
+func TestWebhookInject(t *testing.T) {
+	resp := mutateFixture(t, "inject.json")
+	if resp.UID != "7f0b2891-916f-4ed6-b7cd-27bff1815a8c" {
+		t.Errorf("UID = %q", resp.UID)
+	}
+	if resp.PatchType != "JSONPatch" {
+		t.Fatalf("PatchType = %q, want JSONPatch", resp.PatchType)
+	}
+	var patch []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 2 {
+		t.Fatalf("got %d patch operations, want 2: %s", len(patch), resp.Patch)
+	}
+	if patch[0].Op != "add" || patch[0].Path != "/spec/containers/-" {
+		t.Errorf("first operation = %s %s, want add /spec/containers/-", patch[0].Op, patch[0].Path)
+	}
+	var container struct {
+		Name  string   `json:"name"`
+		Image string   `json:"image"`
+		Args  []string `json:"args"`
+		Ports []struct {
+			ContainerPort int `json:"containerPort"`
+		} `json:"ports"`
+	}
+	if err := json.Unmarshal(patch[0].Value, &container); err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := []string{"-interval", "1m", "-target-port", "9443", "-aggregator-url", "http://check-conn-aggregator.monitoring:8080", "sidecar", "-listen", ":9300"}
+	if container.Name != sidecarContainerName || container.Image != "check-conn-script:test" || !reflect.DeepEqual(container.Args, wantArgs) {
+		t.Errorf("container = %+v, want args %v", container, wantArgs)
+	}
+	if len(container.Ports) != 1 || container.Ports[0].ContainerPort != 9300 {
+		t.Errorf("ports = %+v, want 9300 from the annotation", container.Ports)
+	}
+	if patch[1].Op != "add" || patch[1].Path != "/metadata/annotations/check-conn.io~1injected" || string(patch[1].Value) != `"true"` {
+		t.Errorf("second operation = %s %s %s, want the injected annotation", patch[1].Op, patch[1].Path, patch[1].Value)
+	}
+}
+
+func TestWebhookNoOp(t *testing.T) {
+	for _, name := range []string{"already-injected.json", "no-annotations.json"} {
+		resp := mutateFixture(t, name)
+		if resp.Patch != nil || resp.PatchType != "" || len(resp.Warnings) != 0 {
+			t.Errorf("%s: got %+v, want the pod admitted unchanged", name, resp)
+		}
+	}
+}
+
+func TestWebhookBadPort(t *testing.T) {
+	tests := []struct{ fixture, warning string }{
+		{"bad-port.json", `"metrics" is not a port`},
+		{"bad-target-port.json", `invalid check-conn.io/target-port annotation: "0" is not a port`},
+	}
+	for _, tt := range tests {
+		resp := mutateFixture(t, tt.fixture)
+		// Fails open: the pod is admitted without the sidecar, with a warning why
+		if resp.Patch != nil {
+			t.Errorf("%s: patched a pod with an invalid port annotation: %s", tt.fixture, resp.Patch)
+		}
+		if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], tt.warning) {
+			t.Errorf("%s: warnings = %q, want %s", tt.fixture, resp.Warnings, tt.warning)
+		}
+	}
+}
+
+// applyJSONPatch applies add and replace operations on object members the way RFC 6902 does: replace
+// needs the member to exist, add creates or overwrites it.
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) error {
+	for _, op := range ops {
+		parts := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+		parent := doc
+		for _, p := range parts[:len(parts)-1] {
+			switch v := parent.(type) {
+			case map[string]interface{}:
+				parent = v[p]
+			case []interface{}:
+				i, err := strconv.Atoi(p)
+				if err != nil || i >= len(v) {
+					return fmt.Errorf("%s: no element %s", op.Path, p)
+				}
+				parent = v[i]
+			default:
+				return fmt.Errorf("%s: no member %s", op.Path, p)
+			}
+		}
+		obj, ok := parent.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: parent is not an object", op.Path)
+		}
+		last := parts[len(parts)-1]
+		if _, exists := obj[last]; op.Op == "replace" && !exists {
+			return fmt.Errorf("%s: replace of a missing member", op.Path)
+		}
+		obj[last] = op.Value
+	}
+	return nil
+}
+
+func TestPatchCABundleOnManifest(t *testing.T) {
+	manifest, err := json.Marshal(webhookManifest("check-conn-injector", "check-conn-webhook", "fpms", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	manifestFile := filepath.Join(dir, "manifest.json")
+	patchFile := filepath.Join(dir, "patch.json")
+	if err := os.WriteFile(manifestFile, manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// kubectl patch mutatingwebhookconfiguration <name> --type=json -p <patch>
+	standInKubectl(t, `case "$1" in
+get) cat `+manifestFile+` ;;
+patch) printf '%s' "$6" > `+patchFile+` ;;
+esac
+`)
+
+	if err := patchCABundle("check-conn-injector", []byte("test CA")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(patchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(manifest, &doc)
+	if err := applyJSONPatch(doc, ops); err != nil {
+		t.Fatalf("patch does not apply to the generated manifest: %v", err)
+	}
+	// Applied again, over the caBundle the first one set
+	if err := applyJSONPatch(doc, ops); err != nil {
+		t.Fatalf("patch does not apply over a set caBundle: %v", err)
+	}
+	webhook := doc["webhooks"].([]interface{})[0].(map[string]interface{})
+	if got := webhook["clientConfig"].(map[string]interface{})["caBundle"]; got != base64.StdEncoding.EncodeToString([]byte("test CA")) {
+		t.Errorf("caBundle = %v", got)
+	}
+}